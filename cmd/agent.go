@@ -1 +1,396 @@
 package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/types"
+	"github.com/King-kin5/analysis/processing"
+)
+
+// maxScrapeSize bounds a single profile fetched from a target
+const maxScrapeSize = 256 << 20
+
+// AgentTarget is a process exposing the net/http/pprof endpoints
+type AgentTarget struct {
+	ApplicationID string
+	URL           string
+}
+
+// SidecarConfig represents configuration for the sidecar agent. It is built
+// from flags and the environment only.
+type SidecarConfig struct {
+	ServerURL    string
+	Targets      []AgentTarget
+	Interval     time.Duration
+	CPUDuration  time.Duration
+	ProfileTypes []types.ProfileType
+	Language     string
+	Labels       types.Labels
+	LogLevel     string
+	// APIKey is read from PROFILER_API_KEY rather than a flag so that it
+	// does not show up in process listings
+	APIKey string
+}
+
+// scrapePaths maps profile types to their net/http/pprof endpoint
+var scrapePaths = map[types.ProfileType]string{
+	types.ProfileTypeCPU:          "/debug/pprof/profile",
+	types.ProfileTypeHeap:         "/debug/pprof/heap",
+	types.ProfileTypeAllocs:       "/debug/pprof/allocs",
+	types.ProfileTypeBlock:        "/debug/pprof/block",
+	types.ProfileTypeMutex:        "/debug/pprof/mutex",
+	types.ProfileTypeGoroutine:    "/debug/pprof/goroutine",
+	types.ProfileTypeThreadCreate: "/debug/pprof/threadcreate",
+	types.ProfileTypeTrace:        "/debug/pprof/trace",
+}
+
+// windowedTypes are scraped over CPUDuration. Block, mutex and allocs
+// profiles then hold the counts of that window instead of the totals since
+// the target started, which would grow with every scrape.
+var windowedTypes = map[types.ProfileType]bool{
+	types.ProfileTypeCPU:    true,
+	types.ProfileTypeTrace:  true,
+	types.ProfileTypeBlock:  true,
+	types.ProfileTypeMutex:  true,
+	types.ProfileTypeAllocs: true,
+}
+
+// targetsFlag collects repeated --target app_id=url flags
+type targetsFlag []AgentTarget
+
+func (t *targetsFlag) String() string {
+	specs := make([]string, len(*t))
+	for i, target := range *t {
+		specs[i] = target.ApplicationID + "=" + target.URL
+	}
+	return strings.Join(specs, ",")
+}
+
+func (t *targetsFlag) Set(value string) error {
+	appID, url, ok := strings.Cut(value, "=")
+	if !ok || appID == "" || url == "" {
+		return fmt.Errorf("target must be app_id=url, got %q", value)
+	}
+	*t = append(*t, AgentTarget{ApplicationID: appID, URL: strings.TrimRight(url, "/")})
+	return nil
+}
+
+// labelsFlag collects repeated --label key=value flags
+type labelsFlag types.Labels
+
+func (l *labelsFlag) String() string {
+	return types.Labels(*l).String()
+}
+
+func (l *labelsFlag) Set(value string) error {
+	labels, err := types.ParseLabels(value)
+	if err != nil {
+		return err
+	}
+	if *l == nil {
+		*l = make(labelsFlag)
+	}
+	for key, v := range labels {
+		(*l)[key] = v
+	}
+	return nil
+}
+
+// LoadSidecarConfig builds the sidecar configuration from command line flags,
+// falling back to PROFILER_SERVER_URL for the collector address
+func LoadSidecarConfig(args []string) (SidecarConfig, error) {
+	cfg := SidecarConfig{
+		ServerURL:   os.Getenv("PROFILER_SERVER_URL"),
+		APIKey:      os.Getenv("PROFILER_API_KEY"),
+		Interval:    time.Minute,
+		CPUDuration: 10 * time.Second,
+		Language:    "go",
+		LogLevel:    "info",
+	}
+	if cfg.ServerURL == "" {
+		cfg.ServerURL = "http://localhost:8080"
+	}
+
+	var (
+		targets targetsFlag
+		labels  labelsFlag
+	)
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.StringVar(&cfg.ServerURL, "server", cfg.ServerURL, "collector URL")
+	fs.Var(&targets, "target", "process to profile as app_id=url (repeatable)")
+	fs.Var(&labels, "label", "label attached to every session as key=value (repeatable)")
+	fs.DurationVar(&cfg.Interval, "interval", cfg.Interval, "time between scrapes of a target")
+	fs.DurationVar(&cfg.CPUDuration, "cpu-duration", cfg.CPUDuration, "window of each CPU, block, mutex and allocs profile and execution trace")
+	fs.StringVar(&cfg.Language, "language", cfg.Language, "language reported for the targets")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level (debug, info, warn, error)")
+	profiles := fs.String("profiles", "cpu,heap,block,mutex,goroutine", "comma separated profile types to scrape")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	cfg.Targets = targets
+	cfg.Labels = types.Labels(labels)
+	if len(cfg.Targets) == 0 {
+		return cfg, fmt.Errorf("at least one --target is required")
+	}
+	if cfg.CPUDuration < time.Second {
+		return cfg, fmt.Errorf("cpu duration must be at least 1s")
+	}
+	if cfg.Interval < cfg.CPUDuration {
+		return cfg, fmt.Errorf("interval must not be shorter than the cpu duration")
+	}
+
+	for _, name := range strings.Split(*profiles, ",") {
+		profileType := types.ProfileType(strings.TrimSpace(name))
+		if _, ok := scrapePaths[profileType]; !ok {
+			return cfg, fmt.Errorf("unsupported profile type: %s", name)
+		}
+		cfg.ProfileTypes = append(cfg.ProfileTypes, profileType)
+	}
+
+	return cfg, nil
+}
+
+// Sidecar periodically scrapes the pprof endpoints of target processes and
+// ships the results to a collector
+type Sidecar struct {
+	config     SidecarConfig
+	logger     *zap.Logger
+	collector  *processing.Client
+	httpClient *http.Client
+}
+
+// NewSidecar creates a new sidecar agent
+func NewSidecar(config SidecarConfig, logger *zap.Logger) *Sidecar {
+	if logger == nil {
+		logger, _ = zap.NewProduction()
+	}
+
+	collector := processing.NewClient(config.ServerURL, nil)
+	collector.SetAPIKey(config.APIKey)
+
+	return &Sidecar{
+		config:     config,
+		logger:     logger,
+		collector:  collector,
+		httpClient: &http.Client{Timeout: config.CPUDuration + 30*time.Second},
+	}
+}
+
+// Run scrapes every target once per interval until ctx is cancelled
+func (s *Sidecar) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, target := range s.config.Targets {
+		wg.Add(1)
+		go func(target AgentTarget) {
+			defer wg.Done()
+			s.runTarget(ctx, target)
+		}(target)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *Sidecar) runTarget(ctx context.Context, target AgentTarget) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.scrapeTarget(ctx, target); err != nil && ctx.Err() == nil {
+			s.logger.Error("Scrape failed",
+				zap.String("app_id", target.ApplicationID),
+				zap.String("url", target.URL),
+				zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrapeTarget collects one session worth of profiles from a target. All
+// profile types are fetched concurrently so the CPU profile does not delay
+// the others.
+func (s *Sidecar) scrapeTarget(ctx context.Context, target AgentTarget) error {
+	session := types.ProfileSession{
+		ID:            types.NewSessionID(target.ApplicationID),
+		ApplicationID: target.ApplicationID,
+		Name:          target.ApplicationID,
+		Language:      s.config.Language,
+		StartTime:     time.Now(),
+		ProfileType:   types.ProfileTypeCPU,
+		Mode:          types.ProfileModeSidecar,
+		Labels:        s.config.Labels,
+		Metadata: map[string]interface{}{
+			"target_url": target.URL,
+		},
+	}
+
+	// The session is created first so that keys restricted to the target's
+	// application may write its profiles, and updated once they are shipped
+	if err := s.collector.SendSession(ctx, &session); err != nil {
+		return fmt.Errorf("failed to send session: %w", err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		shipped int
+	)
+	for _, profileType := range s.config.ProfileTypes {
+		wg.Add(1)
+		go func(profileType types.ProfileType) {
+			defer wg.Done()
+
+			data, err := s.scrape(ctx, target, session.ID, profileType)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.logger.Warn("Failed to scrape profile",
+						zap.String("app_id", target.ApplicationID),
+						zap.String("type", string(profileType)),
+						zap.Error(err))
+				}
+				return
+			}
+
+			// Traces are large, so they skip the JSON encoding
+			if profileType == types.ProfileTypeTrace {
+				err = s.collector.UploadProfile(ctx, target.ApplicationID, data)
+			} else {
+				err = s.collector.SendProfileData(ctx, data)
+			}
+			if err != nil {
+				s.logger.Error("Failed to send profile data", zap.Error(err))
+				return
+			}
+
+			mu.Lock()
+			shipped++
+			mu.Unlock()
+		}(profileType)
+	}
+	wg.Wait()
+
+	if shipped == 0 {
+		return fmt.Errorf("no profiles collected")
+	}
+
+	session.EndTime = time.Now()
+	session.Duration = session.EndTime.Sub(session.StartTime)
+
+	// The session may outlive a cancelled scrape, so update it regardless
+	sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if err := s.collector.SendSession(sendCtx, &session); err != nil {
+		return fmt.Errorf("failed to send session: %w", err)
+	}
+
+	s.logger.Info("Target scraped",
+		zap.String("app_id", target.ApplicationID),
+		zap.String("session_id", session.ID),
+		zap.Int("profiles", shipped))
+
+	return nil
+}
+
+func (s *Sidecar) scrape(ctx context.Context, target AgentTarget, sessionID string, profileType types.ProfileType) (*types.ProfileData, error) {
+	url := target.URL + scrapePaths[profileType]
+	if windowedTypes[profileType] {
+		url += fmt.Sprintf("?seconds=%d", int(s.config.CPUDuration.Seconds()))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	data, err := readLimited(resp.Body, maxScrapeSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", url, err)
+	}
+
+	profileData := &types.ProfileData{
+		SessionID: sessionID,
+		Type:      profileType,
+		Timestamp: time.Now(),
+		Data:      data,
+		Metadata: map[string]interface{}{
+			"source": url,
+		},
+	}
+
+	if profileType == types.ProfileTypeTrace {
+		if !collection.IsTrace(data) {
+			return nil, fmt.Errorf("%s: not a runtime execution trace", url)
+		}
+		profileData.SampleCount = int64(len(data))
+		return profileData, nil
+	}
+
+	p, err := collection.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	profileData.SampleCount = int64(len(p.Sample))
+
+	return profileData, nil
+}
+
+// readLimited reads r to the end, failing rather than truncating when it
+// holds more than limit bytes
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+// RunAgent runs the sidecar agent until ctx is cancelled
+func RunAgent(ctx context.Context, args []string) error {
+	cfg, err := LoadSidecarConfig(args)
+	if err != nil {
+		return err
+	}
+
+	logger, err := NewLogger(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	logger.Info("Sidecar agent started",
+		zap.String("server", cfg.ServerURL),
+		zap.Int("targets", len(cfg.Targets)),
+		zap.Duration("interval", cfg.Interval))
+
+	return NewSidecar(cfg, logger).Run(ctx)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"go.uber.org/zap"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		size    int
+		wantErr bool
+	}{
+		{0, false},
+		{9, false},
+		{10, false},
+		{11, true},
+		{1000, true},
+	}
+	for _, tt := range tests {
+		data, err := readLimited(strings.NewReader(strings.Repeat("x", tt.size)), 10)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d bytes: err = %v, want error %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		if err == nil && len(data) != tt.size {
+			t.Errorf("%d bytes: read %d", tt.size, len(data))
+		}
+	}
+}
+
+func TestScrapeWindows(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "main.work", Filename: "/app/work.go"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 42}}}
+	data, err := collection.Encode(&profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "contentions", Unit: "count"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{1}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		queries = make(map[string]string)
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries[r.URL.Path] = r.URL.RawQuery
+		mu.Unlock()
+		w.Write(data)
+	}))
+	defer target.Close()
+
+	sidecar := NewSidecar(SidecarConfig{ServerURL: "http://127.0.0.1:0", CPUDuration: 5 * time.Second}, zap.NewNop())
+	tests := []struct {
+		profileType types.ProfileType
+		query       string
+	}{
+		{types.ProfileTypeBlock, "seconds=5"},
+		{types.ProfileTypeMutex, "seconds=5"},
+		{types.ProfileTypeAllocs, "seconds=5"},
+		{types.ProfileTypeHeap, ""},
+		{types.ProfileTypeGoroutine, ""},
+	}
+	for _, tt := range tests {
+		if _, err := sidecar.scrape(context.Background(), AgentTarget{URL: target.URL}, "s", tt.profileType); err != nil {
+			t.Errorf("scrape %s: %v", tt.profileType, err)
+			continue
+		}
+		mu.Lock()
+		query := queries[scrapePaths[tt.profileType]]
+		mu.Unlock()
+		if query != tt.query {
+			t.Errorf("%s scraped with query %q, want %q", tt.profileType, query, tt.query)
+		}
+	}
+}
@@ -1 +1,42 @@
 package cmd
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// webFS holds the dashboard's pages, scripts and styles. Everything the UI
+// needs is embedded so the binary works on hosts without internet access.
+//
+//go:embed web
+var webFS embed.FS
+
+// RegisterDashboard mounts the web dashboard on the collector's router. The
+// dashboard talks to the collector through the /api/v1 routes, which must be
+// registered before it.
+func RegisterDashboard(router *mux.Router) error {
+	assets, err := fs.Sub(webFS, "web")
+	if err != nil {
+		return fmt.Errorf("failed to load dashboard assets: %w", err)
+	}
+
+	index, err := fs.ReadFile(assets, "index.html")
+	if err != nil {
+		return fmt.Errorf("failed to load dashboard index: %w", err)
+	}
+
+	router.PathPrefix("/static/").Handler(
+		http.StripPrefix("/static/", http.FileServer(http.FS(assets)))).Methods("GET")
+
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(index)
+	}).Methods("GET")
+
+	return nil
+}
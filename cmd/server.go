@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/King-kin5/analysis/pkg/auth"
+	"github.com/King-kin5/analysis/pkg/collector"
+	"github.com/King-kin5/analysis/pkg/retention"
+	"github.com/King-kin5/analysis/pkg/storage"
+)
+
+// ServerConfig represents configuration for the profiler server
+type ServerConfig struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	DataDir   string `json:"data_dir"`
+	Storage   string `json:"storage"`
+	LogLevel  string `json:"log_level"`
+	Dashboard bool   `json:"dashboard"`
+	// Retention is only read from the config file
+	Retention retention.Config `json:"retention"`
+	Auth      AuthConfig       `json:"auth"`
+}
+
+// AuthConfig enables API key authentication on the collector API
+type AuthConfig struct {
+	Enabled bool `json:"enabled"`
+	// AdminKey is accepted as an admin key for all applications, e.g. to
+	// create the first keys. It is read from the config file or
+	// PROFILER_ADMIN_KEY only, never from a flag.
+	AdminKey string `json:"admin_key,omitempty"`
+}
+
+// minAdminKeyLength keeps configured admin keys from being guessable
+const minAdminKeyLength = 16
+
+// DefaultServerConfig returns the configuration used when nothing is set
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Port:      8080,
+		DataDir:   "./profiler-data",
+		Storage:   "file",
+		LogLevel:  "info",
+		Dashboard: true,
+	}
+}
+
+// LoadServerConfig builds the server configuration from, in increasing order
+// of precedence: defaults, a JSON config file, PROFILER_* environment
+// variables and command line flags. The config file is named by --config or
+// PROFILER_CONFIG.
+func LoadServerConfig(args []string) (ServerConfig, error) {
+	cfg := DefaultServerConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("PROFILER_CONFIG"), "path to a JSON config file")
+	host := fs.String("host", cfg.Host, "address to listen on")
+	port := fs.Int("port", cfg.Port, "port to listen on")
+	dataDir := fs.String("data-dir", cfg.DataDir, "directory holding profiling data")
+	storageKind := fs.String("storage", cfg.Storage, "storage backend (file, sqlite)")
+	logLevel := fs.String("log-level", cfg.LogLevel, "log level (debug, info, warn, error)")
+	dashboard := fs.Bool("dashboard", cfg.Dashboard, "serve the web dashboard")
+	authEnabled := fs.Bool("auth", cfg.Auth.Enabled, "require API keys on the collector API")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	}
+
+	if err := applyServerEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.Host = *host
+		case "port":
+			cfg.Port = *port
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "storage":
+			cfg.Storage = *storageKind
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "dashboard":
+			cfg.Dashboard = *dashboard
+		case "auth":
+			cfg.Auth.Enabled = *authEnabled
+		}
+	})
+
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return cfg, fmt.Errorf("invalid port: %d", cfg.Port)
+	}
+	if cfg.DataDir == "" {
+		return cfg, fmt.Errorf("data directory is required")
+	}
+	if cfg.Storage != "file" && cfg.Storage != "sqlite" {
+		return cfg, fmt.Errorf("invalid storage: %s", cfg.Storage)
+	}
+	if err := cfg.Retention.Validate(); err != nil {
+		return cfg, err
+	}
+	if cfg.Auth.AdminKey != "" && len(cfg.Auth.AdminKey) < minAdminKeyLength {
+		return cfg, fmt.Errorf("admin key must be at least %d characters", minAdminKeyLength)
+	}
+
+	return cfg, nil
+}
+
+func applyServerEnv(cfg *ServerConfig) error {
+	if v := os.Getenv("PROFILER_HOST"); v != "" {
+		cfg.Host = v
+	}
+	if v := os.Getenv("PROFILER_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid PROFILER_PORT: %s", v)
+		}
+		cfg.Port = port
+	}
+	if v := os.Getenv("PROFILER_DATA_DIR"); v != "" {
+		cfg.DataDir = v
+	}
+	if v := os.Getenv("PROFILER_STORAGE"); v != "" {
+		cfg.Storage = v
+	}
+	if v := os.Getenv("PROFILER_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv("PROFILER_DASHBOARD"); v != "" {
+		dashboard, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid PROFILER_DASHBOARD: %s", v)
+		}
+		cfg.Dashboard = dashboard
+	}
+	if v := os.Getenv("PROFILER_AUTH"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid PROFILER_AUTH: %s", v)
+		}
+		cfg.Auth.Enabled = enabled
+	}
+	if v := os.Getenv("PROFILER_ADMIN_KEY"); v != "" {
+		cfg.Auth.AdminKey = v
+	}
+	return nil
+}
+
+// NewLogger creates a production logger at the given level
+func NewLogger(level string) (*zap.Logger, error) {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %s", level)
+	}
+
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(lvl)
+	return cfg.Build()
+}
+
+// OpenStorage opens the storage backend selected by the configuration. The
+// SQLite database is kept as profiler.db in the data directory.
+func OpenStorage(cfg ServerConfig) (storage.Storage, error) {
+	switch cfg.Storage {
+	case "", "file":
+		return storage.NewFileStorage(cfg.DataDir)
+	case "sqlite":
+		return storage.NewSQLiteStorage(filepath.Join(cfg.DataDir, "profiler.db"))
+	}
+	return nil, fmt.Errorf("invalid storage: %s", cfg.Storage)
+}
+
+// OpenKeyStore opens the API keys kept as api_keys.json in the data
+// directory. Authentication cannot be enabled without a way to administer
+// keys, so an admin key must be configured or already stored.
+func OpenKeyStore(cfg ServerConfig) (*auth.KeyStore, error) {
+	keys, err := auth.NewKeyStore(filepath.Join(cfg.DataDir, "api_keys.json"), cfg.Auth.AdminKey)
+	if err != nil {
+		return nil, err
+	}
+	if !keys.HasAdmin() {
+		return nil, fmt.Errorf("auth is enabled but no admin key is configured (set PROFILER_ADMIN_KEY)")
+	}
+	return keys, nil
+}
+
+// RunServer runs the collector server until ctx is cancelled
+func RunServer(ctx context.Context, args []string) error {
+	cfg, err := LoadServerConfig(args)
+	if err != nil {
+		return err
+	}
+
+	logger, err := NewLogger(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	store, err := OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	c := collector.NewCollector(store, logger)
+	if cfg.Auth.Enabled {
+		keys, err := OpenKeyStore(cfg)
+		if err != nil {
+			return err
+		}
+		c.SetKeyStore(keys)
+	}
+	if cfg.Dashboard {
+		if err := RegisterDashboard(c.GetRouter()); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Retention.Enabled() {
+		janitor := retention.NewJanitor(store, cfg.Retention, logger)
+		c.SetJanitor(janitor)
+
+		// Stop the janitor before the storage is closed
+		janitorCtx, stopJanitor := context.WithCancel(ctx)
+		janitorDone := make(chan struct{})
+		go func() {
+			defer close(janitorDone)
+			janitor.Start(janitorCtx)
+		}()
+		defer func() {
+			stopJanitor()
+			<-janitorDone
+		}()
+	}
+
+	logger.Info("Profiler server configured",
+		zap.String("data_dir", cfg.DataDir),
+		zap.String("storage", cfg.Storage),
+		zap.Bool("dashboard", cfg.Dashboard),
+		zap.Bool("auth", cfg.Auth.Enabled),
+		zap.Int("retention_policies", len(cfg.Retention.Policies)))
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	if err := c.Start(ctx, addr); err != nil {
+		return err
+	}
+
+	logger.Info("Profiler server stopped")
+	return nil
+}
@@ -0,0 +1,350 @@
+// Universal Profiler dashboard. Everything is rendered client side from the
+// collector's JSON API; no third party libraries are loaded.
+(function () {
+  "use strict";
+
+  const api = "/api/v1";
+  const frameHeight = 18;
+
+  const state = {
+    session: null,
+    flame: null,
+    zoom: null,
+  };
+
+  const $ = (id) => document.getElementById(id);
+
+  function el(tag, attrs, children) {
+    const node = document.createElement(tag);
+    Object.entries(attrs || {}).forEach(([k, v]) => {
+      if (k === "text") node.textContent = v;
+      else if (k === "class") node.className = v;
+      else if (k.startsWith("on")) node.addEventListener(k.slice(2), v);
+      else node.setAttribute(k, v);
+    });
+    (children || []).forEach((c) => node.appendChild(c));
+    return node;
+  }
+
+  // The API key of collectors that require one is asked for on the first
+  // 401 and kept in the browser's local storage
+  const keyStorage = "profiler-api-key";
+
+  async function getJSON(path) {
+    const key = localStorage.getItem(keyStorage);
+    const resp = await fetch(api + path, {
+      headers: key ? { Authorization: "Bearer " + key } : {},
+    });
+    if (resp.status === 401) {
+      // Another request may have asked for the key meanwhile
+      const current = localStorage.getItem(keyStorage);
+      if (current && current !== key) return getJSON(path);
+      const entered = window.prompt("API key (read scope):", "");
+      if (entered) {
+        localStorage.setItem(keyStorage, entered.trim());
+        return getJSON(path);
+      }
+      localStorage.removeItem(keyStorage);
+    }
+    const body = await resp.json().catch(() => ({}));
+    if (!resp.ok) throw new Error(body.error || resp.statusText);
+    return body;
+  }
+
+  function setStatus(text) {
+    $("status").textContent = text || "";
+  }
+
+  function formatDuration(ns) {
+    if (!ns) return "-";
+    const s = ns / 1e9;
+    if (s < 1) return (ns / 1e6).toFixed(0) + " ms";
+    if (s < 120) return s.toFixed(1) + " s";
+    return (s / 60).toFixed(1) + " min";
+  }
+
+  function formatValue(v, unit) {
+    if (unit === "nanoseconds") return formatDuration(v);
+    if (unit === "bytes") {
+      const units = ["B", "KB", "MB", "GB", "TB"];
+      let i = 0;
+      while (v >= 1024 && i < units.length - 1) { v /= 1024; i++; }
+      return v.toFixed(i ? 1 : 0) + " " + units[i];
+    }
+    return Math.round(v).toLocaleString();
+  }
+
+  // Applications and sessions
+
+  async function loadApplications() {
+    setStatus("Loading sessions...");
+    const sessions = (await getJSON("/sessions?fields=id,application_id,name,start_time")) || [];
+    const apps = new Map();
+    sessions.forEach((s) => {
+      const id = s.application_id || "(none)";
+      if (!apps.has(id)) apps.set(id, []);
+      apps.get(id).push(s);
+    });
+
+    const list = $("applications");
+    list.innerHTML = "";
+    [...apps.keys()].sort().forEach((appID) => {
+      const items = apps.get(appID)
+        .sort((a, b) => new Date(b.start_time) - new Date(a.start_time))
+        .map((s) => el("li", {}, [
+          el("a", {
+            href: "#" + encodeURIComponent(s.id),
+            class: "session-link",
+            title: s.id,
+            "data-session": s.id,
+            text: new Date(s.start_time).toLocaleString() + " · " + (s.name || s.id),
+          }),
+        ]));
+      const sub = el("ul", {}, items);
+      list.appendChild(el("li", { class: "app" }, [
+        el("span", { text: appID + " (" + items.length + ")", onclick: () => { sub.hidden = !sub.hidden; } }),
+        sub,
+      ]));
+    });
+
+    setStatus(sessions.length + " sessions");
+  }
+
+  async function showSession(sessionID) {
+    document.querySelectorAll(".session-link").forEach((a) => {
+      a.classList.toggle("active", a.dataset.session === sessionID);
+    });
+
+    let session;
+    try {
+      session = await getJSON("/sessions/" + encodeURIComponent(sessionID));
+    } catch (err) {
+      setStatus(err.message);
+      return;
+    }
+    state.session = session;
+
+    $("empty").hidden = true;
+    $("session").hidden = false;
+    $("session-title").textContent = session.name || session.id;
+
+    const details = $("session-details");
+    details.innerHTML = "";
+    [
+      ["Session", session.id],
+      ["Application", session.application_id],
+      ["Language", session.language || "-"],
+      ["Mode", session.mode || "-"],
+      ["Started", new Date(session.start_time).toLocaleString()],
+      ["Duration", formatDuration(session.duration)],
+    ].forEach(([k, v]) => {
+      details.appendChild(el("div", {}, [el("dt", { text: k }), el("dd", { text: v })]));
+    });
+
+    await loadProfileTypes(session.id);
+    await Promise.all([renderFlameGraph(), renderMetrics(session.id)]);
+  }
+
+  async function loadProfileTypes(sessionID) {
+    const select = $("profile-type");
+    select.innerHTML = "";
+    let profiles = [];
+    try {
+      profiles = (await getJSON("/profiles/" + encodeURIComponent(sessionID) + "?fields=type&limit=1000")) || [];
+    } catch (err) {
+      setStatus(err.message);
+    }
+    const types = [...new Set(profiles.map((p) => p.type))].filter((t) => t !== "io").sort();
+    types.forEach((t) => select.appendChild(el("option", { value: t, text: t })));
+    if (types.includes("cpu")) select.value = "cpu";
+  }
+
+  // Flame graph
+
+  function frameColor(name) {
+    let hash = 0;
+    for (let i = 0; i < name.length; i++) hash = (hash * 31 + name.charCodeAt(i)) | 0;
+    const hue = name.startsWith("runtime.") ? 200 : 10 + (Math.abs(hash) % 40);
+    const light = 60 + (Math.abs(hash >> 8) % 20);
+    return "hsl(" + hue + ", 80%, " + light + "%)";
+  }
+
+  function diffColor(frame) {
+    if (!frame.delta) return "hsl(0, 0%, 85%)";
+    const base = frame.base || 1;
+    const ratio = Math.min(Math.abs(frame.delta) / base, 1);
+    const light = 90 - ratio * 40;
+    return frame.delta > 0 ? "hsl(0, 80%, " + light + "%)" : "hsl(220, 80%, " + light + "%)";
+  }
+
+  async function renderFlameGraph() {
+    const container = $("flamegraph");
+    container.innerHTML = "";
+    $("flame-details").textContent = "";
+    state.flame = null;
+    state.zoom = null;
+
+    const type = $("profile-type").value;
+    if (!state.session || !type) {
+      container.appendChild(el("div", { class: "placeholder", text: "No pprof profiles in this session." }));
+      return;
+    }
+
+    const form = new FormData($("flame-controls"));
+    const params = new URLSearchParams({ type: type, min_width: "0.001" });
+    ["sample_index", "focus", "ignore"].forEach((k) => {
+      if (form.get(k)) params.set(k, form.get(k));
+    });
+    if (form.get("collapse_runtime")) params.set("collapse_runtime", "true");
+
+    setStatus("Rendering flame graph...");
+    try {
+      state.flame = await getJSON("/sessions/" + encodeURIComponent(state.session.id) + "/flamegraph?" + params);
+    } catch (err) {
+      container.appendChild(el("div", { class: "placeholder", text: err.message }));
+      setStatus("");
+      return;
+    }
+    state.zoom = state.flame;
+    drawFlame();
+    setStatus("");
+  }
+
+  function flameDepth(frame) {
+    let depth = 0;
+    (frame.children || []).forEach((c) => { depth = Math.max(depth, flameDepth(c)); });
+    return depth + 1;
+  }
+
+  function drawFlame() {
+    const container = $("flamegraph");
+    container.innerHTML = "";
+    const root = state.zoom;
+    if (!root || !root.value) {
+      container.appendChild(el("div", { class: "placeholder", text: "No samples." }));
+      return;
+    }
+
+    const width = container.clientWidth;
+    const depth = flameDepth(root);
+    container.style.height = depth * frameHeight + "px";
+    const query = $("flame-search").value;
+    let re = null;
+    try { re = query ? new RegExp(query) : null; } catch (e) { re = null; }
+    const diff = root.base !== undefined || root.target !== undefined;
+
+    const fragment = document.createDocumentFragment();
+    const draw = (frame, x, level) => {
+      const w = (frame.value / root.value) * width;
+      if (w < 1) return;
+      const div = el("div", {
+        class: "frame" + (re && re.test(frame.name) ? " match" : ""),
+        title: frame.name,
+        text: frame.name,
+      });
+      div.style.left = x + "px";
+      div.style.width = w + "px";
+      div.style.top = level * frameHeight + "px";
+      div.style.background = diff ? diffColor(frame) : frameColor(frame.name);
+      div.addEventListener("click", () => { state.zoom = frame; drawFlame(); });
+      div.addEventListener("mouseenter", () => {
+        const pct = ((frame.value / state.flame.value) * 100).toFixed(2);
+        $("flame-details").textContent = frame.name + " — " + Math.round(frame.value).toLocaleString() + " (" + pct + "%)";
+      });
+      fragment.appendChild(div);
+
+      let cx = x;
+      (frame.children || []).forEach((c) => {
+        draw(c, cx, level + 1);
+        cx += (c.value / root.value) * width;
+      });
+    };
+    draw(root, 0, 0);
+    container.appendChild(fragment);
+  }
+
+  // Metrics
+
+  const metricSeries = [
+    ["cpu_percent", "CPU %", ""],
+    ["memory_percent", "Memory %", ""],
+    ["heap_alloc", "Heap alloc", "bytes"],
+    ["goroutine_count", "Goroutines", ""],
+    ["io_read_bytes", "IO read", "bytes"],
+    ["io_write_bytes", "IO write", "bytes"],
+  ];
+
+  async function renderMetrics(sessionID) {
+    const container = $("metrics");
+    container.innerHTML = "";
+    let metrics = [];
+    try {
+      metrics = (await getJSON("/metrics/" + encodeURIComponent(sessionID))) || [];
+    } catch (err) {
+      container.appendChild(el("div", { class: "placeholder", text: err.message }));
+      return;
+    }
+
+    const charts = metricSeries
+      .filter(([key]) => metrics.some((m) => m[key]))
+      .map(([key, label, unit]) => lineChart(label, unit, metrics.map((m) => [new Date(m.timestamp).getTime(), m[key] || 0])));
+
+    if (!charts.length) {
+      container.appendChild(el("div", { class: "placeholder", text: "No metrics recorded for this session." }));
+      return;
+    }
+    charts.forEach((c) => container.appendChild(c));
+  }
+
+  function lineChart(label, unit, points) {
+    const ns = "http://www.w3.org/2000/svg";
+    const w = 400, h = 140, pad = 24;
+    points.sort((a, b) => a[0] - b[0]);
+    const xs = points.map((p) => p[0]);
+    const ys = points.map((p) => p[1]);
+    const minX = Math.min(...xs), maxX = Math.max(...xs);
+    const maxY = Math.max(...ys) || 1;
+
+    const svg = document.createElementNS(ns, "svg");
+    svg.setAttribute("viewBox", "0 0 " + w + " " + h);
+    svg.setAttribute("preserveAspectRatio", "none");
+
+    const line = document.createElementNS(ns, "polyline");
+    line.setAttribute("points", points.map(([x, y]) => {
+      const px = maxX === minX ? w / 2 : pad + ((x - minX) / (maxX - minX)) * (w - 2 * pad);
+      const py = h - pad - (y / maxY) * (h - 2 * pad);
+      return px.toFixed(1) + "," + py.toFixed(1);
+    }).join(" "));
+    svg.appendChild(line);
+
+    const maxLabel = document.createElementNS(ns, "text");
+    maxLabel.setAttribute("x", 4);
+    maxLabel.setAttribute("y", 12);
+    maxLabel.textContent = "max " + formatValue(maxY, unit);
+    svg.appendChild(maxLabel);
+
+    return el("div", { class: "chart" }, [el("h4", { text: label + " · " + points.length + " points" }), svg]);
+  }
+
+  // Wiring
+
+  $("flame-controls").addEventListener("submit", (e) => {
+    e.preventDefault();
+    renderFlameGraph();
+  });
+  $("profile-type").addEventListener("change", renderFlameGraph);
+  $("flame-reset").addEventListener("click", () => { state.zoom = state.flame; drawFlame(); });
+  $("flame-search").addEventListener("input", drawFlame);
+  window.addEventListener("resize", drawFlame);
+  window.addEventListener("hashchange", () => {
+    const id = decodeURIComponent(location.hash.slice(1));
+    if (id) showSession(id);
+  });
+
+  loadApplications()
+    .then(() => {
+      const id = decodeURIComponent(location.hash.slice(1));
+      if (id) showSession(id);
+    })
+    .catch((err) => setStatus(err.message));
+})();
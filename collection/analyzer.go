@@ -1 +1,245 @@
 package collection
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Profile is a decoded pprof profile together with the record it was read from
+type Profile struct {
+	SessionID string
+	Type      types.ProfileType
+	Timestamp time.Time
+
+	*profile.Profile
+}
+
+// SampleType describes one value column of a profile
+type SampleType struct {
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Unit  string `json:"unit"`
+}
+
+// Summary is a compact description of a decoded profile
+type Summary struct {
+	SessionID         string            `json:"session_id"`
+	Type              types.ProfileType `json:"type"`
+	Timestamp         time.Time         `json:"timestamp"`
+	SampleTypes       []SampleType      `json:"sample_types"`
+	DefaultSampleType string            `json:"default_sample_type,omitempty"`
+	PeriodType        *SampleType       `json:"period_type,omitempty"`
+	Period            int64             `json:"period"`
+	Duration          time.Duration     `json:"duration"`
+	Samples           int               `json:"samples"`
+	Locations         int               `json:"locations"`
+	Functions         int               `json:"functions"`
+	Mappings          int               `json:"mappings"`
+	Totals            map[string]int64  `json:"totals"`
+}
+
+// Parse decodes a raw pprof payload. Both gzip-compressed and uncompressed
+// protobuf encodings are accepted.
+func Parse(data []byte) (*profile.Profile, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty profile payload")
+	}
+
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pprof data: %w", err)
+	}
+
+	if err := p.CheckValid(); err != nil {
+		return nil, fmt.Errorf("invalid pprof data: %w", err)
+	}
+
+	return p, nil
+}
+
+// Decode parses the pprof payload carried by a stored profile record
+func Decode(data *types.ProfileData) (*Profile, error) {
+	p, err := Parse(data.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Profile{
+		SessionID: data.SessionID,
+		Type:      data.Type,
+		Timestamp: data.Timestamp,
+		Profile:   p,
+	}, nil
+}
+
+// Window returns the span of time the profile covers. The start comes from
+// the pprof data when present and falls back to the stored timestamp;
+// snapshots such as heap profiles cover a single instant.
+func (p *Profile) Window() (start, end time.Time) {
+	start = p.Timestamp
+	if p.TimeNanos > 0 {
+		start = time.Unix(0, p.TimeNanos)
+	}
+	return start, start.Add(time.Duration(p.DurationNanos))
+}
+
+// Overlaps reports whether the profile's window intersects [from, to]. A zero
+// bound leaves that side of the range open.
+func (p *Profile) Overlaps(from, to time.Time) bool {
+	start, end := p.Window()
+	if !to.IsZero() && start.After(to) {
+		return false
+	}
+	if !from.IsZero() && end.Before(from) {
+		return false
+	}
+	return true
+}
+
+// SampleTypes returns the value columns carried by every sample
+func (p *Profile) SampleTypes() []SampleType {
+	sampleTypes := make([]SampleType, len(p.SampleType))
+	for i, st := range p.SampleType {
+		sampleTypes[i] = SampleType{Index: i, Type: st.Type, Unit: st.Unit}
+	}
+	return sampleTypes
+}
+
+// SampleIndex resolves a sample type selector to a value index. The selector
+// may be empty (the profile's default sample type), a numeric index, or a
+// sample type name such as "cpu", "alloc_space" or "delay".
+func (p *Profile) SampleIndex(selector string) (int, error) {
+	if len(p.SampleType) == 0 {
+		return 0, fmt.Errorf("profile has no sample types")
+	}
+
+	if selector == "" {
+		selector = p.DefaultSampleType
+	}
+	if selector == "" {
+		return len(p.SampleType) - 1, nil
+	}
+
+	if n, err := strconv.Atoi(selector); err == nil {
+		if n < 0 || n >= len(p.SampleType) {
+			return 0, fmt.Errorf("sample index %d out of range [0..%d]", n, len(p.SampleType)-1)
+		}
+		return n, nil
+	}
+
+	return p.SampleIndexByName(selector)
+}
+
+// Total returns the sum of the given value column over all samples
+func (p *Profile) Total(index int) int64 {
+	var total int64
+	for _, s := range p.Sample {
+		if index < len(s.Value) {
+			total += s.Value[index]
+		}
+	}
+	return total
+}
+
+// Summary describes the profile's shape and per sample type totals
+func (p *Profile) Summary() *Summary {
+	summary := &Summary{
+		SessionID:         p.SessionID,
+		Type:              p.Type,
+		Timestamp:         p.Timestamp,
+		SampleTypes:       p.SampleTypes(),
+		DefaultSampleType: p.DefaultSampleType,
+		Period:            p.Period,
+		Duration:          time.Duration(p.DurationNanos),
+		Samples:           len(p.Sample),
+		Locations:         len(p.Location),
+		Functions:         len(p.Function),
+		Mappings:          len(p.Mapping),
+		Totals:            make(map[string]int64, len(p.SampleType)),
+	}
+
+	if p.PeriodType != nil {
+		summary.PeriodType = &SampleType{Type: p.PeriodType.Type, Unit: p.PeriodType.Unit}
+	}
+
+	for i, st := range p.SampleType {
+		summary.Totals[st.Type] = p.Total(i)
+	}
+
+	return summary
+}
+
+// Frame is one function frame of a sample's call stack
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file,omitempty"`
+	Line     int64  `json:"line,omitempty"`
+}
+
+// Stack expands a sample's locations into frames, leaf first, each carrying
+// the sampled source line. Inlined functions become frames of their own;
+// unsymbolized locations are named by their address.
+func Stack(sample *profile.Sample) []Frame {
+	var stack []Frame
+	for _, loc := range sample.Location {
+		if len(loc.Line) == 0 {
+			stack = append(stack, Frame{Function: fmt.Sprintf("0x%x", loc.Address)})
+			continue
+		}
+
+		for _, line := range loc.Line {
+			if line.Function == nil {
+				stack = append(stack, Frame{Function: fmt.Sprintf("0x%x", loc.Address)})
+				continue
+			}
+			stack = append(stack, Frame{
+				Function: line.Function.Name,
+				File:     line.Function.Filename,
+				Line:     line.Line,
+			})
+		}
+	}
+	return stack
+}
+
+// Encode serializes a profile as gzip-compressed pprof protobuf
+func Encode(p *profile.Profile) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, fmt.Errorf("failed to encode pprof data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DetectProfileType guesses the profile type from a profile's sample types.
+// Block and mutex profiles share the same sample types and are reported as
+// block. Heap and allocs profiles differ only in their default sample type.
+// An empty type is returned when nothing matches.
+func DetectProfileType(p *profile.Profile) types.ProfileType {
+	has := make(map[string]bool, len(p.SampleType))
+	for _, st := range p.SampleType {
+		has[st.Type] = true
+	}
+
+	switch {
+	case has["cpu"] || has["samples"] && p.PeriodType != nil && p.PeriodType.Type == "cpu":
+		return types.ProfileTypeCPU
+	case (has["inuse_space"] || has["alloc_space"]) && p.DefaultSampleType == "alloc_space":
+		return types.ProfileTypeAllocs
+	case has["inuse_space"] || has["alloc_space"]:
+		return types.ProfileTypeHeap
+	case has["goroutine"]:
+		return types.ProfileTypeGoroutine
+	case has["threadcreate"]:
+		return types.ProfileTypeThreadCreate
+	case has["contentions"] && has["delay"]:
+		return types.ProfileTypeBlock
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package collection
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// loadFixture decodes testdata/cpu.pb.gz, a CPU profile of main.main calling
+// main.work, which also inlines main.helper:
+//
+//	main.work  /app/work.go:42  <- main.main /app/main.go:12   7 samples
+//	main.work  /app/work.go:45  <- main.main /app/main.go:12   2 samples
+//	main.helper /app/work.go:53 inlined in main.work /app/work.go:44
+//	                            <- main.main /app/main.go:12   1 sample
+//
+// main.work starts at line 40 and main.main at line 10.
+func loadFixture(t *testing.T) *Profile {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/cpu.pb.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Decode(&types.ProfileData{SessionID: "s", Type: types.ProfileTypeCPU, Data: data})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return p
+}
+
+func TestParseFixture(t *testing.T) {
+	p := loadFixture(t)
+
+	summary := p.Summary()
+	if summary.Samples != 3 || summary.Functions != 3 || summary.Locations != 4 || summary.Mappings != 1 {
+		t.Errorf("summary = %d samples, %d functions, %d locations, %d mappings",
+			summary.Samples, summary.Functions, summary.Locations, summary.Mappings)
+	}
+	if summary.Totals["samples"] != 10 || summary.Totals["cpu"] != 100000000 {
+		t.Errorf("totals = %v", summary.Totals)
+	}
+
+	index, err := p.SampleIndex("cpu")
+	if err != nil || index != 1 {
+		t.Errorf("SampleIndex(cpu) = %d, %v", index, err)
+	}
+}
+
+func TestStack(t *testing.T) {
+	p := loadFixture(t)
+
+	tests := []struct {
+		sample int
+		want   []Frame
+	}{
+		{0, []Frame{
+			{Function: "main.work", File: "/app/work.go", Line: 42},
+			{Function: "main.main", File: "/app/main.go", Line: 12},
+		}},
+		{1, []Frame{
+			{Function: "main.work", File: "/app/work.go", Line: 45},
+			{Function: "main.main", File: "/app/main.go", Line: 12},
+		}},
+		{2, []Frame{
+			{Function: "main.helper", File: "/app/work.go", Line: 53},
+			{Function: "main.work", File: "/app/work.go", Line: 44},
+			{Function: "main.main", File: "/app/main.go", Line: 12},
+		}},
+	}
+	for _, tt := range tests {
+		if got := Stack(p.Sample[tt.sample]); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Stack(sample %d) = %+v, want %+v", tt.sample, got, tt.want)
+		}
+	}
+}
+
+func TestBuildCallGraphLines(t *testing.T) {
+	p := loadFixture(t)
+
+	graph, err := BuildCallGraph(p, 1)
+	if err != nil {
+		t.Fatalf("BuildCallGraph: %v", err)
+	}
+
+	nodes := make(map[string]*types.CallGraphNode)
+	for _, n := range graph.Nodes {
+		nodes[n.FunctionName] = n
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("got %d nodes, want one per function", len(graph.Nodes))
+	}
+
+	tests := []struct {
+		function    string
+		line        int
+		self, total float64
+	}{
+		{"main.main", 12, 0, 100000000},
+		{"main.work", 42, 90000000, 100000000},
+		{"main.helper", 53, 10000000, 10000000},
+	}
+	for _, tt := range tests {
+		n := nodes[tt.function]
+		if n == nil {
+			t.Errorf("%s: missing node", tt.function)
+			continue
+		}
+		if n.LineNumber != tt.line || n.SelfTime != tt.self || n.TotalTime != tt.total {
+			t.Errorf("%s: line %d self %v total %v, want line %d self %v total %v",
+				tt.function, n.LineNumber, n.SelfTime, n.TotalTime, tt.line, tt.self, tt.total)
+		}
+	}
+
+	work := nodes["main.main"].Children
+	if len(work) != 1 || work[0].FunctionName != "main.work" || work[0].LineNumber != 42 || work[0].TotalTime != 100000000 {
+		t.Errorf("main.main edges = %+v", work)
+	}
+}
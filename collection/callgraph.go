@@ -0,0 +1,170 @@
+package collection
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// CallGraph is a function level call graph computed for one sample type.
+// Each node is a function; its Children are the edges to the functions it
+// calls, carrying the edge weight in TotalTime.
+type CallGraph struct {
+	SessionID   string                 `json:"session_id"`
+	ProfileType types.ProfileType      `json:"profile_type"`
+	SampleType  SampleType             `json:"sample_type"`
+	Total       int64                  `json:"total"`
+	Nodes       []*types.CallGraphNode `json:"nodes"`
+}
+
+type edgeKey struct {
+	caller Frame
+	callee Frame
+}
+
+type graphNode struct {
+	node  *types.CallGraphNode
+	edges map[Frame]*types.CallGraphNode
+	// lines sums the value of the samples passing through each line
+	lines map[int64]int64
+}
+
+// functionFrame drops the line of a frame, so that the samples of every
+// line of a function reach the same node
+func functionFrame(f Frame) Frame {
+	return Frame{Function: f.Function, File: f.File}
+}
+
+// BuildCallGraph aggregates the samples of a profile into a call graph for
+// the given value index. A sample contributes to a function's TotalTime and to
+// each caller/callee edge at most once, so recursive frames are not counted
+// twice. Calls is the number of samples the function or edge appears in.
+// LineNumber is the function's line with the largest value.
+func BuildCallGraph(p *Profile, sampleIndex int) (*CallGraph, error) {
+	if sampleIndex < 0 || sampleIndex >= len(p.SampleType) {
+		return nil, fmt.Errorf("sample index %d out of range", sampleIndex)
+	}
+
+	graph := &CallGraph{
+		SessionID:   p.SessionID,
+		ProfileType: p.Type,
+		SampleType:  p.SampleTypes()[sampleIndex],
+	}
+
+	nodes := make(map[Frame]*graphNode)
+	nodeFor := func(f Frame) *graphNode {
+		if n, ok := nodes[f]; ok {
+			return n
+		}
+		n := &graphNode{
+			node: &types.CallGraphNode{
+				ID:           fmt.Sprintf("n%d", len(nodes)+1),
+				FunctionName: f.Function,
+				FileName:     f.File,
+			},
+			edges: make(map[Frame]*types.CallGraphNode),
+			lines: make(map[int64]int64),
+		}
+		nodes[f] = n
+		return n
+	}
+
+	for _, sample := range p.Sample {
+		value := sample.Value[sampleIndex]
+		if value == 0 {
+			continue
+		}
+		graph.Total += value
+
+		lines := Stack(sample)
+		if len(lines) == 0 {
+			continue
+		}
+		stack := make([]Frame, len(lines))
+		for i, f := range lines {
+			stack[i] = functionFrame(f)
+		}
+		seenLines := make(map[Frame]bool, len(lines))
+		for i, f := range lines {
+			if !seenLines[f] {
+				seenLines[f] = true
+				nodeFor(stack[i]).lines[f.Line] += value
+			}
+		}
+
+		seen := make(map[Frame]bool, len(stack))
+		seenEdges := make(map[edgeKey]bool, len(stack))
+		for i, f := range stack {
+			n := nodeFor(f)
+			if i == 0 {
+				n.node.SelfTime += float64(value)
+			}
+
+			if seen[f] {
+				if n.node.Metadata == nil {
+					n.node.Metadata = map[string]interface{}{}
+				}
+				n.node.Metadata["recursive"] = true
+			} else {
+				seen[f] = true
+				n.node.TotalTime += float64(value)
+				n.node.Calls++
+			}
+
+			if i == 0 {
+				continue
+			}
+
+			callee := stack[i-1]
+			ek := edgeKey{caller: f, callee: callee}
+			if seenEdges[ek] {
+				continue
+			}
+			seenEdges[ek] = true
+
+			edge, ok := n.edges[callee]
+			if !ok {
+				target := nodes[callee].node
+				edge = &types.CallGraphNode{
+					ID:           target.ID,
+					FunctionName: target.FunctionName,
+					FileName:     target.FileName,
+				}
+				n.edges[callee] = edge
+				n.node.Children = append(n.node.Children, edge)
+			}
+			edge.TotalTime += float64(value)
+			edge.Calls++
+		}
+	}
+
+	for _, n := range nodes {
+		var hottest int64
+		for line, value := range n.lines {
+			if value > hottest || value == hottest && line < int64(n.node.LineNumber) {
+				hottest = value
+				n.node.LineNumber = int(line)
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		for callee, edge := range n.edges {
+			edge.LineNumber = nodes[callee].node.LineNumber
+		}
+		sort.Slice(n.node.Children, func(i, j int) bool {
+			return n.node.Children[i].TotalTime > n.node.Children[j].TotalTime
+		})
+		graph.Nodes = append(graph.Nodes, n.node)
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		if graph.Nodes[i].TotalTime != graph.Nodes[j].TotalTime {
+			return graph.Nodes[i].TotalTime > graph.Nodes[j].TotalTime
+		}
+		return graph.Nodes[i].FunctionName < graph.Nodes[j].FunctionName
+	})
+
+	return graph, nil
+}
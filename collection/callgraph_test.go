@@ -0,0 +1,188 @@
+package collection
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// stackProfile builds a CPU profile from folded stack lines such as
+// "main;work;helper:12 3": frames root first, each a function with an
+// optional line, then the sample count. Every function lives in
+// /app/main.go.
+func stackProfile(t *testing.T, lines ...string) *Profile {
+	t.Helper()
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+	}
+	functions := make(map[string]*profile.Function)
+	locations := make(map[string]*profile.Location)
+
+	for _, line := range lines {
+		sep := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseInt(line[sep+1:], 10, 64)
+		if sep < 0 || err != nil {
+			t.Fatalf("invalid stack line %q", line)
+		}
+
+		frames := strings.Split(line[:sep], ";")
+		sample := &profile.Sample{Value: []int64{value}}
+		for i := len(frames) - 1; i >= 0; i-- {
+			loc, ok := locations[frames[i]]
+			if !ok {
+				name, lineNum := frames[i], int64(1)
+				if n, l, found := strings.Cut(frames[i], ":"); found {
+					name = n
+					if lineNum, err = strconv.ParseInt(l, 10, 64); err != nil {
+						t.Fatalf("invalid frame %q", frames[i])
+					}
+				}
+				fn, ok := functions[name]
+				if !ok {
+					fn = &profile.Function{ID: uint64(len(functions) + 1), Name: name, Filename: "/app/main.go"}
+					functions[name] = fn
+					p.Function = append(p.Function, fn)
+				}
+				loc = &profile.Location{ID: uint64(len(locations) + 1), Line: []profile.Line{{Function: fn, Line: lineNum}}}
+				locations[frames[i]] = loc
+				p.Location = append(p.Location, loc)
+			}
+			sample.Location = append(sample.Location, loc)
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+
+	return &Profile{SessionID: "s", Type: types.ProfileTypeCPU, Profile: p}
+}
+
+// graphNodes indexes the nodes of a call graph by function name
+func graphNodes(t *testing.T, graph *CallGraph) map[string]*types.CallGraphNode {
+	t.Helper()
+
+	nodes := make(map[string]*types.CallGraphNode)
+	for _, n := range graph.Nodes {
+		if nodes[n.FunctionName] != nil {
+			t.Fatalf("function %s has two nodes", n.FunctionName)
+		}
+		nodes[n.FunctionName] = n
+	}
+	return nodes
+}
+
+// edge returns the edge from caller to callee, or nil
+func edge(caller *types.CallGraphNode, callee string) *types.CallGraphNode {
+	for _, e := range caller.Children {
+		if e.FunctionName == callee {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestBuildCallGraphRecursion(t *testing.T) {
+	p := stackProfile(t,
+		"main;a;b;a 4",
+		"main;a 6",
+		"main;c;c;c 2",
+	)
+
+	graph, err := BuildCallGraph(p, 0)
+	if err != nil {
+		t.Fatalf("BuildCallGraph: %v", err)
+	}
+	if graph.Total != 12 {
+		t.Errorf("total = %d, want 12", graph.Total)
+	}
+	nodes := graphNodes(t, graph)
+
+	tests := []struct {
+		function    string
+		self, total float64
+		calls       int64
+		recursive   bool
+	}{
+		{"main", 0, 12, 3, false},
+		{"a", 10, 10, 2, true},
+		{"b", 0, 4, 1, false},
+		{"c", 2, 2, 1, true},
+	}
+	for _, tt := range tests {
+		n := nodes[tt.function]
+		if n == nil {
+			t.Errorf("%s: missing node", tt.function)
+			continue
+		}
+		recursive, _ := n.Metadata["recursive"].(bool)
+		if n.SelfTime != tt.self || n.TotalTime != tt.total || n.Calls != tt.calls || recursive != tt.recursive {
+			t.Errorf("%s: self %v total %v calls %d recursive %v, want self %v total %v calls %d recursive %v",
+				tt.function, n.SelfTime, n.TotalTime, n.Calls, recursive, tt.self, tt.total, tt.calls, tt.recursive)
+		}
+	}
+
+	// Each edge is counted once per sample, however often it repeats
+	edges := []struct {
+		caller, callee string
+		weight         float64
+		calls          int64
+	}{
+		{"main", "a", 10, 2},
+		{"a", "b", 4, 1},
+		{"b", "a", 4, 1},
+		{"main", "c", 2, 1},
+		{"c", "c", 2, 1},
+	}
+	for _, tt := range edges {
+		e := edge(nodes[tt.caller], tt.callee)
+		if e == nil {
+			t.Errorf("missing edge %s -> %s", tt.caller, tt.callee)
+			continue
+		}
+		if e.TotalTime != tt.weight || e.Calls != tt.calls || e.ID != nodes[tt.callee].ID {
+			t.Errorf("edge %s -> %s: weight %v calls %d id %s, want weight %v calls %d id %s",
+				tt.caller, tt.callee, e.TotalTime, e.Calls, e.ID, tt.weight, tt.calls, nodes[tt.callee].ID)
+		}
+	}
+	if e := edge(nodes["a"], "a"); e != nil {
+		t.Errorf("unexpected edge a -> a: %+v", e)
+	}
+}
+
+func TestBuildCallGraphEdgeWeights(t *testing.T) {
+	p := stackProfile(t,
+		"main;light 1",
+		"main;heavy:10 5",
+		"main;heavy:20 3",
+		"main;idle 0",
+	)
+
+	graph, err := BuildCallGraph(p, 0)
+	if err != nil {
+		t.Fatalf("BuildCallGraph: %v", err)
+	}
+	nodes := graphNodes(t, graph)
+
+	if nodes["idle"] != nil {
+		t.Error("zero-value sample produced a node")
+	}
+	if graph.Nodes[0].FunctionName != "main" || graph.Nodes[1].FunctionName != "heavy" {
+		t.Errorf("nodes not ordered by total: %s, %s", graph.Nodes[0].FunctionName, graph.Nodes[1].FunctionName)
+	}
+
+	children := nodes["main"].Children
+	if len(children) != 2 || children[0].FunctionName != "heavy" || children[0].TotalTime != 8 || children[1].TotalTime != 1 {
+		t.Fatalf("main edges = %+v, want heavy (8) before light (1)", children)
+	}
+	// Edges point at the callee's hottest line
+	if children[0].LineNumber != 10 || nodes["heavy"].LineNumber != 10 {
+		t.Errorf("heavy at line %d, edge at line %d, want 10", nodes["heavy"].LineNumber, children[0].LineNumber)
+	}
+
+	if _, err := BuildCallGraph(p, 1); err == nil {
+		t.Error("BuildCallGraph accepted an out of range sample index")
+	}
+}
@@ -0,0 +1,183 @@
+package collection
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Normalization selects how target values are scaled before comparison
+type Normalization string
+
+const (
+	// NormalizeNone compares raw values
+	NormalizeNone Normalization = "none"
+	// NormalizeTotal scales the target so both sides have the same total
+	NormalizeTotal Normalization = "total"
+	// NormalizeDuration scales the target to the base profile's duration
+	NormalizeDuration Normalization = "duration"
+)
+
+// FunctionDelta is the change of one function's flat and cumulative values
+// between a base and a target profile. Percentages are relative to the base
+// and omitted when the function is absent from it.
+type FunctionDelta struct {
+	Function         string   `json:"function"`
+	File             string   `json:"file,omitempty"`
+	BaseFlat         float64  `json:"base_flat"`
+	TargetFlat       float64  `json:"target_flat"`
+	BaseCum          float64  `json:"base_cum"`
+	TargetCum        float64  `json:"target_cum"`
+	FlatDelta        float64  `json:"flat_delta"`
+	CumDelta         float64  `json:"cum_delta"`
+	FlatDeltaPercent *float64 `json:"flat_delta_percent,omitempty"`
+	CumDeltaPercent  *float64 `json:"cum_delta_percent,omitempty"`
+}
+
+// Comparison is the differential view of two profiles of the same type
+type Comparison struct {
+	BaseSessionID   string           `json:"base_session_id"`
+	TargetSessionID string           `json:"target_session_id"`
+	SampleType      SampleType       `json:"sample_type"`
+	Normalization   Normalization    `json:"normalization"`
+	Scale           float64          `json:"scale"`
+	BaseTotal       float64          `json:"base_total"`
+	TargetTotal     float64          `json:"target_total"`
+	Functions       []*FunctionDelta `json:"functions"`
+}
+
+// ParseNormalization validates a normalization name, defaulting to total
+func ParseNormalization(name string) (Normalization, error) {
+	switch Normalization(name) {
+	case "":
+		return NormalizeTotal, nil
+	case NormalizeNone, NormalizeTotal, NormalizeDuration:
+		return Normalization(name), nil
+	}
+	return "", fmt.Errorf("unknown normalization: %s", name)
+}
+
+// TargetScale returns the factor applied to target values so they are
+// comparable with the base
+func TargetScale(base, target *Profile, baseIndex, targetIndex int, mode Normalization) (float64, error) {
+	switch mode {
+	case NormalizeNone:
+		return 1, nil
+	case NormalizeTotal:
+		baseTotal, targetTotal := base.Total(baseIndex), target.Total(targetIndex)
+		if baseTotal == 0 || targetTotal == 0 {
+			return 1, nil
+		}
+		return float64(baseTotal) / float64(targetTotal), nil
+	case NormalizeDuration:
+		if base.DurationNanos <= 0 || target.DurationNanos <= 0 {
+			return 0, fmt.Errorf("profiles carry no duration to normalize by")
+		}
+		return float64(base.DurationNanos) / float64(target.DurationNanos), nil
+	}
+	return 0, fmt.Errorf("unknown normalization: %s", mode)
+}
+
+// Compare computes per function deltas between two profiles. Target values
+// are multiplied by scale before comparison. Functions are ordered by the
+// absolute change of their cumulative value.
+func Compare(base, target *Profile, baseIndex, targetIndex int, scale float64) (*Comparison, error) {
+	if baseIndex < 0 || baseIndex >= len(base.SampleType) {
+		return nil, fmt.Errorf("base sample index %d out of range", baseIndex)
+	}
+	if targetIndex < 0 || targetIndex >= len(target.SampleType) {
+		return nil, fmt.Errorf("target sample index %d out of range", targetIndex)
+	}
+
+	comparison := &Comparison{
+		BaseSessionID:   base.SessionID,
+		TargetSessionID: target.SessionID,
+		SampleType:      base.SampleTypes()[baseIndex],
+		Scale:           scale,
+		BaseTotal:       float64(base.Total(baseIndex)),
+		TargetTotal:     float64(target.Total(targetIndex)) * scale,
+	}
+
+	deltas := make(map[Frame]*FunctionDelta)
+	deltaFor := func(f Frame) *FunctionDelta {
+		key := Frame{Function: f.Function, File: f.File}
+		d, ok := deltas[key]
+		if !ok {
+			d = &FunctionDelta{Function: f.Function, File: f.File}
+			deltas[key] = d
+		}
+		return d
+	}
+
+	for f, v := range functionValues(base, baseIndex) {
+		d := deltaFor(f)
+		d.BaseFlat = float64(v.flat)
+		d.BaseCum = float64(v.cum)
+	}
+	for f, v := range functionValues(target, targetIndex) {
+		d := deltaFor(f)
+		d.TargetFlat = float64(v.flat) * scale
+		d.TargetCum = float64(v.cum) * scale
+	}
+
+	for _, d := range deltas {
+		d.FlatDelta = d.TargetFlat - d.BaseFlat
+		d.CumDelta = d.TargetCum - d.BaseCum
+		d.FlatDeltaPercent = percentChange(d.BaseFlat, d.TargetFlat)
+		d.CumDeltaPercent = percentChange(d.BaseCum, d.TargetCum)
+		comparison.Functions = append(comparison.Functions, d)
+	}
+
+	sort.Slice(comparison.Functions, func(i, j int) bool {
+		a, b := comparison.Functions[i], comparison.Functions[j]
+		if math.Abs(a.CumDelta) != math.Abs(b.CumDelta) {
+			return math.Abs(a.CumDelta) > math.Abs(b.CumDelta)
+		}
+		return a.Function < b.Function
+	})
+
+	return comparison, nil
+}
+
+func percentChange(base, target float64) *float64 {
+	if base == 0 {
+		return nil
+	}
+	pct := (target - base) / base * 100
+	return &pct
+}
+
+type flatCum struct {
+	flat int64
+	cum  int64
+}
+
+// functionValues sums flat and cumulative values per function. A sample adds
+// to a function's cumulative value once even when the function recurses.
+func functionValues(p *Profile, index int) map[Frame]*flatCum {
+	values := make(map[Frame]*flatCum)
+	for _, sample := range p.Sample {
+		value := sample.Value[index]
+		if value == 0 {
+			continue
+		}
+
+		seen := make(map[Frame]bool)
+		for i, f := range Stack(sample) {
+			key := Frame{Function: f.Function, File: f.File}
+			v, ok := values[key]
+			if !ok {
+				v = &flatCum{}
+				values[key] = v
+			}
+			if i == 0 {
+				v.flat += value
+			}
+			if !seen[key] {
+				seen[key] = true
+				v.cum += value
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,98 @@
+package collection
+
+import "testing"
+
+func TestTargetScale(t *testing.T) {
+	base := stackProfile(t, "main;a 4", "main;b 6")
+	target := stackProfile(t, "main;a 10", "main;c 30")
+	empty := stackProfile(t, "main 0")
+	base.DurationNanos, target.DurationNanos = 10e9, 40e9
+
+	tests := []struct {
+		name          string
+		normalization string
+		target        *Profile
+		want          float64
+	}{
+		{"default", "", target, 0.25},
+		{"total", "total", target, 0.25},
+		{"duration", "duration", target, 0.25},
+		{"none", "none", target, 1},
+		{"empty target", "total", empty, 1},
+	}
+	for _, tt := range tests {
+		mode, err := ParseNormalization(tt.normalization)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		scale, err := TargetScale(base, tt.target, 0, 0, mode)
+		if err != nil || scale != tt.want {
+			t.Errorf("%s: scale = %v, %v, want %v", tt.name, scale, err, tt.want)
+		}
+	}
+
+	if _, err := ParseNormalization("median"); err == nil {
+		t.Error("ParseNormalization accepted median")
+	}
+	if _, err := TargetScale(base, empty, 0, 0, NormalizeDuration); err == nil {
+		t.Error("TargetScale normalized by duration without one")
+	}
+}
+
+func TestCompareMissingFrames(t *testing.T) {
+	base := stackProfile(t, "main;a 4", "main;b 6", "main;r;r 2")
+	target := stackProfile(t, "main;a 10", "main;c 10", "main;r;r 4")
+	target.SessionID = "t"
+
+	comparison, err := Compare(base, target, 0, 0, 0.5)
+	if err != nil {
+		t.Fatalf("Compare: %v", err)
+	}
+	if comparison.BaseSessionID != "s" || comparison.TargetSessionID != "t" {
+		t.Errorf("sessions = %s, %s", comparison.BaseSessionID, comparison.TargetSessionID)
+	}
+	if comparison.BaseTotal != 12 || comparison.TargetTotal != 12 {
+		t.Errorf("totals = %v, %v, want 12, 12", comparison.BaseTotal, comparison.TargetTotal)
+	}
+
+	percent := func(v float64) *float64 { return &v }
+	want := []struct {
+		function            string
+		baseCum, targetCum  float64
+		cumDelta, flatDelta float64
+		cumPercent          *float64
+	}{
+		// b vanished from the target and c is new to it
+		{"b", 6, 0, -6, -6, percent(-100)},
+		{"c", 0, 5, 5, 5, nil},
+		{"a", 4, 5, 1, 1, percent(25)},
+		{"main", 12, 12, 0, 0, percent(0)},
+		// Recursive frames count once per sample
+		{"r", 2, 2, 0, 0, percent(0)},
+	}
+	if len(comparison.Functions) != len(want) {
+		t.Fatalf("got %d functions, want %d", len(comparison.Functions), len(want))
+	}
+	for i, tt := range want {
+		d := comparison.Functions[i]
+		if d.Function != tt.function || d.File != "/app/main.go" {
+			t.Errorf("function %d = %s in %s, want %s", i, d.Function, d.File, tt.function)
+			continue
+		}
+		if d.BaseCum != tt.baseCum || d.TargetCum != tt.targetCum || d.CumDelta != tt.cumDelta || d.FlatDelta != tt.flatDelta {
+			t.Errorf("%s: cum %v -> %v (%v), flat delta %v, want cum %v -> %v (%v), flat delta %v",
+				tt.function, d.BaseCum, d.TargetCum, d.CumDelta, d.FlatDelta, tt.baseCum, tt.targetCum, tt.cumDelta, tt.flatDelta)
+		}
+		switch {
+		case tt.cumPercent == nil && d.CumDeltaPercent != nil:
+			t.Errorf("%s: cum percent = %v, want none", tt.function, *d.CumDeltaPercent)
+		case tt.cumPercent != nil && (d.CumDeltaPercent == nil || *d.CumDeltaPercent != *tt.cumPercent):
+			t.Errorf("%s: cum percent = %v, want %v", tt.function, d.CumDeltaPercent, *tt.cumPercent)
+		}
+	}
+
+	if _, err := Compare(base, target, 0, 1, 1); err == nil {
+		t.Error("Compare accepted an out of range sample index")
+	}
+}
@@ -0,0 +1,329 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// GoroutineGroup is a set of goroutines sharing the same state and stack
+type GoroutineGroup struct {
+	Count int64 `json:"count"`
+	// State is the scheduler state, e.g. "chan receive". Only text dumps
+	// carry it.
+	State string `json:"state,omitempty"`
+	// MaxWait is the longest time a goroutine of the group has been waiting,
+	// as reported by the runtime (minute resolution)
+	MaxWait time.Duration `json:"max_wait,omitempty"`
+	// Stack is leaf first; Frame.Line is the line the goroutine is at
+	Stack     []Frame `json:"stack"`
+	CreatedBy *Frame  `json:"created_by,omitempty"`
+	Summary   string  `json:"summary"`
+}
+
+// GoroutineReport groups the goroutines of a dump by state and stack
+type GoroutineReport struct {
+	SessionID string            `json:"session_id"`
+	Type      types.ProfileType `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Source    string            `json:"source"`
+	Total     int64             `json:"total"`
+	Groups    []*GoroutineGroup `json:"groups"`
+}
+
+// GroupGoroutines builds a report from a goroutine profile in pprof form.
+// The runtime already aggregates identical stacks; states are not available.
+func GroupGoroutines(p *Profile) *GoroutineReport {
+	report := &GoroutineReport{
+		SessionID: p.SessionID,
+		Type:      p.Type,
+		Timestamp: p.Timestamp,
+		Source:    "pprof",
+	}
+
+	groups := make(map[string]*GoroutineGroup)
+	for _, sample := range p.Sample {
+		count := sample.Value[0]
+		if count == 0 {
+			continue
+		}
+		report.Total += count
+
+		stack := make([]Frame, 0, len(sample.Location))
+		var key strings.Builder
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				f := Frame{Function: fmt.Sprintf("0x%x", loc.Address), Line: line.Line}
+				if line.Function != nil {
+					f.Function = line.Function.Name
+					f.File = line.Function.Filename
+				}
+				stack = append(stack, f)
+				fmt.Fprintf(&key, "%s:%d;", f.Function, f.Line)
+			}
+		}
+
+		g, ok := groups[key.String()]
+		if !ok {
+			g = &GoroutineGroup{Stack: stack}
+			groups[key.String()] = g
+		}
+		g.Count += count
+	}
+
+	report.Groups = sortedGroups(groups)
+	return report
+}
+
+var (
+	goroutineHeader = regexp.MustCompile(`^goroutine (\d+)(?: [^\[]*)? \[([^\]]*)\]:$`)
+	goroutineFile   = regexp.MustCompile(`^\t(.*):(\d+)(?: \+0x[0-9a-f]+)?$`)
+	goroutineWait   = regexp.MustCompile(`^(\d+) minutes?$`)
+)
+
+// ParseGoroutineDump groups a text goroutine dump, as written by
+// pprof.Lookup("goroutine").WriteTo(w, 2) or a panic traceback, by state
+// and stack.
+func ParseGoroutineDump(data []byte) (*GoroutineReport, error) {
+	report := &GoroutineReport{Source: "dump"}
+	groups := make(map[string]*GoroutineGroup)
+
+	var (
+		current   *GoroutineGroup
+		wait      time.Duration
+		lastFrame *Frame
+		createdBy bool
+	)
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+
+		var key strings.Builder
+		key.WriteString(current.State)
+		for _, f := range current.Stack {
+			fmt.Fprintf(&key, ";%s:%s:%d", f.Function, f.File, f.Line)
+		}
+
+		g, ok := groups[key.String()]
+		if !ok {
+			g = current
+			groups[key.String()] = g
+		}
+		g.Count++
+		if wait > g.MaxWait {
+			g.MaxWait = wait
+		}
+		report.Total++
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if m := goroutineHeader.FindStringSubmatch(line); m != nil {
+			flush()
+			current = &GoroutineGroup{}
+			wait = 0
+			lastFrame = nil
+			createdBy = false
+
+			for i, part := range strings.Split(m[2], ", ") {
+				if i == 0 {
+					current.State = part
+					continue
+				}
+				if w := goroutineWait.FindStringSubmatch(part); w != nil {
+					minutes, _ := strconv.Atoi(w[1])
+					wait = time.Duration(minutes) * time.Minute
+				}
+			}
+			continue
+		}
+
+		if current == nil || line == "" {
+			continue
+		}
+
+		if m := goroutineFile.FindStringSubmatch(line); m != nil {
+			if lastFrame != nil {
+				lastFrame.File = m[1]
+				lastFrame.Line, _ = strconv.ParseInt(m[2], 10, 64)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "created by ") {
+			name := strings.TrimPrefix(line, "created by ")
+			if i := strings.Index(name, " in goroutine "); i >= 0 {
+				name = name[:i]
+			}
+			current.CreatedBy = &Frame{Function: name}
+			lastFrame = current.CreatedBy
+			createdBy = true
+			continue
+		}
+
+		if createdBy || strings.HasPrefix(line, "...") {
+			continue
+		}
+
+		current.Stack = append(current.Stack, Frame{Function: trimCallArgs(line)})
+		lastFrame = &current.Stack[len(current.Stack)-1]
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading goroutine dump: %w", err)
+	}
+	if report.Total == 0 {
+		return nil, fmt.Errorf("no goroutines found in dump")
+	}
+
+	report.Groups = sortedGroups(groups)
+	return report, nil
+}
+
+// trimCallArgs strips the argument list from a traceback call line,
+// "main.(*T).run(0xc000012345, ...)" becoming "main.(*T).run"
+func trimCallArgs(line string) string {
+	if !strings.HasSuffix(line, ")") {
+		return line
+	}
+	if i := strings.LastIndexByte(line, '('); i > 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func sortedGroups(groups map[string]*GoroutineGroup) []*GoroutineGroup {
+	sorted := make([]*GoroutineGroup, 0, len(groups))
+	for _, g := range groups {
+		g.Summary = groupSummary(g)
+		sorted = append(sorted, g)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Summary < sorted[j].Summary
+	})
+	return sorted
+}
+
+// groupSummary describes a group the way it is usually read out loud, e.g.
+// "1,203 goroutines blocked in chan receive at main.worker (main.go:42)"
+func groupSummary(g *GoroutineGroup) string {
+	noun := "goroutines"
+	if g.Count == 1 {
+		noun = "goroutine"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", formatCount(g.Count), noun)
+
+	switch g.State {
+	case "":
+	case "running", "runnable", "syscall":
+		fmt.Fprintf(&b, " %s", g.State)
+	default:
+		fmt.Fprintf(&b, " blocked in %s", g.State)
+	}
+
+	if f := userFrame(g.Stack); f != nil {
+		fmt.Fprintf(&b, " at %s", f.Function)
+		if f.File != "" {
+			fmt.Fprintf(&b, " (%s:%d)", shortPath(f.File), f.Line)
+		}
+	}
+
+	return b.String()
+}
+
+// userFrame returns the innermost frame outside of the Go runtime, which is
+// where the goroutine is blocked from the application's point of view
+func userFrame(stack []Frame) *Frame {
+	for i := range stack {
+		name := stack[i].Function
+		if !strings.HasPrefix(name, "runtime.") && !strings.HasPrefix(name, "internal/") &&
+			!strings.HasPrefix(name, "sync.runtime_") {
+			return &stack[i]
+		}
+	}
+	if len(stack) > 0 {
+		return &stack[0]
+	}
+	return nil
+}
+
+func shortPath(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
+func formatCount(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// GoroutineReport groups the goroutines of the latest goroutine capture of a
+// session. A text dump is preferred over the pprof form when the session has
+// one, since only dumps record goroutine states. Only the payload of the
+// capture used is read.
+func (a *Analyzer) GoroutineReport(sessionID string) (*GoroutineReport, error) {
+	records, err := a.storage.ListProfiles(sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load profile data: %w", err)
+	}
+
+	isDump := func(record *types.ProfileData) bool {
+		format, _ := record.Metadata["format"].(string)
+		return format == types.ProfileFormatText
+	}
+	latestDump := latestRecord(records, types.ProfileTypeGoroutine, isDump)
+	latestProfile := latestRecord(records, types.ProfileTypeGoroutine, func(record *types.ProfileData) bool {
+		return !isDump(record)
+	})
+
+	if latestDump != nil {
+		if dump, err := a.loadRecord(latestDump); err == nil {
+			report, err := ParseGoroutineDump(dump.Data)
+			if err == nil {
+				report.SessionID = sessionID
+				report.Type = types.ProfileTypeGoroutine
+				report.Timestamp = dump.Timestamp
+				return report, nil
+			}
+		}
+	}
+
+	if latestProfile == nil {
+		return nil, fmt.Errorf("%w: session %s, type %s", ErrNoProfiles, sessionID, types.ProfileTypeGoroutine)
+	}
+
+	record, err := a.loadRecord(latestProfile)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Decode(record)
+	if err != nil {
+		return nil, err
+	}
+	return GroupGoroutines(p), nil
+}
@@ -0,0 +1,98 @@
+package collection
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// workerGoroutine is the dump of a goroutine blocked in main.worker
+func workerGoroutine(header, arg string, line int) string {
+	return strings.Join([]string{
+		header,
+		"runtime.gopark(0x0?, 0x0?, 0x0?, 0x0?, 0x0?)",
+		"\t/usr/local/go/src/runtime/proc.go:398 +0xce",
+		"runtime.chanrecv(" + arg + ", 0x0, 0x1)",
+		"\t/usr/local/go/src/runtime/chan.go:583 +0x3cd",
+		"main.worker(" + arg + ")",
+		"\t/app/worker.go:" + strconv.Itoa(line) + " +0x45",
+		"created by main.start in goroutine 1",
+		"\t/app/main.go:20 +0x66",
+		"",
+	}, "\n")
+}
+
+func TestParseGoroutineDump(t *testing.T) {
+	dump := strings.Join([]string{
+		"goroutine 1 [running]:",
+		"main.main()",
+		"\t/app/main.go:10 +0x1d",
+		"",
+		workerGoroutine("goroutine 7 [chan receive, 5 minutes]:", "0xc000010000", 42),
+		workerGoroutine("goroutine 8 gp=0xc000102000 m=nil [chan receive, 12 minutes]:", "0xc000010060", 42),
+		workerGoroutine("goroutine 9 [chan receive]:", "0xc0000100c0", 42),
+		workerGoroutine("goroutine 10 [select]:", "0xc000010120", 42),
+		workerGoroutine("goroutine 11 [chan receive, 1 minute]:", "0xc000010180", 47),
+	}, "\n")
+
+	report, err := ParseGoroutineDump([]byte(dump))
+	if err != nil {
+		t.Fatalf("ParseGoroutineDump: %v", err)
+	}
+	if report.Total != 6 || report.Source != "dump" {
+		t.Errorf("total %d source %s, want 6 dump", report.Total, report.Source)
+	}
+
+	// Goroutines group by state and stack lines, whatever their arguments
+	want := []struct {
+		summary string
+		maxWait time.Duration
+	}{
+		{"3 goroutines blocked in chan receive at main.worker (worker.go:42)", 12 * time.Minute},
+		{"1 goroutine blocked in chan receive at main.worker (worker.go:47)", time.Minute},
+		{"1 goroutine blocked in select at main.worker (worker.go:42)", 0},
+		{"1 goroutine running at main.main (main.go:10)", 0},
+	}
+	if len(report.Groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(report.Groups), len(want))
+	}
+	for i, tt := range want {
+		g := report.Groups[i]
+		if g.Summary != tt.summary || g.MaxWait != tt.maxWait {
+			t.Errorf("group %d = %q waiting %v, want %q waiting %v", i, g.Summary, g.MaxWait, tt.summary, tt.maxWait)
+		}
+	}
+
+	worker := report.Groups[0]
+	stack := []Frame{
+		{Function: "runtime.gopark", File: "/usr/local/go/src/runtime/proc.go", Line: 398},
+		{Function: "runtime.chanrecv", File: "/usr/local/go/src/runtime/chan.go", Line: 583},
+		{Function: "main.worker", File: "/app/worker.go", Line: 42},
+	}
+	if !reflect.DeepEqual(worker.Stack, stack) {
+		t.Errorf("stack = %+v, want %+v", worker.Stack, stack)
+	}
+	if createdBy := worker.CreatedBy; createdBy == nil || *createdBy != (Frame{Function: "main.start", File: "/app/main.go", Line: 20}) {
+		t.Errorf("created by %+v, want main.start at main.go:20", createdBy)
+	}
+	if report.Groups[3].CreatedBy != nil {
+		t.Errorf("main goroutine created by %+v", report.Groups[3].CreatedBy)
+	}
+
+	if _, err := ParseGoroutineDump([]byte("no goroutines here\n")); err == nil {
+		t.Error("ParseGoroutineDump accepted a dump without goroutines")
+	}
+}
+
+func TestGroupSummaryCount(t *testing.T) {
+	g := &GoroutineGroup{Count: 1203, State: "IO wait", Stack: []Frame{
+		{Function: "internal/poll.runtime_pollWait"},
+		{Function: "net.(*conn).Read", File: "/go/src/net/net.go", Line: 179},
+	}}
+	want := "1,203 goroutines blocked in IO wait at net.(*conn).Read (net.go:179)"
+	if got := groupSummary(g); got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// ErrIncompatibleProfiles is returned when profiles with different sample
+// types are merged
+var ErrIncompatibleProfiles = errors.New("incompatible profiles")
+
+// Merge combines compatible profiles into one whose sample values are the sums
+// of the inputs. All profiles must carry the same sample types. The result
+// keeps the session ID and type shared by the inputs and the latest timestamp.
+func Merge(profiles []*Profile) (*Profile, error) {
+	if len(profiles) == 0 {
+		return nil, ErrNoProfiles
+	}
+
+	if len(profiles) == 1 {
+		return profiles[0], nil
+	}
+
+	first := profiles[0]
+	merged := &Profile{
+		SessionID: first.SessionID,
+		Type:      first.Type,
+		Timestamp: first.Timestamp,
+	}
+
+	srcs := make([]*profile.Profile, len(profiles))
+	for i, p := range profiles {
+		if err := checkCompatible(first, p); err != nil {
+			return nil, err
+		}
+
+		if p.SessionID != merged.SessionID {
+			merged.SessionID = ""
+		}
+		if p.Type != merged.Type {
+			merged.Type = ""
+		}
+		if p.Timestamp.After(merged.Timestamp) {
+			merged.Timestamp = p.Timestamp
+		}
+		srcs[i] = p.Profile
+	}
+
+	p, err := profile.Merge(srcs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIncompatibleProfiles, err)
+	}
+	merged.Profile = p
+
+	return merged, nil
+}
+
+// IsSnapshot reports whether each profile of a type describes the whole
+// process at the moment it was taken, such as the memory in use, the live
+// goroutines or the allocations since the process started. Adding snapshots
+// together counts the same state several times.
+func IsSnapshot(profileType types.ProfileType) bool {
+	switch profileType {
+	case types.ProfileTypeHeap, types.ProfileTypeMemory, types.ProfileTypeAllocs,
+		types.ProfileTypeGoroutine, types.ProfileTypeThreadCreate:
+		return true
+	}
+	return false
+}
+
+// Combine reduces profiles of one type, oldest first, to a single profile.
+// Profiles covering a window, such as CPU profiles and contention deltas, are
+// merged. Of snapshots only the latest of each session is kept, and those of
+// different sessions, that is of different processes, are merged.
+func Combine(profiles []*Profile) (*Profile, error) {
+	if len(profiles) == 0 || !IsSnapshot(profiles[0].Type) {
+		return Merge(profiles)
+	}
+
+	latest := make(map[string]int)
+	var snapshots []*Profile
+	for _, p := range profiles {
+		if i, ok := latest[p.SessionID]; ok {
+			snapshots[i] = p
+			continue
+		}
+		latest[p.SessionID] = len(snapshots)
+		snapshots = append(snapshots, p)
+	}
+	return Merge(snapshots)
+}
+
+func checkCompatible(a, b *Profile) error {
+	if len(a.SampleType) != len(b.SampleType) {
+		return fmt.Errorf("%w: %d sample types vs %d", ErrIncompatibleProfiles, len(a.SampleType), len(b.SampleType))
+	}
+
+	for i := range a.SampleType {
+		if a.SampleType[i].Type != b.SampleType[i].Type || a.SampleType[i].Unit != b.SampleType[i].Unit {
+			return fmt.Errorf("%w: sample type %s/%s vs %s/%s", ErrIncompatibleProfiles,
+				a.SampleType[i].Type, a.SampleType[i].Unit, b.SampleType[i].Type, b.SampleType[i].Unit)
+		}
+	}
+
+	return nil
+}
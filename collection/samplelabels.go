@@ -0,0 +1,128 @@
+package collection
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Unlabeled is the breakdown value of samples that do not carry the label
+const Unlabeled = "(none)"
+
+// SampleLabelKey describes one sample label key found in a profile, such as
+// a key set with pprof.Labels
+type SampleLabelKey struct {
+	Key     string `json:"key"`
+	Values  int    `json:"values"`
+	Samples int    `json:"samples"`
+}
+
+// LabelValue is one row of a label breakdown
+type LabelValue struct {
+	Value      string                 `json:"value"`
+	Samples    int                    `json:"samples"`
+	Total      int64                  `json:"total"`
+	Percent    float64                `json:"percent"`
+	FlameGraph *types.FlameGraphFrame `json:"flame_graph,omitempty"`
+}
+
+// LabelBreakdown aggregates a profile's samples by the value of one sample
+// label key
+type LabelBreakdown struct {
+	SessionID   string            `json:"session_id"`
+	ProfileType types.ProfileType `json:"profile_type"`
+	SampleType  SampleType        `json:"sample_type"`
+	Key         string            `json:"key"`
+	Total       int64             `json:"total"`
+	Values      []*LabelValue     `json:"values"`
+}
+
+// SampleLabelKeys lists the string sample label keys of a profile with the
+// number of distinct values and labelled samples of each, sorted by key
+func SampleLabelKeys(p *Profile) []*SampleLabelKey {
+	values := make(map[string]map[string]bool)
+	samples := make(map[string]int)
+	for _, sample := range p.Sample {
+		for key := range sample.Label {
+			if values[key] == nil {
+				values[key] = make(map[string]bool)
+			}
+			values[key][SampleLabel(sample, key)] = true
+			samples[key]++
+		}
+	}
+
+	keys := make([]*SampleLabelKey, 0, len(values))
+	for key, set := range values {
+		keys = append(keys, &SampleLabelKey{Key: key, Values: len(set), Samples: samples[key]})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// SampleLabel returns the value of a sample's label, Unlabeled when the
+// sample does not carry it. Several values are joined with commas.
+func SampleLabel(sample *profile.Sample, key string) string {
+	values := sample.Label[key]
+	if len(values) == 0 {
+		return Unlabeled
+	}
+	return strings.Join(values, ",")
+}
+
+// BreakdownByLabel sums the given value column per value of a sample label
+// key, largest first. Samples without the label are reported under Unlabeled.
+func BreakdownByLabel(p *Profile, key string, index int) (*LabelBreakdown, error) {
+	if index < 0 || index >= len(p.SampleType) {
+		return nil, fmt.Errorf("sample index %d out of range", index)
+	}
+	if key == "" {
+		return nil, fmt.Errorf("label key is required")
+	}
+
+	breakdown := &LabelBreakdown{
+		SessionID:   p.SessionID,
+		ProfileType: p.Type,
+		SampleType:  p.SampleTypes()[index],
+		Key:         key,
+	}
+
+	byValue := make(map[string]*LabelValue)
+	for _, sample := range p.Sample {
+		value := sample.Value[index]
+		if value == 0 {
+			continue
+		}
+		breakdown.Total += value
+
+		name := SampleLabel(sample, key)
+		v, ok := byValue[name]
+		if !ok {
+			v = &LabelValue{Value: name}
+			byValue[name] = v
+			breakdown.Values = append(breakdown.Values, v)
+		}
+		v.Samples++
+		v.Total += value
+	}
+
+	sort.Slice(breakdown.Values, func(i, j int) bool {
+		a, b := breakdown.Values[i], breakdown.Values[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return a.Value < b.Value
+	})
+
+	for _, v := range breakdown.Values {
+		v.Percent = percentOf(v.Total, breakdown.Total)
+	}
+
+	return breakdown, nil
+}
@@ -0,0 +1,96 @@
+package collection
+
+import (
+	"reflect"
+	"testing"
+)
+
+// labelledProfile is a CPU profile whose samples carry endpoint and tenant
+// labels
+func labelledProfile(t *testing.T) *Profile {
+	t.Helper()
+
+	p := stackProfile(t,
+		"main;checkout 5",
+		"main;checkout 3",
+		"main;search 4",
+		"main;gc 4",
+		"main;idle 0",
+	)
+	labels := []map[string][]string{
+		{"endpoint": {"/checkout"}, "tenant": {"a"}},
+		{"endpoint": {"/checkout"}, "tenant": {"b"}},
+		{"endpoint": {"/search"}, "tenant": {"a", "b"}},
+		nil,
+		{"endpoint": {"/idle"}},
+	}
+	for i, sample := range p.Sample {
+		sample.Label = labels[i]
+	}
+	return p
+}
+
+func TestSampleLabelKeys(t *testing.T) {
+	keys := SampleLabelKeys(labelledProfile(t))
+
+	want := []SampleLabelKey{
+		{Key: "endpoint", Values: 3, Samples: 4},
+		{Key: "tenant", Values: 3, Samples: 3},
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+	for i := range want {
+		if *keys[i] != want[i] {
+			t.Errorf("key %d = %+v, want %+v", i, *keys[i], want[i])
+		}
+	}
+
+	if keys := SampleLabelKeys(stackProfile(t, "main 1")); len(keys) != 0 {
+		t.Errorf("unlabelled profile has keys %+v", keys)
+	}
+}
+
+func TestBreakdownByLabel(t *testing.T) {
+	p := labelledProfile(t)
+
+	type row struct {
+		value   string
+		samples int
+		total   int64
+		percent float64
+	}
+	tests := []struct {
+		key  string
+		want []row
+	}{
+		{"endpoint", []row{{"/checkout", 2, 8, 50}, {Unlabeled, 1, 4, 25}, {"/search", 1, 4, 25}}},
+		// Several values of a key are reported together
+		{"tenant", []row{{"a", 1, 5, 31.25}, {Unlabeled, 1, 4, 25}, {"a,b", 1, 4, 25}, {"b", 1, 3, 18.75}}},
+		{"region", []row{{Unlabeled, 4, 16, 100}}},
+	}
+	for _, tt := range tests {
+		breakdown, err := BreakdownByLabel(p, tt.key, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.key, err)
+			continue
+		}
+		if breakdown.Total != 16 || breakdown.Key != tt.key {
+			t.Errorf("%s: total %d key %s, want 16", tt.key, breakdown.Total, breakdown.Key)
+		}
+		var got []row
+		for _, v := range breakdown.Values {
+			got = append(got, row{v.Value, v.Samples, v.Total, v.Percent})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: values = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	if _, err := BreakdownByLabel(p, "", 0); err == nil {
+		t.Error("BreakdownByLabel accepted an empty key")
+	}
+	if _, err := BreakdownByLabel(p, "endpoint", 1); err == nil {
+		t.Error("BreakdownByLabel accepted an out of range sample index")
+	}
+}
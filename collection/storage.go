@@ -1 +1,151 @@
 package collection
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// ErrNoProfiles is returned when a session holds no decodable profile of the
+// requested type
+var ErrNoProfiles = errors.New("no profiles found")
+
+// Analyzer loads stored profiling data and decodes it for analysis
+type Analyzer struct {
+	storage storage.Storage
+}
+
+// NewAnalyzer creates a new analyzer reading from the given storage
+func NewAnalyzer(store storage.Storage) *Analyzer {
+	return &Analyzer{
+		storage: store,
+	}
+}
+
+// SessionProfiles returns the decoded profiles of a session whose window
+// overlaps [from, to], oldest first. A zero bound leaves that side of the
+// range open and an empty profile type selects every type.
+func (a *Analyzer) SessionProfiles(sessionID string, profileType types.ProfileType, from, to time.Time) ([]*Profile, error) {
+	records, err := a.storage.GetProfileData(sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load profile data: %w", err)
+	}
+
+	return decodeProfiles(records, profileType, from, to), nil
+}
+
+// SessionProfile returns a single profile of the given type for a session,
+// restricted to [from, to]. When several profiles match, such as the windows
+// of a continuous session, they are merged into one, except for snapshot
+// types whose latest profile is returned.
+func (a *Analyzer) SessionProfile(sessionID string, profileType types.ProfileType, from, to time.Time) (*Profile, error) {
+	profiles, err := a.SessionProfiles(sessionID, profileType, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%w: session %s, type %s", ErrNoProfiles, sessionID, profileType)
+	}
+
+	return Combine(profiles)
+}
+
+// ApplicationProfiles returns the decoded profiles matching a storage query,
+// that is recorded by any session of an application within the query's time
+// range and labels, oldest first
+func (a *Analyzer) ApplicationProfiles(query storage.ProfileQuery) ([]*Profile, error) {
+	records, err := a.storage.QueryProfileData(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile data: %w", err)
+	}
+
+	return decodeProfiles(records, query.Type, query.From, query.To), nil
+}
+
+// ApplicationProfile merges every profile matching a storage query. Of
+// snapshot types only the latest profile of each session is merged.
+func (a *Analyzer) ApplicationProfile(query storage.ProfileQuery) (*Profile, error) {
+	profiles, err := a.ApplicationProfiles(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%w: application %s, type %s", ErrNoProfiles, query.ApplicationID, query.Type)
+	}
+
+	return Combine(profiles)
+}
+
+// decodeProfiles decodes the pprof records of the given type whose window
+// overlaps [from, to] and sorts them oldest first. Records whose payload is
+// not pprof (such as IO snapshots, text dumps and execution traces) are
+// skipped.
+func decodeProfiles(records []*types.ProfileData, profileType types.ProfileType, from, to time.Time) []*Profile {
+	var profiles []*Profile
+	for _, record := range records {
+		if profileType != "" && record.Type != profileType {
+			continue
+		}
+		if !isPprof(record) {
+			continue
+		}
+
+		p, err := Decode(record)
+		if err != nil {
+			continue
+		}
+		if !p.Overlaps(from, to) {
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].Timestamp.Before(profiles[j].Timestamp)
+	})
+
+	return profiles
+}
+
+// latestRecord returns the newest of a listing's profiles of a type that keep
+// accepts, or nil
+func latestRecord(records []*types.ProfileData, profileType types.ProfileType, keep func(*types.ProfileData) bool) *types.ProfileData {
+	var latest *types.ProfileData
+	for _, record := range records {
+		if record.Type != profileType || !keep(record) {
+			continue
+		}
+		if latest == nil || record.Timestamp.After(latest.Timestamp) {
+			latest = record
+		}
+	}
+	return latest
+}
+
+// loadRecord reads the payload of a profile from a metadata listing
+func (a *Analyzer) loadRecord(record *types.ProfileData) (*types.ProfileData, error) {
+	full, err := a.storage.GetProfile(record.SessionID, record.ID)
+	if err != nil {
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			return nil, fmt.Errorf("%w: session %s, type %s", ErrNoProfiles, record.SessionID, record.Type)
+		}
+		return nil, fmt.Errorf("failed to load profile data: %w", err)
+	}
+	return full, nil
+}
+
+// isPprof reports whether a record may hold a pprof profile, so payloads
+// known to be something else are not handed to the parser
+func isPprof(record *types.ProfileData) bool {
+	if record.Type == types.ProfileTypeTrace {
+		return false
+	}
+	format, _ := record.Metadata["format"].(string)
+	return format != types.ProfileFormatText
+}
@@ -0,0 +1,191 @@
+package collection
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// encodeProfile returns a pprof profile with one sample of the given value
+// for each sample type
+func encodeProfile(t *testing.T, sampleTypes []string, value int64) []byte {
+	t.Helper()
+
+	fn := &profile.Function{ID: 1, Name: "main.work", Filename: "/app/work.go"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 42}}}
+	p := &profile.Profile{
+		Sample:   []*profile.Sample{{Location: []*profile.Location{loc}}},
+		Location: []*profile.Location{loc},
+		Function: []*profile.Function{fn},
+	}
+	for _, st := range sampleTypes {
+		p.SampleType = append(p.SampleType, &profile.ValueType{Type: st, Unit: "count"})
+		p.Sample[0].Value = append(p.Sample[0].Value, value)
+	}
+
+	data, err := Encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSessionProfileSnapshots(t *testing.T) {
+	store, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	analyzer := NewAnalyzer(store)
+
+	start := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	save := func(sessionID string, profileType types.ProfileType, sampleTypes []string, value int64, at time.Duration) {
+		t.Helper()
+		err := store.SaveProfileData(&types.ProfileData{
+			SessionID: sessionID,
+			Type:      profileType,
+			Timestamp: start.Add(at),
+			Data:      encodeProfile(t, sampleTypes, value),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"s", "t"} {
+		if err := store.SaveSession(&types.ProfileSession{ID: id, ApplicationID: "app", StartTime: start}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	heap := []string{"inuse_space"}
+	save("s", types.ProfileTypeHeap, heap, 30, 2*time.Minute)
+	save("s", types.ProfileTypeHeap, heap, 10, 0)
+	save("s", types.ProfileTypeHeap, heap, 20, time.Minute)
+	save("t", types.ProfileTypeHeap, heap, 5, 0)
+	save("s", types.ProfileTypeCPU, []string{"cpu"}, 1, 0)
+	save("s", types.ProfileTypeCPU, []string{"cpu"}, 2, time.Minute)
+
+	tests := []struct {
+		name string
+		load func() (*Profile, error)
+		want int64
+	}{
+		{"latest heap snapshot", func() (*Profile, error) {
+			return analyzer.SessionProfile("s", types.ProfileTypeHeap, time.Time{}, time.Time{})
+		}, 30},
+		{"latest heap snapshot in range", func() (*Profile, error) {
+			return analyzer.SessionProfile("s", types.ProfileTypeHeap, time.Time{}, start.Add(90*time.Second))
+		}, 20},
+		{"merged cpu windows", func() (*Profile, error) {
+			return analyzer.SessionProfile("s", types.ProfileTypeCPU, time.Time{}, time.Time{})
+		}, 3},
+		{"latest heap snapshot of each session", func() (*Profile, error) {
+			return analyzer.ApplicationProfile(storage.ProfileQuery{ApplicationID: "app", Type: types.ProfileTypeHeap})
+		}, 35},
+	}
+	for _, tt := range tests {
+		p, err := tt.load()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := p.Total(0); got != tt.want {
+			t.Errorf("%s: total %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	save("s", types.ProfileTypeCPU, []string{"samples"}, 1, 2*time.Minute)
+	if _, err := analyzer.SessionProfile("s", types.ProfileTypeCPU, time.Time{}, time.Time{}); !errors.Is(err, ErrIncompatibleProfiles) {
+		t.Errorf("SessionProfile of mixed sample types: %v, want ErrIncompatibleProfiles", err)
+	}
+}
+
+// payloadCounter counts the profiles whose payloads are read
+type payloadCounter struct {
+	storage.Storage
+	payloads int
+}
+
+func (s *payloadCounter) GetProfileData(sessionID string) ([]*types.ProfileData, error) {
+	profiles, err := s.Storage.GetProfileData(sessionID)
+	s.payloads += len(profiles)
+	return profiles, err
+}
+
+func (s *payloadCounter) GetProfile(sessionID, profileID string) (*types.ProfileData, error) {
+	s.payloads++
+	return s.Storage.GetProfile(sessionID, profileID)
+}
+
+func TestLatestTrace(t *testing.T) {
+	fs, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	store := &payloadCounter{Storage: fs}
+	analyzer := NewAnalyzer(store)
+
+	if _, err := analyzer.LatestTrace("s"); !errors.Is(err, ErrNoProfiles) {
+		t.Errorf("LatestTrace of an empty session: %v, want ErrNoProfiles", err)
+	}
+
+	start := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	for i, payload := range []string{"trace 0", "trace 2", "trace 1"} {
+		at := []time.Duration{0, 2 * time.Minute, time.Minute}[i]
+		if err := fs.SaveProfileData(&types.ProfileData{SessionID: "s", Type: types.ProfileTypeTrace, Timestamp: start.Add(at), Data: []byte(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.SaveProfileData(&types.ProfileData{SessionID: "s", Type: types.ProfileTypeCPU, Timestamp: start.Add(time.Hour), Data: []byte("cpu")}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.payloads = 0
+	trace, err := analyzer.LatestTrace("s")
+	if err != nil {
+		t.Fatalf("LatestTrace: %v", err)
+	}
+	if string(trace.Data) != "trace 2" {
+		t.Errorf("LatestTrace = %q, want the newest trace", trace.Data)
+	}
+	if store.payloads != 1 {
+		t.Errorf("LatestTrace read %d payloads, want 1", store.payloads)
+	}
+}
+
+func TestGoroutineReportReadsOneCapture(t *testing.T) {
+	fs, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	store := &payloadCounter{Storage: fs}
+	analyzer := NewAnalyzer(store)
+
+	start := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	save := func(at time.Duration, data []byte, metadata map[string]interface{}) {
+		t.Helper()
+		err := fs.SaveProfileData(&types.ProfileData{SessionID: "s", Type: types.ProfileTypeGoroutine, Timestamp: start.Add(at), Data: data, Metadata: metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump := []byte("goroutine 1 [running]:\nmain.main()\n\t/app/main.go:10 +0x1d\n")
+	save(0, encodeProfile(t, []string{"goroutine"}, 3), nil)
+	save(time.Minute, dump, map[string]interface{}{"format": types.ProfileFormatText})
+	save(2*time.Minute, encodeProfile(t, []string{"goroutine"}, 5), nil)
+
+	report, err := analyzer.GoroutineReport("s")
+	if err != nil {
+		t.Fatalf("GoroutineReport: %v", err)
+	}
+	if report.Source != "dump" || report.Total != 1 {
+		t.Errorf("report from %s with %d goroutines, want the dump with 1", report.Source, report.Total)
+	}
+	if store.payloads != 1 {
+		t.Errorf("GoroutineReport read %d payloads, want 1", store.payloads)
+	}
+}
@@ -0,0 +1,203 @@
+package collection
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Granularity selects what the entries of a top report aggregate over
+type Granularity string
+
+const (
+	GranularityFunction Granularity = "function"
+	GranularityFile     Granularity = "file"
+	GranularityLine     Granularity = "line"
+	GranularityAddress  Granularity = "address"
+)
+
+// ParseGranularity validates a granularity name, defaulting to function
+func ParseGranularity(name string) (Granularity, error) {
+	switch Granularity(name) {
+	case "":
+		return GranularityFunction, nil
+	case GranularityFunction, GranularityFile, GranularityLine, GranularityAddress:
+		return Granularity(name), nil
+	}
+	return "", fmt.Errorf("unknown granularity: %s", name)
+}
+
+// TopOptions controls the content of a top report
+type TopOptions struct {
+	SampleIndex int
+	// N limits the number of entries, 0 means all
+	N int
+	// SortByCum orders entries by cumulative instead of flat value
+	SortByCum   bool
+	Granularity Granularity
+	// Filter keeps only entries whose name matches, e.g. a package prefix
+	Filter *regexp.Regexp
+}
+
+// TopEntry is one row of a top report, in the spirit of "go tool pprof -top"
+type TopEntry struct {
+	Name        string  `json:"name"`
+	File        string  `json:"file,omitempty"`
+	Line        int64   `json:"line,omitempty"`
+	Address     string  `json:"address,omitempty"`
+	Flat        int64   `json:"flat"`
+	FlatPercent float64 `json:"flat_percent"`
+	SumPercent  float64 `json:"sum_percent"`
+	Cum         int64   `json:"cum"`
+	CumPercent  float64 `json:"cum_percent"`
+}
+
+// TopReport is the flat/cum table of a profile
+type TopReport struct {
+	SessionID   string            `json:"session_id"`
+	ProfileType types.ProfileType `json:"profile_type"`
+	SampleType  SampleType        `json:"sample_type"`
+	Granularity Granularity       `json:"granularity"`
+	SortBy      string            `json:"sort_by"`
+	Total       int64             `json:"total"`
+	Entries     []*TopEntry       `json:"entries"`
+}
+
+// topKey identifies the aggregation bucket of a frame at a granularity
+type topKey struct {
+	name    string
+	file    string
+	line    int64
+	address uint64
+}
+
+// Top aggregates a profile's samples into flat and cumulative values per
+// function, file, line or address. Percentages are relative to the total of
+// all samples; a sample adds to an entry's cumulative value at most once.
+func Top(p *Profile, opts TopOptions) (*TopReport, error) {
+	if opts.SampleIndex < 0 || opts.SampleIndex >= len(p.SampleType) {
+		return nil, fmt.Errorf("sample index %d out of range", opts.SampleIndex)
+	}
+	if opts.Granularity == "" {
+		opts.Granularity = GranularityFunction
+	}
+
+	report := &TopReport{
+		SessionID:   p.SessionID,
+		ProfileType: p.Type,
+		SampleType:  p.SampleTypes()[opts.SampleIndex],
+		Granularity: opts.Granularity,
+		SortBy:      "flat",
+	}
+	if opts.SortByCum {
+		report.SortBy = "cum"
+	}
+
+	entries := make(map[topKey]*TopEntry)
+	for _, sample := range p.Sample {
+		value := sample.Value[opts.SampleIndex]
+		if value == 0 {
+			continue
+		}
+		report.Total += value
+
+		seen := make(map[topKey]bool)
+		for i, key := range sampleKeys(sample, opts.Granularity) {
+			e, ok := entries[key]
+			if !ok {
+				e = &TopEntry{Name: key.name, File: key.file, Line: key.line}
+				if opts.Granularity == GranularityAddress {
+					e.Address = fmt.Sprintf("0x%x", key.address)
+				}
+				entries[key] = e
+			}
+			if i == 0 {
+				e.Flat += value
+			}
+			if !seen[key] {
+				seen[key] = true
+				e.Cum += value
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if opts.Filter != nil && !opts.Filter.MatchString(e.Name) {
+			continue
+		}
+		report.Entries = append(report.Entries, e)
+	}
+
+	sort.Slice(report.Entries, func(i, j int) bool {
+		a, b := report.Entries[i], report.Entries[j]
+		av, bv := a.Flat, b.Flat
+		if opts.SortByCum {
+			av, bv = a.Cum, b.Cum
+		}
+		if av != bv {
+			return av > bv
+		}
+		if a.Cum != b.Cum {
+			return a.Cum > b.Cum
+		}
+		return a.Name < b.Name
+	})
+
+	if opts.N > 0 && len(report.Entries) > opts.N {
+		report.Entries = report.Entries[:opts.N]
+	}
+
+	var sum int64
+	for _, e := range report.Entries {
+		sum += e.Flat
+		e.FlatPercent = percentOf(e.Flat, report.Total)
+		e.CumPercent = percentOf(e.Cum, report.Total)
+		e.SumPercent = percentOf(sum, report.Total)
+	}
+
+	return report, nil
+}
+
+// sampleKeys returns the bucket of every frame of a sample, leaf first
+func sampleKeys(sample *profile.Sample, granularity Granularity) []topKey {
+	var keys []topKey
+	for _, loc := range sample.Location {
+		if len(loc.Line) == 0 {
+			keys = append(keys, topKey{name: fmt.Sprintf("0x%x", loc.Address), address: loc.Address})
+			continue
+		}
+
+		for _, line := range loc.Line {
+			key := topKey{name: fmt.Sprintf("0x%x", loc.Address)}
+			if line.Function != nil {
+				key.name = line.Function.Name
+				key.file = line.Function.Filename
+			}
+
+			switch granularity {
+			case GranularityFile:
+				if key.file != "" {
+					key = topKey{name: key.file}
+				}
+			case GranularityLine:
+				key.line = line.Line
+			case GranularityAddress:
+				key.line = line.Line
+				key.address = loc.Address
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func percentOf(value, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(value) / float64(total) * 100
+}
@@ -0,0 +1,95 @@
+package collection
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestTopGranularity(t *testing.T) {
+	p := stackProfile(t, "main;work:10 5", "main;work:20 3", "main;helper 2")
+	for _, fn := range p.Function {
+		if fn.Name == "helper" {
+			fn.Filename = "/app/helper.go"
+		}
+	}
+	for _, loc := range p.Location {
+		loc.Address = 0x1000 + loc.ID
+	}
+
+	// row renders an entry as name[:line][@address] flat/cum
+	row := func(e *TopEntry) string {
+		s := e.Name
+		if e.Line != 0 {
+			s += fmt.Sprintf(":%d", e.Line)
+		}
+		if e.Address != "" {
+			s += "@" + e.Address
+		}
+		return fmt.Sprintf("%s %d/%d", s, e.Flat, e.Cum)
+	}
+
+	tests := []struct {
+		name        string
+		granularity string
+		opts        TopOptions
+		want        []string
+	}{
+		{"function", "", TopOptions{}, []string{"work 8/8", "helper 2/2", "main 0/10"}},
+		{"file", "file", TopOptions{}, []string{"/app/main.go 8/10", "/app/helper.go 2/2"}},
+		{"line", "line", TopOptions{}, []string{"work:10 5/5", "work:20 3/3", "helper:1 2/2", "main:1 0/10"}},
+		{"address", "address", TopOptions{}, []string{"work:10@0x1001 5/5", "work:20@0x1003 3/3", "helper:1@0x1004 2/2", "main:1@0x1002 0/10"}},
+		{"by cum", "", TopOptions{SortByCum: true}, []string{"main 0/10", "work 8/8", "helper 2/2"}},
+		{"first two", "", TopOptions{N: 2}, []string{"work 8/8", "helper 2/2"}},
+		{"filtered", "line", TopOptions{Filter: regexp.MustCompile(`^work$`)}, []string{"work:10 5/5", "work:20 3/3"}},
+	}
+	for _, tt := range tests {
+		granularity, err := ParseGranularity(tt.granularity)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		tt.opts.Granularity = granularity
+
+		report, err := Top(p, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range report.Entries {
+			got = append(got, row(e))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: entries = %v, want %v", tt.name, got, tt.want)
+		}
+		if report.Total != 10 || report.Granularity != granularity {
+			t.Errorf("%s: total %d granularity %s", tt.name, report.Total, report.Granularity)
+		}
+	}
+
+	if _, err := ParseGranularity("package"); err == nil {
+		t.Error("ParseGranularity accepted package")
+	}
+}
+
+func TestTopPercentages(t *testing.T) {
+	p := stackProfile(t, "main;a 6", "main;b 3", "main;c 1")
+
+	report, err := Top(p, TopOptions{N: 2})
+	if err != nil {
+		t.Fatalf("Top: %v", err)
+	}
+	// Percentages stay relative to every sample, not only the listed ones
+	want := [][3]float64{{60, 60, 60}, {30, 90, 30}}
+	for i, e := range report.Entries {
+		if got := [3]float64{e.FlatPercent, e.SumPercent, e.CumPercent}; got != want[i] {
+			t.Errorf("%s: flat, sum, cum percent = %v, want %v", e.Name, got, want[i])
+		}
+	}
+
+	if _, err := Top(p, TopOptions{SampleIndex: 1}); err == nil {
+		t.Error("Top accepted an out of range sample index")
+	}
+}
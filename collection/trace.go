@@ -0,0 +1,390 @@
+package collection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	xtrace "golang.org/x/exp/trace"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// ErrInvalidTrace is returned when a stored trace cannot be parsed
+var ErrInvalidTrace = errors.New("invalid execution trace")
+
+// traceMagic prefixes every runtime execution trace, e.g. "go 1.23 trace"
+var traceMagic = []byte("go 1.")
+
+// IsTrace reports whether data looks like a runtime/trace execution trace
+func IsTrace(data []byte) bool {
+	return bytes.HasPrefix(data, traceMagic) && bytes.Contains(data[:min(len(data), 16)], []byte(" trace"))
+}
+
+// latencyBounds are the upper bounds of the scheduling latency histogram
+// buckets; a final bucket holds everything above the last bound
+var latencyBounds = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyBucket counts latencies up to and including UpperBound. The last
+// bucket of a histogram has no upper bound.
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"upper_bound,omitempty"`
+	Count      int64         `json:"count"`
+}
+
+// LatencyHistogram summarises how long goroutines waited to be scheduled
+// after becoming runnable
+type LatencyHistogram struct {
+	Count   int64           `json:"count"`
+	Total   time.Duration   `json:"total"`
+	Mean    time.Duration   `json:"mean"`
+	P50     time.Duration   `json:"p50"`
+	P99     time.Duration   `json:"p99"`
+	Max     time.Duration   `json:"max"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// GCEvent is a GC phase or stop-the-world pause. Start is relative to the
+// beginning of the trace.
+type GCEvent struct {
+	Kind     string        `json:"kind"`
+	Start    time.Duration `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// HeapSample is the live heap reported by the runtime at a point of the trace
+type HeapSample struct {
+	Time      time.Duration `json:"time"`
+	HeapBytes uint64        `json:"heap_bytes"`
+	GoalBytes uint64        `json:"goal_bytes,omitempty"`
+}
+
+// GCTimeline lists the GC activity of a trace
+type GCTimeline struct {
+	Cycles      int           `json:"cycles"`
+	MarkTime    time.Duration `json:"mark_time"`
+	PauseTotal  time.Duration `json:"pause_total"`
+	PauseMax    time.Duration `json:"pause_max"`
+	Events      []GCEvent     `json:"events"`
+	HeapSamples []HeapSample  `json:"heap_samples,omitempty"`
+}
+
+// SyscallSite is the time goroutines spent in syscalls made from one function
+type SyscallSite struct {
+	Function string        `json:"function"`
+	File     string        `json:"file,omitempty"`
+	Line     int64         `json:"line,omitempty"`
+	Count    int64         `json:"count"`
+	Total    time.Duration `json:"total"`
+}
+
+// SyscallSummary totals the time goroutines were blocked in syscalls
+type SyscallSummary struct {
+	Count int64          `json:"count"`
+	Total time.Duration  `json:"total"`
+	Sites []*SyscallSite `json:"sites"`
+}
+
+// TraceSummary is the server-side digest of a runtime execution trace
+type TraceSummary struct {
+	SessionID         string            `json:"session_id,omitempty"`
+	Timestamp         time.Time         `json:"timestamp,omitempty"`
+	Size              int               `json:"size"`
+	Duration          time.Duration     `json:"duration"`
+	Events            int64             `json:"events"`
+	Goroutines        int               `json:"goroutines"`
+	SchedulingLatency *LatencyHistogram `json:"scheduling_latency"`
+	GC                *GCTimeline       `json:"gc"`
+	Syscalls          *SyscallSummary   `json:"syscalls"`
+}
+
+// maxSyscallSites bounds the syscall sites kept in a summary
+const maxSyscallSites = 20
+
+// openRange is a GC or stop-the-world range that has not ended yet
+type openRange struct {
+	kind  string
+	start xtrace.Time
+}
+
+// pendingSyscall is a goroutine currently blocked in a syscall
+type pendingSyscall struct {
+	start xtrace.Time
+	site  Frame
+}
+
+// SummarizeTrace parses a runtime execution trace and computes its scheduling
+// latency histogram, GC timeline and syscall blocking totals
+func SummarizeTrace(data []byte) (*TraceSummary, error) {
+	reader, err := xtrace.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTrace, err)
+	}
+
+	summary := &TraceSummary{
+		Size: len(data),
+		GC:   &GCTimeline{},
+	}
+
+	var (
+		first, last xtrace.Time
+		latencies   []time.Duration
+		runnable    = make(map[xtrace.GoID]xtrace.Time)
+		inSyscall   = make(map[xtrace.GoID]pendingSyscall)
+		goroutines  = make(map[xtrace.GoID]struct{})
+		ranges      = make(map[string]openRange)
+		sites       = make(map[Frame]*SyscallSite)
+		syscalls    = &SyscallSummary{}
+		heap        HeapSample
+	)
+
+	for {
+		ev, err := reader.ReadEvent()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTrace, err)
+		}
+
+		summary.Events++
+		if first == 0 {
+			first = ev.Time()
+		}
+		last = ev.Time()
+
+		switch ev.Kind() {
+		case xtrace.EventStateTransition:
+			st := ev.StateTransition()
+			if st.Resource.Kind != xtrace.ResourceGoroutine {
+				continue
+			}
+			id := st.Resource.Goroutine()
+			goroutines[id] = struct{}{}
+			from, to := st.Goroutine()
+
+			if to == xtrace.GoRunnable {
+				runnable[id] = ev.Time()
+			}
+			if from == xtrace.GoRunnable && to == xtrace.GoRunning {
+				if start, ok := runnable[id]; ok {
+					latencies = append(latencies, ev.Time().Sub(start))
+				}
+			}
+			if to != xtrace.GoRunnable {
+				delete(runnable, id)
+			}
+
+			if to == xtrace.GoSyscall {
+				inSyscall[id] = pendingSyscall{start: ev.Time(), site: syscallSite(ev.Stack())}
+			} else if from == xtrace.GoSyscall {
+				if pending, ok := inSyscall[id]; ok {
+					d := ev.Time().Sub(pending.start)
+					syscalls.Count++
+					syscalls.Total += d
+
+					site, ok := sites[pending.site]
+					if !ok {
+						site = &SyscallSite{
+							Function: pending.site.Function,
+							File:     pending.site.File,
+							Line:     pending.site.Line,
+						}
+						sites[pending.site] = site
+					}
+					site.Count++
+					site.Total += d
+					delete(inSyscall, id)
+				}
+			}
+
+		case xtrace.EventRangeBegin, xtrace.EventRangeActive:
+			kind, ok := gcRangeKind(ev.Range().Name)
+			if !ok {
+				continue
+			}
+			key := rangeKey(ev)
+			start := ev.Time()
+			if ev.Kind() == xtrace.EventRangeActive {
+				// Already running when the trace started
+				start = first
+			}
+			ranges[key] = openRange{kind: kind, start: start}
+
+		case xtrace.EventRangeEnd:
+			if _, ok := gcRangeKind(ev.Range().Name); !ok {
+				continue
+			}
+			key := rangeKey(ev)
+			open, ok := ranges[key]
+			if !ok {
+				continue
+			}
+			delete(ranges, key)
+			summary.GC.add(open.kind, open.start.Sub(first), ev.Time().Sub(open.start))
+
+		case xtrace.EventMetric:
+			metric := ev.Metric()
+			if metric.Value.Kind() != xtrace.ValueUint64 {
+				continue
+			}
+			switch metric.Name {
+			case "/memory/classes/heap/objects:bytes":
+				heap.HeapBytes = metric.Value.Uint64()
+				heap.Time = ev.Time().Sub(first)
+				summary.GC.HeapSamples = append(summary.GC.HeapSamples, heap)
+			case "/gc/heap/goal:bytes":
+				heap.GoalBytes = metric.Value.Uint64()
+			}
+		}
+	}
+
+	if summary.Events == 0 {
+		return nil, fmt.Errorf("trace holds no events")
+	}
+
+	summary.Duration = last.Sub(first)
+	summary.Goroutines = len(goroutines)
+	summary.SchedulingLatency = latencyHistogram(latencies)
+
+	syscalls.Sites = make([]*SyscallSite, 0, len(sites))
+	for _, site := range sites {
+		syscalls.Sites = append(syscalls.Sites, site)
+	}
+	sort.Slice(syscalls.Sites, func(i, j int) bool {
+		if syscalls.Sites[i].Total != syscalls.Sites[j].Total {
+			return syscalls.Sites[i].Total > syscalls.Sites[j].Total
+		}
+		return syscalls.Sites[i].Function < syscalls.Sites[j].Function
+	})
+	if len(syscalls.Sites) > maxSyscallSites {
+		syscalls.Sites = syscalls.Sites[:maxSyscallSites]
+	}
+	summary.Syscalls = syscalls
+
+	sort.SliceStable(summary.GC.Events, func(i, j int) bool {
+		return summary.GC.Events[i].Start < summary.GC.Events[j].Start
+	})
+
+	return summary, nil
+}
+
+func (gc *GCTimeline) add(kind string, start, d time.Duration) {
+	gc.Events = append(gc.Events, GCEvent{Kind: kind, Start: start, Duration: d})
+
+	switch kind {
+	case "mark":
+		gc.Cycles++
+		gc.MarkTime += d
+	case "stw":
+		gc.PauseTotal += d
+		if d > gc.PauseMax {
+			gc.PauseMax = d
+		}
+	}
+}
+
+// gcRangeKind maps the runtime's range names to GC timeline event kinds
+func gcRangeKind(name string) (string, bool) {
+	switch {
+	case name == "GC concurrent mark phase":
+		return "mark", true
+	case strings.HasPrefix(name, "stop-the-world"):
+		return "stw", true
+	}
+	return "", false
+}
+
+// rangeKey identifies a range by name and the resource it is scoped to, since
+// only one range of each name is active on a resource at a time
+func rangeKey(ev xtrace.Event) string {
+	r := ev.Range()
+	return r.Name + "/" + r.Scope.String()
+}
+
+// syscallSite returns the innermost frame of a syscall's stack that is not
+// part of the runtime or syscall packages
+func syscallSite(stack xtrace.Stack) Frame {
+	var site Frame
+	for f := range stack.Frames() {
+		frame := Frame{Function: f.Func, File: f.File, Line: int64(f.Line)}
+		if site.Function == "" {
+			site = frame
+		}
+		if !strings.HasPrefix(f.Func, "runtime.") && !strings.HasPrefix(f.Func, "syscall.") &&
+			!strings.HasPrefix(f.Func, "internal/") && !strings.HasPrefix(f.Func, "golang.org/x/sys/") {
+			return frame
+		}
+	}
+	if site.Function == "" {
+		site.Function = "unknown"
+	}
+	return site
+}
+
+func latencyHistogram(latencies []time.Duration) *LatencyHistogram {
+	h := &LatencyHistogram{Buckets: make([]LatencyBucket, len(latencyBounds)+1)}
+	for i, bound := range latencyBounds {
+		h.Buckets[i].UpperBound = bound
+	}
+	if len(latencies) == 0 {
+		return h
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	for _, d := range latencies {
+		h.Total += d
+		i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+		h.Buckets[i].Count++
+	}
+
+	h.Count = int64(len(latencies))
+	h.Mean = h.Total / time.Duration(h.Count)
+	h.P50 = latencies[len(latencies)/2]
+	h.P99 = latencies[len(latencies)*99/100]
+	h.Max = latencies[len(latencies)-1]
+	return h
+}
+
+// TraceSummary summarises the latest execution trace of a session
+func (a *Analyzer) TraceSummary(sessionID string) (*TraceSummary, error) {
+	record, err := a.LatestTrace(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := SummarizeTrace(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	summary.SessionID = sessionID
+	summary.Timestamp = record.Timestamp
+	return summary, nil
+}
+
+// LatestTrace returns the most recent execution trace stored for a session.
+// Traces are large, so only that one is read.
+func (a *Analyzer) LatestTrace(sessionID string) (*types.ProfileData, error) {
+	records, err := a.storage.ListProfiles(sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load profile data: %w", err)
+	}
+
+	latest := latestRecord(records, types.ProfileTypeTrace, func(*types.ProfileData) bool { return true })
+	if latest == nil {
+		return nil, fmt.Errorf("%w: session %s, type %s", ErrNoProfiles, sessionID, types.ProfileTypeTrace)
+	}
+	return a.loadRecord(latest)
+}
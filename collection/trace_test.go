@@ -0,0 +1,146 @@
+package collection
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/trace"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureTrace records an execution trace of the test process while it
+// collects garbage, schedules goroutines and makes syscalls
+func captureTrace(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Skipf("tracing unavailable: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var sink []byte
+			for j := 0; j < 100; j++ {
+				sink = make([]byte, 64<<10)
+				runtime.Gosched()
+			}
+			_ = sink
+		}()
+	}
+	wg.Wait()
+	runtime.GC()
+
+	path := filepath.Join(t.TempDir(), "out")
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	trace.Stop()
+	return buf.Bytes()
+}
+
+func TestSummarizeTrace(t *testing.T) {
+	data := captureTrace(t)
+	if !IsTrace(data) {
+		t.Fatalf("IsTrace rejected a runtime trace starting with %q", data[:min(len(data), 16)])
+	}
+
+	summary, err := SummarizeTrace(data)
+	if err != nil {
+		t.Fatalf("SummarizeTrace: %v", err)
+	}
+	if summary.Size != len(data) || summary.Events == 0 || summary.Duration <= 0 {
+		t.Errorf("size %d events %d duration %v", summary.Size, summary.Events, summary.Duration)
+	}
+	if summary.Goroutines < 4*runtime.GOMAXPROCS(0) {
+		t.Errorf("%d goroutines, want at least %d", summary.Goroutines, 4*runtime.GOMAXPROCS(0))
+	}
+
+	latency := summary.SchedulingLatency
+	var bucketed int64
+	for _, b := range latency.Buckets {
+		bucketed += b.Count
+	}
+	if latency.Count == 0 || bucketed != latency.Count || latency.P50 > latency.P99 || latency.P99 > latency.Max {
+		t.Errorf("scheduling latency: %d in buckets of %d, p50 %v p99 %v max %v",
+			bucketed, latency.Count, latency.P50, latency.P99, latency.Max)
+	}
+
+	gc := summary.GC
+	if gc.Cycles == 0 || gc.MarkTime <= 0 || gc.PauseTotal <= 0 || gc.PauseMax > gc.PauseTotal {
+		t.Errorf("gc: %d cycles, mark %v, pauses %v (max %v)", gc.Cycles, gc.MarkTime, gc.PauseTotal, gc.PauseMax)
+	}
+	for i, ev := range gc.Events {
+		if ev.Kind != "mark" && ev.Kind != "stw" {
+			t.Errorf("gc event %d has kind %s", i, ev.Kind)
+		}
+		if i > 0 && ev.Start < gc.Events[i-1].Start {
+			t.Errorf("gc event %d starts before the previous one", i)
+		}
+	}
+	if len(gc.HeapSamples) == 0 {
+		t.Error("no heap samples")
+	}
+
+	syscalls := summary.Syscalls
+	var counted int64
+	for _, site := range syscalls.Sites {
+		counted += site.Count
+	}
+	if syscalls.Count < 10 || syscalls.Total <= 0 || (len(syscalls.Sites) < maxSyscallSites && counted != syscalls.Count) {
+		t.Errorf("syscalls: %d taking %v, %d of them in %d sites", syscalls.Count, syscalls.Total, counted, len(syscalls.Sites))
+	}
+}
+
+func TestSummarizeInvalidTrace(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("not a trace"), []byte("go 1.23 trace\x00\x00garbage")} {
+		if _, err := SummarizeTrace(data); !errors.Is(err, ErrInvalidTrace) {
+			t.Errorf("SummarizeTrace(%q) = %v, want ErrInvalidTrace", data, err)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var latencies []time.Duration
+	for i := 0; i < 98; i++ {
+		latencies = append(latencies, 5*time.Microsecond)
+	}
+	latencies = append(latencies, 50*time.Millisecond, 2*time.Second)
+
+	h := latencyHistogram(latencies)
+	if h.Count != 100 || h.P50 != 5*time.Microsecond || h.P99 != 2*time.Second || h.Max != 2*time.Second {
+		t.Errorf("count %d p50 %v p99 %v max %v", h.Count, h.P50, h.P99, h.Max)
+	}
+	if want := (98*5*time.Microsecond + 50*time.Millisecond + 2*time.Second) / 100; h.Mean != want {
+		t.Errorf("mean = %v, want %v", h.Mean, want)
+	}
+
+	// Bounds are inclusive and the last bucket is unbounded
+	counts := make([]int64, len(h.Buckets))
+	for i, b := range h.Buckets {
+		counts[i] = b.Count
+	}
+	want := []int64{98, 0, 0, 0, 1, 0, 1}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("bucket counts = %v, want %v", counts, want)
+		}
+	}
+	if last := h.Buckets[len(h.Buckets)-1]; last.UpperBound != 0 {
+		t.Errorf("last bucket bounded by %v", last.UpperBound)
+	}
+
+	if empty := latencyHistogram(nil); empty.Count != 0 || len(empty.Buckets) != len(latencyBounds)+1 {
+		t.Errorf("empty histogram: %+v", empty)
+	}
+}
@@ -1 +1,183 @@
 package library
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/collection"
+)
+
+// FoldedOptions describes the samples of a folded stacks file
+type FoldedOptions struct {
+	// SampleType and Unit name the count column, "samples"/"count" by default
+	SampleType string
+	Unit       string
+	// Period is the sampling interval the counts were taken at. When set, a
+	// "cpu"/"nanoseconds" column is added holding count * Period.
+	Period time.Duration
+}
+
+// pySpyFrame matches frames annotated with their source position, as written
+// by py-spy ("handle (app/views.py:42)")
+var pySpyFrame = regexp.MustCompile(`^(.*) \(([^()]*):(\d+)\)$`)
+
+// ParseFolded reads the collapsed "folded stacks" text format, one
+// "root;caller;leaf count" line per stack, as produced by the
+// stackcollapse-* scripts, perf and py-spy --format raw, and synthesizes an
+// equivalent pprof profile.
+func ParseFolded(r io.Reader, opts FoldedOptions) (*profile.Profile, error) {
+	if opts.SampleType == "" {
+		opts.SampleType = "samples"
+	}
+	if opts.Unit == "" {
+		opts.Unit = "count"
+	}
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: opts.SampleType, Unit: opts.Unit}},
+		TimeNanos:  time.Now().UnixNano(),
+	}
+	if opts.Period > 0 {
+		p.SampleType = append(p.SampleType, &profile.ValueType{Type: "cpu", Unit: "nanoseconds"})
+		p.PeriodType = &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+		p.Period = opts.Period.Nanoseconds()
+	}
+
+	functions := make(map[collection.Frame]*profile.Function)
+	locations := make(map[collection.Frame]*profile.Location)
+	locationFor := func(f collection.Frame) *profile.Location {
+		if loc, ok := locations[f]; ok {
+			return loc
+		}
+
+		fnKey := collection.Frame{Function: f.Function, File: f.File}
+		fn, ok := functions[fnKey]
+		if !ok {
+			fn = &profile.Function{
+				ID:         uint64(len(p.Function) + 1),
+				Name:       f.Function,
+				SystemName: f.Function,
+				Filename:   f.File,
+			}
+			functions[fnKey] = fn
+			p.Function = append(p.Function, fn)
+		}
+
+		loc := &profile.Location{
+			ID:   uint64(len(p.Location) + 1),
+			Line: []profile.Line{{Function: fn, Line: f.Line}},
+		}
+		locations[f] = loc
+		p.Location = append(p.Location, loc)
+		return loc
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sep := strings.LastIndexByte(line, ' ')
+		if sep < 0 {
+			return nil, fmt.Errorf("line %d: missing sample count", lineNum)
+		}
+
+		count, err := strconv.ParseInt(line[sep+1:], 10, 64)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("line %d: invalid sample count %q", lineNum, line[sep+1:])
+		}
+		if count == 0 {
+			continue
+		}
+
+		frames := strings.Split(strings.TrimSpace(line[:sep]), ";")
+		sample := &profile.Sample{
+			Location: make([]*profile.Location, 0, len(frames)),
+			Value:    []int64{count},
+		}
+		if opts.Period > 0 {
+			sample.Value = append(sample.Value, count*opts.Period.Nanoseconds())
+		}
+
+		// Folded stacks are root first, pprof locations are leaf first
+		for i := len(frames) - 1; i >= 0; i-- {
+			if frames[i] == "" {
+				continue
+			}
+			sample.Location = append(sample.Location, locationFor(parseFoldedFrame(frames[i])))
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading folded stacks: %w", err)
+	}
+
+	if len(p.Sample) == 0 {
+		return nil, fmt.Errorf("no samples found")
+	}
+
+	if err := p.CheckValid(); err != nil {
+		return nil, fmt.Errorf("invalid folded stacks: %w", err)
+	}
+
+	return p, nil
+}
+
+func parseFoldedFrame(frame string) collection.Frame {
+	if m := pySpyFrame.FindStringSubmatch(frame); m != nil {
+		line, _ := strconv.ParseInt(m[3], 10, 64)
+		return collection.Frame{Function: m[1], File: m[2], Line: line}
+	}
+	return collection.Frame{Function: frame}
+}
+
+// WriteFolded writes a profile in the folded stacks format using the given
+// value column. Identical stacks are aggregated and written in sorted order.
+func WriteFolded(w io.Writer, p *collection.Profile, sampleIndex int) error {
+	if sampleIndex < 0 || sampleIndex >= len(p.SampleType) {
+		return fmt.Errorf("sample index %d out of range", sampleIndex)
+	}
+
+	stacks := make(map[string]int64)
+	for _, sample := range p.Sample {
+		value := sample.Value[sampleIndex]
+		if value == 0 {
+			continue
+		}
+
+		names := stackNames(collection.Stack(sample))
+		for i, name := range names {
+			names[i] = strings.ReplaceAll(name, ";", ":")
+		}
+		stacks[strings.Join(names, ";")] += value
+	}
+
+	keys := make([]string, 0, len(stacks))
+	for k := range stacks {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(bw, "%s %d\n", k, stacks[k]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
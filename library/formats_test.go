@@ -0,0 +1,55 @@
+package library
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/King-kin5/analysis/collection"
+)
+
+func TestParseFoldedLines(t *testing.T) {
+	input := "main (app.py:3);handle (app/views.py:42) 5\nmain (app.py:3);handle (app/views.py:47) 2\n"
+
+	p, err := ParseFolded(strings.NewReader(input), FoldedOptions{})
+	if err != nil {
+		t.Fatalf("ParseFolded: %v", err)
+	}
+	if len(p.Sample) != 2 {
+		t.Fatalf("got %d samples, want 2", len(p.Sample))
+	}
+
+	want := []collection.Frame{
+		{Function: "handle", File: "app/views.py", Line: 42},
+		{Function: "main", File: "app.py", Line: 3},
+	}
+	if got := collection.Stack(p.Sample[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stack = %+v, want %+v", got, want)
+	}
+	if got := collection.Stack(p.Sample[1])[0].Line; got != 47 {
+		t.Errorf("second sample line = %d, want 47", got)
+	}
+
+	// Both lines belong to one function
+	if len(p.Function) != 2 {
+		t.Errorf("got %d functions, want 2", len(p.Function))
+	}
+}
+
+func TestFoldedRoundTrip(t *testing.T) {
+	input := "main;parse 1\nmain;parse;read 3\nmain;render 6\n"
+
+	p, err := ParseFolded(strings.NewReader(input), FoldedOptions{})
+	if err != nil {
+		t.Fatalf("ParseFolded: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := WriteFolded(&out, &collection.Profile{Profile: p}, 0); err != nil {
+		t.Fatalf("WriteFolded: %v", err)
+	}
+	if out.String() != input {
+		t.Errorf("WriteFolded =\n%s\nwant\n%s", out.String(), input)
+	}
+}
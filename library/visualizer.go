@@ -1 +1,226 @@
 package library
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// RootFrameName is the name of the synthetic frame spanning all samples
+const RootFrameName = "root"
+
+// FlameGraphOptions controls how a profile's stacks are folded into a flame graph
+type FlameGraphOptions struct {
+	// SampleIndex selects the value column used as frame width
+	SampleIndex int
+	// MinWidth prunes frames narrower than this fraction of the root (0..1)
+	MinWidth float64
+	// Focus keeps only samples with at least one frame matching the expression
+	Focus *regexp.Regexp
+	// Ignore drops samples with any frame matching the expression
+	Ignore *regexp.Regexp
+	// CollapseRuntime folds runs of consecutive Go runtime frames into one
+	CollapseRuntime bool
+	// LabelKey, when set, keeps only samples whose sample label LabelKey has
+	// LabelValue (collection.Unlabeled selects samples without the label)
+	LabelKey   string
+	LabelValue string
+}
+
+// BuildFlameGraph folds the samples of a profile into a flame graph rooted at
+// a frame holding the value of every kept sample. The result is suitable for
+// D3 flame graph renderers as is.
+func BuildFlameGraph(p *collection.Profile, opts FlameGraphOptions) (*types.FlameGraphFrame, error) {
+	if opts.SampleIndex < 0 || opts.SampleIndex >= len(p.SampleType) {
+		return nil, fmt.Errorf("sample index %d out of range", opts.SampleIndex)
+	}
+	if opts.MinWidth < 0 || opts.MinWidth > 1 {
+		return nil, fmt.Errorf("min width must be between 0 and 1")
+	}
+
+	b := newFlameBuilder()
+	b.fold(p, opts.SampleIndex, opts, func(f *types.FlameGraphFrame, v float64) {
+		f.Value += v
+	})
+
+	if opts.MinWidth > 0 {
+		prune(b.root, b.root.Value*opts.MinWidth)
+	}
+	sortFrames(b.root)
+
+	return b.root, nil
+}
+
+// flameBuilder accumulates root-first stacks into a frame tree
+type flameBuilder struct {
+	root     *types.FlameGraphFrame
+	children map[*types.FlameGraphFrame]map[string]*types.FlameGraphFrame
+}
+
+func newFlameBuilder() *flameBuilder {
+	return &flameBuilder{
+		root:     &types.FlameGraphFrame{Name: RootFrameName},
+		children: make(map[*types.FlameGraphFrame]map[string]*types.FlameGraphFrame),
+	}
+}
+
+// fold adds every sample of a profile kept by the options, applying update
+// with the sample's value to each frame along its stack
+func (b *flameBuilder) fold(p *collection.Profile, index int, opts FlameGraphOptions, update func(*types.FlameGraphFrame, float64)) {
+	for _, sample := range p.Sample {
+		value := sample.Value[index]
+		if value == 0 {
+			continue
+		}
+		if opts.LabelKey != "" && collection.SampleLabel(sample, opts.LabelKey) != opts.LabelValue {
+			continue
+		}
+
+		names := stackNames(collection.Stack(sample))
+		if !keepStack(names, opts) {
+			continue
+		}
+		if opts.CollapseRuntime {
+			names = collapseRuntime(names)
+		}
+
+		v := float64(value)
+		b.add(names, func(f *types.FlameGraphFrame) { update(f, v) })
+	}
+}
+
+// add applies update to every frame along a root-first stack, root included
+func (b *flameBuilder) add(stack []string, update func(*types.FlameGraphFrame)) {
+	frame := b.root
+	update(frame)
+	for _, name := range stack {
+		frame = b.child(frame, name)
+		update(frame)
+	}
+}
+
+func (b *flameBuilder) child(parent *types.FlameGraphFrame, name string) *types.FlameGraphFrame {
+	byName, ok := b.children[parent]
+	if !ok {
+		byName = make(map[string]*types.FlameGraphFrame)
+		b.children[parent] = byName
+	}
+
+	frame, ok := byName[name]
+	if !ok {
+		frame = &types.FlameGraphFrame{Name: name}
+		byName[name] = frame
+		parent.Children = append(parent.Children, frame)
+	}
+	return frame
+}
+
+// stackNames converts a leaf-first stack into root-first function names
+func stackNames(stack []collection.Frame) []string {
+	names := make([]string, len(stack))
+	for i, f := range stack {
+		names[len(stack)-1-i] = f.Function
+	}
+	return names
+}
+
+func keepStack(names []string, opts FlameGraphOptions) bool {
+	if opts.Focus == nil && opts.Ignore == nil {
+		return true
+	}
+
+	focused := opts.Focus == nil
+	for _, name := range names {
+		if opts.Ignore != nil && opts.Ignore.MatchString(name) {
+			return false
+		}
+		if !focused && opts.Focus.MatchString(name) {
+			focused = true
+		}
+	}
+	return focused
+}
+
+func isRuntimeFrame(name string) bool {
+	return strings.HasPrefix(name, "runtime.") || strings.HasPrefix(name, "runtime/internal/")
+}
+
+// collapseRuntime keeps only the outermost frame of each run of runtime frames
+func collapseRuntime(names []string) []string {
+	collapsed := names[:0:0]
+	for i, name := range names {
+		if i > 0 && isRuntimeFrame(name) && isRuntimeFrame(names[i-1]) {
+			continue
+		}
+		collapsed = append(collapsed, name)
+	}
+	return collapsed
+}
+
+func prune(frame *types.FlameGraphFrame, minValue float64) {
+	kept := frame.Children[:0]
+	for _, child := range frame.Children {
+		if child.Value < minValue && child.Base < minValue {
+			continue
+		}
+		prune(child, minValue)
+		kept = append(kept, child)
+	}
+	frame.Children = kept
+}
+
+func sortFrames(frame *types.FlameGraphFrame) {
+	sort.Slice(frame.Children, func(i, j int) bool {
+		return frame.Children[i].Name < frame.Children[j].Name
+	})
+	for _, child := range frame.Children {
+		sortFrames(child)
+	}
+}
+
+// BuildDiffFlameGraph folds two profiles into one differential flame graph.
+// Every frame carries the base and the scaled target value; Value is the
+// target value and Delta is target minus base. opts.SampleIndex applies to
+// the base and targetIndex to the target.
+func BuildDiffFlameGraph(base, target *collection.Profile, opts FlameGraphOptions, targetIndex int, scale float64) (*types.FlameGraphFrame, error) {
+	if opts.SampleIndex < 0 || opts.SampleIndex >= len(base.SampleType) {
+		return nil, fmt.Errorf("sample index %d out of range", opts.SampleIndex)
+	}
+	if targetIndex < 0 || targetIndex >= len(target.SampleType) {
+		return nil, fmt.Errorf("target sample index %d out of range", targetIndex)
+	}
+	if opts.MinWidth < 0 || opts.MinWidth > 1 {
+		return nil, fmt.Errorf("min width must be between 0 and 1")
+	}
+
+	b := newFlameBuilder()
+	b.fold(base, opts.SampleIndex, opts, func(f *types.FlameGraphFrame, v float64) {
+		f.Base += v
+	})
+	b.fold(target, targetIndex, opts, func(f *types.FlameGraphFrame, v float64) {
+		f.Target += v * scale
+	})
+
+	setDiffValues(b.root)
+
+	if opts.MinWidth > 0 {
+		width := math.Max(b.root.Value, b.root.Base)
+		prune(b.root, width*opts.MinWidth)
+	}
+	sortFrames(b.root)
+
+	return b.root, nil
+}
+
+func setDiffValues(frame *types.FlameGraphFrame) {
+	frame.Value = frame.Target
+	frame.Delta = frame.Target - frame.Base
+	for _, child := range frame.Children {
+		setDiffValues(child)
+	}
+}
@@ -0,0 +1,140 @@
+package library
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// foldedProfile parses folded stacks into a profile
+func foldedProfile(t *testing.T, input string) *collection.Profile {
+	t.Helper()
+
+	p, err := ParseFolded(strings.NewReader(input), FoldedOptions{})
+	if err != nil {
+		t.Fatalf("ParseFolded: %v", err)
+	}
+	return &collection.Profile{Profile: p}
+}
+
+// framePaths returns the value of every frame of a flame graph by its
+// root-first path, checking that children are sorted by name
+func framePaths(t *testing.T, frame *types.FlameGraphFrame) map[string]float64 {
+	t.Helper()
+
+	paths := make(map[string]float64)
+	var walk func(prefix string, f *types.FlameGraphFrame)
+	walk = func(prefix string, f *types.FlameGraphFrame) {
+		path := prefix + f.Name
+		paths[path] = f.Value
+		for i, child := range f.Children {
+			if i > 0 && f.Children[i-1].Name >= child.Name {
+				t.Errorf("children of %s are not sorted: %s before %s", path, f.Children[i-1].Name, child.Name)
+			}
+			walk(path+";", child)
+		}
+	}
+	walk("", frame)
+	return paths
+}
+
+func TestBuildFlameGraph(t *testing.T) {
+	p := foldedProfile(t, "main;render 6\nmain;parse;read 3\nmain;parse 1\nmain;runtime.mallocgc;runtime.sweep 2\ngc;runtime.gcBgMarkWorker 8\n")
+
+	tests := []struct {
+		name string
+		opts FlameGraphOptions
+		want map[string]float64
+	}{
+		{"all stacks", FlameGraphOptions{}, map[string]float64{
+			"root": 20, "root;main": 12, "root;main;render": 6, "root;main;parse": 4, "root;main;parse;read": 3,
+			"root;main;runtime.mallocgc": 2, "root;main;runtime.mallocgc;runtime.sweep": 2,
+			"root;gc": 8, "root;gc;runtime.gcBgMarkWorker": 8,
+		}},
+		{"pruned below 20%", FlameGraphOptions{MinWidth: 0.2}, map[string]float64{
+			"root": 20, "root;main": 12, "root;main;render": 6, "root;main;parse": 4,
+			"root;gc": 8, "root;gc;runtime.gcBgMarkWorker": 8,
+		}},
+		{"focus", FlameGraphOptions{Focus: regexp.MustCompile(`^parse$`)}, map[string]float64{
+			"root": 4, "root;main": 4, "root;main;parse": 4, "root;main;parse;read": 3,
+		}},
+		{"ignore", FlameGraphOptions{Ignore: regexp.MustCompile(`^runtime\.`)}, map[string]float64{
+			"root": 10, "root;main": 10, "root;main;render": 6, "root;main;parse": 4, "root;main;parse;read": 3,
+		}},
+		{"focus and ignore", FlameGraphOptions{Focus: regexp.MustCompile(`^main$`), Ignore: regexp.MustCompile(`^read$`)}, map[string]float64{
+			"root": 9, "root;main": 9, "root;main;render": 6, "root;main;parse": 1,
+			"root;main;runtime.mallocgc": 2, "root;main;runtime.mallocgc;runtime.sweep": 2,
+		}},
+		{"collapsed runtime", FlameGraphOptions{CollapseRuntime: true}, map[string]float64{
+			"root": 20, "root;main": 12, "root;main;render": 6, "root;main;parse": 4, "root;main;parse;read": 3,
+			"root;main;runtime.mallocgc": 2, "root;gc": 8, "root;gc;runtime.gcBgMarkWorker": 8,
+		}},
+	}
+	for _, tt := range tests {
+		graph, err := BuildFlameGraph(p, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := framePaths(t, graph); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %v\nwant %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, opts := range []FlameGraphOptions{{SampleIndex: 1}, {MinWidth: 1.5}, {MinWidth: -0.1}} {
+		if _, err := BuildFlameGraph(p, opts); err == nil {
+			t.Errorf("BuildFlameGraph accepted %+v", opts)
+		}
+	}
+}
+
+func TestBuildFlameGraphPruneKeepsWideParents(t *testing.T) {
+	// Each leaf is narrow but together they make their parent wide
+	var input strings.Builder
+	for _, leaf := range []string{"a", "b", "c", "d", "e"} {
+		input.WriteString("main;work;" + leaf + " 2\n")
+	}
+	p := foldedProfile(t, input.String())
+
+	graph, err := BuildFlameGraph(p, FlameGraphOptions{MinWidth: 0.25})
+	if err != nil {
+		t.Fatalf("BuildFlameGraph: %v", err)
+	}
+	want := map[string]float64{"root": 10, "root;main": 10, "root;main;work": 10}
+	if got := framePaths(t, graph); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBuildFlameGraphLabel(t *testing.T) {
+	p := foldedProfile(t, "main;checkout 5\nmain;search 3\nmain;gc 2\n")
+	for _, sample := range p.Sample {
+		switch leaf := collection.Stack(sample)[0].Function; leaf {
+		case "checkout", "search":
+			sample.Label = map[string][]string{"endpoint": {"/" + leaf}}
+		}
+	}
+
+	tests := []struct {
+		value string
+		want  map[string]float64
+	}{
+		{"/checkout", map[string]float64{"root": 5, "root;main": 5, "root;main;checkout": 5}},
+		{collection.Unlabeled, map[string]float64{"root": 2, "root;main": 2, "root;main;gc": 2}},
+		{"/missing", map[string]float64{"root": 0}},
+	}
+	for _, tt := range tests {
+		graph, err := BuildFlameGraph(p, FlameGraphOptions{LabelKey: "endpoint", LabelValue: tt.value})
+		if err != nil {
+			t.Errorf("%s: %v", tt.value, err)
+			continue
+		}
+		if got := framePaths(t, graph); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
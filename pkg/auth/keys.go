@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	// ScopeIngest allows creating sessions and uploading profiles and metrics
+	ScopeIngest Scope = "ingest"
+	// ScopeRead allows reading sessions, profiles, metrics and analyses
+	ScopeRead Scope = "read"
+	// ScopeAdmin allows everything, including deleting sessions, retention
+	// and key management
+	ScopeAdmin Scope = "admin"
+)
+
+// AllApplications in a key's applications grants access to every application
+const AllApplications = "*"
+
+// keyPrefix starts every API key so that keys are recognizable in configs
+// and secret scanners
+const keyPrefix = "pk_"
+
+var (
+	// ErrInvalidKey is returned by Authenticate for unknown keys
+	ErrInvalidKey = errors.New("invalid API key")
+	// ErrKeyNotFound is returned by Delete for unknown key IDs
+	ErrKeyNotFound = errors.New("API key not found")
+)
+
+// Key describes an API key. The key itself is only returned once, when it
+// is created; the store keeps its SHA-256 hash.
+type Key struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	Prefix       string    `json:"prefix"`
+	Scopes       []Scope   `json:"scopes"`
+	Applications []string  `json:"applications"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// HasScope reports whether the key grants a scope. The admin scope grants
+// every scope.
+func (k *Key) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllApplications reports whether the key is valid for every application
+func (k *Key) AllApplications() bool {
+	for _, app := range k.Applications {
+		if app == AllApplications {
+			return true
+		}
+	}
+	return false
+}
+
+// CoversApplication reports whether the key is valid for an application
+func (k *Key) CoversApplication(applicationID string) bool {
+	for _, app := range k.Applications {
+		if app == AllApplications || app == applicationID {
+			return true
+		}
+	}
+	return false
+}
+
+// KeySpec is the request for a new API key
+type KeySpec struct {
+	Name         string   `json:"name"`
+	Scopes       []Scope  `json:"scopes"`
+	Applications []string `json:"applications"`
+}
+
+// Validate checks that the spec names known scopes and at least one
+// application. Admin keys must be valid for all applications.
+func (s KeySpec) Validate() error {
+	if len(s.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	admin := false
+	for _, scope := range s.Scopes {
+		switch scope {
+		case ScopeIngest, ScopeRead:
+		case ScopeAdmin:
+			admin = true
+		default:
+			return fmt.Errorf("invalid scope: %s (expected ingest, read or admin)", scope)
+		}
+	}
+
+	if len(s.Applications) == 0 {
+		return fmt.Errorf("at least one application is required, or %q for all", AllApplications)
+	}
+	all := false
+	for _, app := range s.Applications {
+		if strings.TrimSpace(app) == "" {
+			return fmt.Errorf("application IDs must not be empty")
+		}
+		all = all || app == AllApplications
+	}
+	if admin && !all {
+		return fmt.Errorf("admin keys must be valid for all applications (%q)", AllApplications)
+	}
+	return nil
+}
+
+// storedKey is a key as persisted: its description and hash
+type storedKey struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+// KeyStore holds the API keys, persisted as a JSON file
+type KeyStore struct {
+	path     string
+	adminKey *storedKey
+
+	mu     sync.RWMutex
+	keys   []*storedKey
+	byHash map[string]*storedKey
+}
+
+// NewKeyStore opens the key store kept at path, creating it on the first
+// key. A non-empty adminKey is accepted as an additional admin key valid for
+// all applications; it is never written to the store.
+func NewKeyStore(path, adminKey string) (*KeyStore, error) {
+	s := &KeyStore{
+		path:   path,
+		byHash: make(map[string]*storedKey),
+	}
+
+	if adminKey != "" {
+		s.adminKey = &storedKey{
+			Key: Key{
+				ID:           "config",
+				Name:         "admin key from the server configuration",
+				Scopes:       []Scope{ScopeAdmin},
+				Applications: []string{AllApplications},
+			},
+			Hash: hashKey(adminKey),
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	for _, k := range s.keys {
+		s.byHash[k.Hash] = k
+	}
+
+	return s, nil
+}
+
+// HasAdmin reports whether any key, including the configured admin key,
+// grants the admin scope
+func (s *KeyStore) HasAdmin() bool {
+	if s.adminKey != nil {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if k.HasScope(ScopeAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate returns the key matching a presented API key
+func (s *KeyStore) Authenticate(key string) (*Key, error) {
+	hash := hashKey(key)
+
+	if s.adminKey != nil && subtle.ConstantTimeCompare([]byte(hash), []byte(s.adminKey.Hash)) == 1 {
+		k := s.adminKey.Key
+		return &k, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored, ok := s.byHash[hash]
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	k := stored.Key
+	return &k, nil
+}
+
+// Create adds a key for spec and returns it with the API key, which is not
+// stored and cannot be recovered later
+func (s *KeyStore) Create(spec KeySpec) (*Key, string, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	apiKey := keyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	stored := &storedKey{
+		Key: Key{
+			ID:           hex.EncodeToString(id),
+			Name:         spec.Name,
+			Prefix:       apiKey[:len(keyPrefix)+6],
+			Scopes:       spec.Scopes,
+			Applications: spec.Applications,
+			CreatedAt:    time.Now().UTC(),
+		},
+		Hash: hashKey(apiKey),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := append(append([]*storedKey(nil), s.keys...), stored)
+	if err := s.save(keys); err != nil {
+		return nil, "", err
+	}
+	s.keys = keys
+	s.byHash[stored.Hash] = stored
+
+	k := stored.Key
+	return &k, apiKey, nil
+}
+
+// List returns the stored keys, oldest first. The configured admin key is
+// not listed.
+func (s *KeyStore) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]Key, len(s.keys))
+	for i, k := range s.keys {
+		keys[i] = k.Key
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Delete revokes a stored key
+func (s *KeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*storedKey, 0, len(s.keys))
+	var deleted *storedKey
+	for _, k := range s.keys {
+		if k.ID == id {
+			deleted = k
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if deleted == nil {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+
+	if err := s.save(keys); err != nil {
+		return err
+	}
+	s.keys = keys
+	delete(s.byHash, deleted.Hash)
+	return nil
+}
+
+// save writes the keys to a temporary file and renames it over the store,
+// readable by the owner only since the file grants access to the collector
+func (s *KeyStore) save(keys []*storedKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal API keys: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".keys-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	return nil
+}
+
+// hashKey returns the hex SHA-256 of an API key. Keys carry 192 random
+// bits, so a fast unsalted hash is enough to protect them at rest.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
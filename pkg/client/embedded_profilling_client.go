@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"runtime/trace"
 	"sync"
 	"time"
 
+	"github.com/google/pprof/profile"
 	"github.com/shirou/gopsutil/v3/process"
 
 	"github.com/King-kin5/analysis/pkg/types"
@@ -28,13 +31,33 @@ type Client struct {
 	mu        sync.RWMutex
 	ctx       context.Context
 	cancel    context.CancelFunc
+
+	// contention tracks how many sessions currently need block and mutex
+	// profiling enabled, so rates are restored once the last one stops
+	contentionMu  sync.Mutex
+	blockSessions int
+	mutexSessions int
+	blockRate     int
+	mutexRate     int
+	prevMutexRate int
 }
 
+const (
+	// defaultBlockProfileRate samples one blocking event per 10µs blocked
+	defaultBlockProfileRate = 10000
+	// defaultMutexProfileFraction reports one in 10 mutex contention events
+	defaultMutexProfileFraction = 10
+)
+
 type profilingSession struct {
 	session    types.ProfileSession
 	cpuFile    io.WriteCloser
 	cancel     context.CancelFunc
 	collecting bool
+
+	// cpuStopped is closed once the session's CPU profile has been stopped;
+	// nil when the session never started one
+	cpuStopped chan struct{}
 }
 
 // NewClient creates a new embedded profiling client
@@ -63,7 +86,7 @@ func NewClient(config types.AgentConfig) (*Client, error) {
 
 // StartProfiling starts a new profiling session
 func (c *Client) StartProfiling(ctx context.Context, config types.ProfilingConfig) (string, error) {
-	sessionID := fmt.Sprintf("%s_%d", c.config.ApplicationID, time.Now().UnixNano())
+	sessionID := types.NewSessionID(c.config.ApplicationID)
 	
 	session := types.ProfileSession{
 		ID:            sessionID,
@@ -73,6 +96,7 @@ func (c *Client) StartProfiling(ctx context.Context, config types.ProfilingConfi
 		StartTime:     time.Now(),
 		ProfileType:   types.ProfileTypeCPU, // Default
 		Mode:          c.config.Mode,
+		Labels:        types.MergeLabels(c.config.Labels, config.Labels),
 		Metadata: map[string]interface{}{
 			"go_version": runtime.Version(),
 			"os":         runtime.GOOS,
@@ -80,32 +104,61 @@ func (c *Client) StartProfiling(ctx context.Context, config types.ProfilingConfi
 		},
 	}
 
+	if config.Window > 0 {
+		session.Mode = types.ProfileModeContinuous
+	}
+
 	ps := &profilingSession{
 		session:    session,
 		collecting: true,
 	}
 
+	// Every collector of the session stops when this context is cancelled
+	sessionCtx, cancel := context.WithCancel(ctx)
+	ps.cancel = cancel
+
 	c.mu.Lock()
 	c.sessions[sessionID] = ps
 	c.mu.Unlock()
 
+	// Sessions are reported before any of their profiles so that collectors
+	// requiring API keys can tie the profiles to the application, and so
+	// that continuous sessions can be queried while they run. The local copy
+	// is sent since a concurrent StopProfiling may already be ending ps.session.
+	if err := c.sendSession(session); err != nil {
+		c.logger.Warn("Failed to send session", zap.Error(err))
+	}
+
 	// Start profiling based on types requested
-	for _, profileType := range config.ProfileTypes {
-		switch profileType {
-		case types.ProfileTypeCPU:
-			if err := c.startCPUProfile(ctx, ps); err != nil {
-				c.logger.Error("Failed to start CPU profiling", zap.Error(err))
+	if config.Window > 0 {
+		ps.cpuStopped = make(chan struct{})
+		go c.runWindows(sessionCtx, ps, config)
+	} else {
+		for _, profileType := range config.ProfileTypes {
+			switch profileType {
+			case types.ProfileTypeCPU:
+				if err := c.startCPUProfile(sessionCtx, ps); err != nil {
+					c.logger.Error("Failed to start CPU profiling", zap.Error(err))
+				}
+			case types.ProfileTypeMemory, types.ProfileTypeHeap:
+				go c.collectMemoryProfile(sessionCtx, ps, config)
+			case types.ProfileTypeIO:
+				go c.collectIOProfile(sessionCtx, ps, config)
+			case types.ProfileTypeBlock, types.ProfileTypeMutex:
+				c.startContentionProfile(sessionCtx, ps, profileType, config.SampleRate)
+			case types.ProfileTypeGoroutine, types.ProfileTypeThreadCreate, types.ProfileTypeAllocs:
+				go c.collectSnapshotProfile(sessionCtx, ps, profileType, config)
+			case types.ProfileTypeTrace:
+				if err := c.startTrace(sessionCtx, ps); err != nil {
+					c.logger.Error("Failed to start execution trace", zap.Error(err))
+				}
 			}
-		case types.ProfileTypeMemory, types.ProfileTypeHeap:
-			go c.collectMemoryProfile(ctx, ps, config)
-		case types.ProfileTypeIO:
-			go c.collectIOProfile(ctx, ps, config)
 		}
 	}
 
 	// Collect metrics if enabled
 	if config.CollectMetrics {
-		go c.collectMetrics(ctx, sessionID, config.MetricsInterval)
+		go c.collectMetrics(sessionCtx, sessionID, config.MetricsInterval)
 	}
 
 	// Stop profiling after duration
@@ -134,8 +187,12 @@ func (c *Client) StopProfiling(sessionID string) error {
 		ps.cancel()
 	}
 
+	// CPU profiling is process-wide: the next session can only start one
+	// after this session's collector has stopped it
+	if ps.cpuStopped != nil {
+		<-ps.cpuStopped
+	}
 	if ps.cpuFile != nil {
-		pprof.StopCPUProfile()
 		ps.cpuFile.Close()
 	}
 
@@ -153,17 +210,17 @@ func (c *Client) startCPUProfile(ctx context.Context, ps *profilingSession) erro
 	if err := pprof.StartCPUProfile(ps.cpuFile); err != nil {
 		return err
 	}
-
-	sessionCtx, cancel := context.WithCancel(ctx)
-	ps.cancel = cancel
+	ps.cpuStopped = make(chan struct{})
 
 	go func() {
-		<-sessionCtx.Done()
+		<-ctx.Done()
 		pprof.StopCPUProfile()
+		close(ps.cpuStopped)
 		
 		// Send CPU profile data
 		profileData := types.ProfileData{
 			SessionID:   ps.session.ID,
+			Labels:      ps.session.Labels,
 			Type:        types.ProfileTypeCPU,
 			Timestamp:   time.Now(),
 			Data:        buf.Bytes(),
@@ -175,6 +232,358 @@ func (c *Client) startCPUProfile(ctx context.Context, ps *profilingSession) erro
 	return nil
 }
 
+// startTrace records a runtime execution trace for the lifetime of the
+// session. Only one trace can run per process at a time.
+func (c *Client) startTrace(ctx context.Context, ps *profilingSession) error {
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		trace.Stop()
+
+		profileData := types.ProfileData{
+			SessionID:   ps.session.ID,
+			Labels:      ps.session.Labels,
+			Type:        types.ProfileTypeTrace,
+			Timestamp:   time.Now(),
+			Data:        buf.Bytes(),
+			SampleCount: int64(buf.Len()),
+		}
+		c.sendProfileUpload(profileData)
+	}()
+
+	return nil
+}
+
+// runWindows records every requested profile type in back-to-back windows of
+// config.Window until the session stops. All types share the same window
+// boundaries and the CPU profile is restarted as soon as it is stopped, so
+// consecutive windows never overlap. CPU, block and mutex windows cover the
+// whole window; heap, allocs, goroutine and threadcreate are snapshots taken
+// at its end.
+func (c *Client) runWindows(ctx context.Context, ps *profilingSession, config types.ProfilingConfig) {
+	defer close(ps.cpuStopped)
+
+	var (
+		cpu        bool
+		snapshots  []types.ProfileType
+		contention = make(map[types.ProfileType][]byte)
+		rates      = make(map[types.ProfileType]int)
+	)
+
+	for _, profileType := range config.ProfileTypes {
+		switch profileType {
+		case types.ProfileTypeCPU:
+			cpu = true
+		case types.ProfileTypeMemory, types.ProfileTypeHeap:
+			snapshots = appendType(snapshots, types.ProfileTypeHeap)
+		case types.ProfileTypeGoroutine, types.ProfileTypeThreadCreate, types.ProfileTypeAllocs:
+			snapshots = appendType(snapshots, profileType)
+		case types.ProfileTypeBlock, types.ProfileTypeMutex:
+			if _, ok := contention[profileType]; ok {
+				continue
+			}
+			rates[profileType] = c.enableContentionProfiling(profileType, config.SampleRate)
+			defer c.disableContentionProfiling(profileType)
+
+			var base bytes.Buffer
+			pprof.Lookup(string(profileType)).WriteTo(&base, 0)
+			contention[profileType] = base.Bytes()
+		case types.ProfileTypeIO:
+			go c.collectIOProfile(ctx, ps, config)
+		case types.ProfileTypeTrace:
+			c.logger.Warn("Execution traces are not recorded in continuous mode")
+		}
+	}
+
+	start := time.Now()
+
+	var cpuBuf *bytes.Buffer
+	if cpu {
+		cpuBuf = c.startCPUWindow()
+	}
+
+	ticker := time.NewTicker(config.Window)
+	defer ticker.Stop()
+
+	for {
+		stopped := false
+		select {
+		case <-ctx.Done():
+			stopped = true
+		case <-ticker.C:
+		}
+		end := time.Now()
+
+		var window []types.ProfileData
+
+		if cpuBuf != nil {
+			pprof.StopCPUProfile()
+			window = append(window, types.ProfileData{
+				SessionID:   ps.session.ID,
+				Labels:      ps.session.Labels,
+				Type:        types.ProfileTypeCPU,
+				Timestamp:   start,
+				Data:        cpuBuf.Bytes(),
+				SampleCount: int64(cpuBuf.Len()),
+			})
+			cpuBuf = nil
+		}
+		if cpu && !stopped {
+			cpuBuf = c.startCPUWindow()
+		}
+
+		for profileType, base := range contention {
+			var current bytes.Buffer
+			if err := pprof.Lookup(string(profileType)).WriteTo(&current, 0); err != nil {
+				c.logger.Error("Failed to collect profile", zap.String("type", string(profileType)), zap.Error(err))
+				continue
+			}
+			contention[profileType] = current.Bytes()
+
+			data, sampleCount, err := deltaProfile(base, current.Bytes())
+			if err != nil {
+				c.logger.Warn("Failed to compute profile delta", zap.String("type", string(profileType)), zap.Error(err))
+				continue
+			}
+			window = append(window, types.ProfileData{
+				SessionID:   ps.session.ID,
+				Labels:      ps.session.Labels,
+				Type:        profileType,
+				Timestamp:   start,
+				Data:        data,
+				SampleRate:  rates[profileType],
+				SampleCount: sampleCount,
+			})
+		}
+
+		for _, profileType := range snapshots {
+			var buf bytes.Buffer
+			if err := pprof.Lookup(string(profileType)).WriteTo(&buf, 0); err != nil {
+				c.logger.Error("Failed to collect profile", zap.String("type", string(profileType)), zap.Error(err))
+				continue
+			}
+			window = append(window, types.ProfileData{
+				SessionID:   ps.session.ID,
+				Labels:      ps.session.Labels,
+				Type:        profileType,
+				Timestamp:   end,
+				Data:        buf.Bytes(),
+				SampleCount: int64(pprof.Lookup(string(profileType)).Count()),
+			})
+		}
+
+		// Uploads must not delay the next window
+		go func(window []types.ProfileData) {
+			for _, data := range window {
+				c.sendProfileData(data)
+			}
+		}(window)
+
+		if stopped {
+			return
+		}
+		start = end
+	}
+}
+
+// startCPUWindow starts CPU profiling into a new buffer. It returns nil when
+// CPU profiling is already running elsewhere in the process; the next window
+// tries again.
+func (c *Client) startCPUWindow() *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		c.logger.Warn("Failed to start CPU profile window", zap.Error(err))
+		return nil
+	}
+	return &buf
+}
+
+func appendType(profileTypes []types.ProfileType, profileType types.ProfileType) []types.ProfileType {
+	for _, t := range profileTypes {
+		if t == profileType {
+			return profileTypes
+		}
+	}
+	return append(profileTypes, profileType)
+}
+
+// startContentionProfile enables block or mutex profiling for the session and
+// sends the contention recorded while it ran once the session stops. rate is
+// the block profile rate in nanoseconds or the mutex profile fraction; values
+// <= 0 select a default.
+func (c *Client) startContentionProfile(ctx context.Context, ps *profilingSession, profileType types.ProfileType, rate int) {
+	name := "block"
+	if profileType == types.ProfileTypeMutex {
+		name = "mutex"
+	}
+
+	rate = c.enableContentionProfiling(profileType, rate)
+
+	var base bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&base, 0); err != nil {
+		c.logger.Error("Failed to capture baseline profile", zap.String("type", name), zap.Error(err))
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		var current bytes.Buffer
+		err := pprof.Lookup(name).WriteTo(&current, 0)
+		c.disableContentionProfiling(profileType)
+		if err != nil {
+			c.logger.Error("Failed to collect profile", zap.String("type", name), zap.Error(err))
+			return
+		}
+
+		// The runtime's profiles are cumulative since process start, so only
+		// send what was recorded during the session
+		data, sampleCount, err := deltaProfile(base.Bytes(), current.Bytes())
+		if err != nil {
+			c.logger.Warn("Failed to compute profile delta, sending cumulative profile",
+				zap.String("type", name), zap.Error(err))
+			data = current.Bytes()
+		}
+
+		profileData := types.ProfileData{
+			SessionID:   ps.session.ID,
+			Labels:      ps.session.Labels,
+			Type:        profileType,
+			Timestamp:   time.Now(),
+			Data:        data,
+			SampleRate:  rate,
+			SampleCount: sampleCount,
+		}
+		c.sendProfileData(profileData)
+	}()
+}
+
+// collectSnapshotProfile sends a point-in-time profile of the runtime once the
+// session stops. Goroutine profiles are optionally followed by a full text
+// dump, which keeps the goroutine states the pprof form drops.
+func (c *Client) collectSnapshotProfile(ctx context.Context, ps *profilingSession, profileType types.ProfileType, config types.ProfilingConfig) {
+	<-ctx.Done()
+
+	name := string(profileType)
+	var buf bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+		c.logger.Error("Failed to collect profile", zap.String("type", name), zap.Error(err))
+		return
+	}
+
+	c.sendProfileData(types.ProfileData{
+		SessionID:   ps.session.ID,
+		Labels:      ps.session.Labels,
+		Type:        profileType,
+		Timestamp:   time.Now(),
+		Data:        buf.Bytes(),
+		SampleCount: int64(pprof.Lookup(name).Count()),
+	})
+
+	if profileType != types.ProfileTypeGoroutine || !config.GoroutineStacks {
+		return
+	}
+
+	var dump bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&dump, 2); err != nil {
+		c.logger.Error("Failed to collect goroutine dump", zap.Error(err))
+		return
+	}
+
+	c.sendProfileData(types.ProfileData{
+		SessionID:   ps.session.ID,
+		Labels:      ps.session.Labels,
+		Type:        profileType,
+		Timestamp:   time.Now(),
+		Data:        dump.Bytes(),
+		SampleCount: int64(bytes.Count(dump.Bytes(), []byte("\ngoroutine ")) + 1),
+		Metadata: map[string]interface{}{
+			"format": types.ProfileFormatText,
+		},
+	})
+}
+
+// enableContentionProfiling turns on block or mutex profiling and returns the
+// rate in effect. Concurrent sessions share the rate set by the first one.
+func (c *Client) enableContentionProfiling(profileType types.ProfileType, rate int) int {
+	c.contentionMu.Lock()
+	defer c.contentionMu.Unlock()
+
+	switch profileType {
+	case types.ProfileTypeBlock:
+		if rate <= 0 {
+			rate = defaultBlockProfileRate
+		}
+		if c.blockSessions == 0 {
+			runtime.SetBlockProfileRate(rate)
+			c.blockRate = rate
+		}
+		c.blockSessions++
+		return c.blockRate
+	default:
+		if rate <= 0 {
+			rate = defaultMutexProfileFraction
+		}
+		if c.mutexSessions == 0 {
+			c.prevMutexRate = runtime.SetMutexProfileFraction(rate)
+			c.mutexRate = rate
+		}
+		c.mutexSessions++
+		return c.mutexRate
+	}
+}
+
+// disableContentionProfiling restores the previous rate once no session needs
+// block or mutex profiling anymore. The runtime offers no way to read the
+// block profile rate, so it is reset to 0, its default.
+func (c *Client) disableContentionProfiling(profileType types.ProfileType) {
+	c.contentionMu.Lock()
+	defer c.contentionMu.Unlock()
+
+	switch profileType {
+	case types.ProfileTypeBlock:
+		c.blockSessions--
+		if c.blockSessions == 0 {
+			runtime.SetBlockProfileRate(0)
+		}
+	default:
+		c.mutexSessions--
+		if c.mutexSessions == 0 {
+			runtime.SetMutexProfileFraction(c.prevMutexRate)
+		}
+	}
+}
+
+// deltaProfile subtracts a baseline profile from a later capture of the same
+// cumulative profile
+func deltaProfile(base, current []byte) ([]byte, int64, error) {
+	baseProfile, err := profile.ParseData(base)
+	if err != nil {
+		return nil, 0, err
+	}
+	currentProfile, err := profile.ParseData(current)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	baseProfile.Scale(-1)
+	delta, err := profile.Merge([]*profile.Profile{currentProfile, baseProfile})
+	if err != nil {
+		return nil, 0, err
+	}
+	delta.TimeNanos = baseProfile.TimeNanos
+	delta.DurationNanos = currentProfile.TimeNanos - baseProfile.TimeNanos
+
+	var buf bytes.Buffer
+	if err := delta.Write(&buf); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), int64(len(delta.Sample)), nil
+}
+
 func (c *Client) collectMemoryProfile(ctx context.Context, ps *profilingSession, config types.ProfilingConfig) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -196,6 +605,7 @@ func (c *Client) collectMemoryProfile(ctx context.Context, ps *profilingSession,
 
 			profileData := types.ProfileData{
 				SessionID:   ps.session.ID,
+				Labels:      ps.session.Labels,
 				Type:        types.ProfileTypeHeap,
 				Timestamp:   time.Now(),
 				Data:        buf.Bytes(),
@@ -267,6 +677,7 @@ func (c *Client) collectIOProfile(ctx context.Context, ps *profilingSession, con
 
 			profileData := types.ProfileData{
 				SessionID:   ps.session.ID,
+				Labels:      ps.session.Labels,
 				Type:        types.ProfileTypeIO,
 				Timestamp:   time.Now(),
 				Data:        jsonData,
@@ -304,6 +715,19 @@ func (c *Client) collectMetrics(ctx context.Context, sessionID string, interval
 	}
 }
 
+// post sends a request to the collector with the configured API key
+func (c *Client) post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+	return c.httpClient.Do(req)
+}
+
 func (c *Client) sendSession(session types.ProfileSession) error {
 	data, err := json.Marshal(session)
 	if err != nil {
@@ -311,7 +735,7 @@ func (c *Client) sendSession(session types.ProfileSession) error {
 	}
 
 	url := fmt.Sprintf("%s/api/v1/sessions", c.config.ServerURL)
-	resp, err := c.httpClient.Post(url, "application/json", bytes.NewBuffer(data))
+	resp, err := c.post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
@@ -331,7 +755,7 @@ func (c *Client) sendProfileData(data types.ProfileData) error {
 	}
 
 	url := fmt.Sprintf("%s/api/v1/profiles", c.config.ServerURL)
-	resp, err := c.httpClient.Post(url, "application/json", bytes.NewBuffer(payload))
+	resp, err := c.post(url, "application/json", bytes.NewBuffer(payload))
 	if err != nil {
 		c.logger.Error("Failed to send profile data", zap.Error(err))
 		return err
@@ -341,6 +765,34 @@ func (c *Client) sendProfileData(data types.ProfileData) error {
 	return nil
 }
 
+// sendProfileUpload sends the profile as a raw application/octet-stream body,
+// which avoids base64 encoding large payloads such as execution traces
+func (c *Client) sendProfileUpload(data types.ProfileData) error {
+	query := url.Values{}
+	query.Set("session_id", data.SessionID)
+	query.Set("application_id", c.config.ApplicationID)
+	query.Set("type", string(data.Type))
+	query.Set("timestamp", data.Timestamp.Format(time.RFC3339))
+	if len(data.Labels) > 0 {
+		query.Set("labels", data.Labels.String())
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v1/profiles?%s", c.config.ServerURL, query.Encode())
+	resp, err := c.post(endpoint, "application/octet-stream", bytes.NewReader(data.Data))
+	if err != nil {
+		c.logger.Error("Failed to upload profile data", zap.Error(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		c.logger.Error("Failed to upload profile data", zap.Int("status", resp.StatusCode))
+		return fmt.Errorf("failed to upload profile data: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
 func (c *Client) sendMetrics(sessionID string, metrics types.MetricsSnapshot) error {
 	payload := map[string]interface{}{
 		"session_id": sessionID,
@@ -353,7 +805,7 @@ func (c *Client) sendMetrics(sessionID string, metrics types.MetricsSnapshot) er
 	}
 
 	url := fmt.Sprintf("%s/api/v1/metrics", c.config.ServerURL)
-	resp, err := c.httpClient.Post(url, "application/json", bytes.NewBuffer(data))
+	resp, err := c.post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		c.logger.Error("Failed to send metrics", zap.Error(err))
 		return err
@@ -364,6 +816,11 @@ func (c *Client) sendMetrics(sessionID string, metrics types.MetricsSnapshot) er
 }
 
 func (c *Client) autoProfile() {
+	if c.config.Continuous {
+		c.continuousProfile()
+		return
+	}
+
 	ticker := time.NewTicker(c.config.ProfileInterval)
 	defer ticker.Stop()
 
@@ -374,7 +831,6 @@ func (c *Client) autoProfile() {
 		case <-ticker.C:
 			config := types.ProfilingConfig{
 				ProfileTypes:    []types.ProfileType{types.ProfileTypeCPU, types.ProfileTypeMemory},
-				Duration:        30 * time.Second,
 				CollectMetrics:  true,
 				MetricsInterval: 5 * time.Second,
 			}
@@ -382,23 +838,71 @@ func (c *Client) autoProfile() {
 			sessionID, err := c.StartProfiling(c.ctx, config)
 			if err != nil {
 				c.logger.Error("Auto-profiling failed", zap.Error(err))
-			} else {
-				c.logger.Info("Auto-profiling started", zap.String("session_id", sessionID))
+				continue
+			}
+			c.logger.Info("Auto-profiling started", zap.String("session_id", sessionID))
+
+			// CPU profiling is process-wide, so the session is stopped here
+			// rather than by a timer: the next tick cannot start one before
+			// this one has ended
+			timer := time.NewTimer(min(30*time.Second, c.config.ProfileInterval))
+			select {
+			case <-c.ctx.Done():
+				// Close stops the session
+				timer.Stop()
+				return
+			case <-timer.C:
 			}
+			c.StopProfiling(sessionID)
 		}
 	}
 }
 
+// defaultWindowDuration is the continuous profiling window used when
+// AgentConfig.WindowDuration is not set
+const defaultWindowDuration = 10 * time.Second
+
+// continuousProfile records a single continuous session for the lifetime of
+// the client
+func (c *Client) continuousProfile() {
+	window := c.config.WindowDuration
+	if window <= 0 {
+		window = defaultWindowDuration
+	}
+
+	config := types.ProfilingConfig{
+		ProfileTypes:    []types.ProfileType{types.ProfileTypeCPU, types.ProfileTypeHeap},
+		Window:          window,
+		CollectMetrics:  true,
+		MetricsInterval: window,
+	}
+
+	sessionID, err := c.StartProfiling(c.ctx, config)
+	if err != nil {
+		c.logger.Error("Continuous profiling failed", zap.Error(err))
+		return
+	}
+	c.logger.Info("Continuous profiling started",
+		zap.String("session_id", sessionID),
+		zap.Duration("window", window))
+}
+
 // Close stops the client and cleans up resources
 func (c *Client) Close() error {
 	c.cancel()
 	
+	// StopProfiling takes the lock itself
 	c.mu.Lock()
+	sessionIDs := make([]string, 0, len(c.sessions))
 	for sessionID := range c.sessions {
-		c.StopProfiling(sessionID)
+		sessionIDs = append(sessionIDs, sessionID)
 	}
 	c.mu.Unlock()
 
+	for _, sessionID := range sessionIDs {
+		c.StopProfiling(sessionID)
+	}
+
 	return c.logger.Sync()
 }
 
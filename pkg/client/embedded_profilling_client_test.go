@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// recorder is a collector that counts ended sessions and valid CPU profiles
+type recorder struct {
+	mu       sync.Mutex
+	ended    map[string]bool
+	profiled map[string]bool
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/api/v1/sessions":
+		var session types.ProfileSession
+		if json.NewDecoder(req.Body).Decode(&session) == nil && !session.EndTime.IsZero() {
+			r.ended[session.ID] = true
+		}
+	case "/api/v1/profiles":
+		var data types.ProfileData
+		if json.NewDecoder(req.Body).Decode(&data) == nil && data.Type == types.ProfileTypeCPU {
+			if _, err := collection.Parse(data.Data); err == nil {
+				r.profiled[data.SessionID] = true
+			}
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *recorder) counts() (ended, profiled int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.ended {
+		if r.profiled[id] {
+			profiled++
+		}
+	}
+	return len(r.ended), profiled
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestAutoProfileBackToBack(t *testing.T) {
+	rec := &recorder{ended: make(map[string]bool), profiled: make(map[string]bool)}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	// A session lasts the whole interval, so each one ends as the next
+	// tick fires
+	c, err := NewClient(types.AgentConfig{
+		ServerURL:       server.URL,
+		ApplicationID:   "app",
+		AutoProfile:     true,
+		ProfileInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	ok := waitFor(5*time.Second, func() bool {
+		ended, _ := rec.counts()
+		return ended >= 4
+	})
+	c.Close()
+	if !ok {
+		t.Fatal("fewer than 4 sessions ended")
+	}
+
+	var ended, profiled int
+	waitFor(2*time.Second, func() bool {
+		ended, profiled = rec.counts()
+		return profiled == ended
+	})
+	if profiled != ended {
+		t.Errorf("%d of %d sessions sent a CPU profile", profiled, ended)
+	}
+}
+
+// profileSink is a collector that passes on every profile it receives
+type profileSink chan types.ProfileData
+
+func (s profileSink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/api/v1/profiles" {
+		var data types.ProfileData
+		if json.NewDecoder(req.Body).Decode(&data) == nil {
+			s <- data
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+//go:noinline
+func contendBefore(mu *sync.Mutex) { contend(mu) }
+
+//go:noinline
+func contendDuring(mu *sync.Mutex) { contend(mu) }
+
+// contend holds mu while another goroutine waits for it
+func contend(mu *sync.Mutex) {
+	mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		mu.Lock()
+		mu.Unlock()
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	mu.Unlock()
+	<-done
+}
+
+//go:noinline
+func blockBefore() { <-time.After(20 * time.Millisecond) }
+
+//go:noinline
+func blockDuring() { <-time.After(20 * time.Millisecond) }
+
+// profiledFunctions returns the names of the functions in a profile's samples
+func profiledFunctions(t *testing.T, data []byte) map[string]bool {
+	t.Helper()
+
+	p, err := profile.ParseData(data)
+	if err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+	functions := make(map[string]bool)
+	for _, sample := range p.Sample {
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				name := line.Function.Name
+				functions[name[strings.LastIndexByte(name, '.')+1:]] = true
+			}
+		}
+	}
+	return functions
+}
+
+func TestContentionProfiles(t *testing.T) {
+	sink := make(profileSink, 4)
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	c, err := NewClient(types.AgentConfig{ServerURL: server.URL, ApplicationID: "app"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	// Contention recorded before the session must not be reported with it
+	previous := runtime.SetMutexProfileFraction(1)
+	defer runtime.SetMutexProfileFraction(previous)
+	runtime.SetBlockProfileRate(1)
+	defer runtime.SetBlockProfileRate(0)
+	var mu sync.Mutex
+	contendBefore(&mu)
+	blockBefore()
+
+	sessionID, err := c.StartProfiling(context.Background(), types.ProfilingConfig{
+		ProfileTypes: []types.ProfileType{types.ProfileTypeBlock, types.ProfileTypeMutex},
+		SampleRate:   1,
+	})
+	if err != nil {
+		t.Fatalf("StartProfiling: %v", err)
+	}
+	contendDuring(&mu)
+	blockDuring()
+	if err := c.StopProfiling(sessionID); err != nil {
+		t.Fatalf("StopProfiling: %v", err)
+	}
+
+	received := make(map[types.ProfileType]types.ProfileData)
+	for len(received) < 2 {
+		select {
+		case data := <-sink:
+			received[data.Type] = data
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of 2 profiles", len(received))
+		}
+	}
+
+	tests := []struct {
+		profileType    types.ProfileType
+		during, before string
+	}{
+		{types.ProfileTypeMutex, "contendDuring", "contendBefore"},
+		{types.ProfileTypeBlock, "blockDuring", "blockBefore"},
+	}
+	for _, tt := range tests {
+		data := received[tt.profileType]
+		if data.SessionID != sessionID || data.SampleRate != 1 || data.SampleCount == 0 {
+			t.Errorf("%s: session %s, rate %d, %d samples", tt.profileType, data.SessionID, data.SampleRate, data.SampleCount)
+		}
+		functions := profiledFunctions(t, data.Data)
+		if !functions[tt.during] || functions[tt.before] {
+			t.Errorf("%s: %s profiled %v, %s profiled %v, want only %s",
+				tt.profileType, tt.during, functions[tt.during], tt.before, functions[tt.before], tt.during)
+		}
+	}
+
+	// The mutex profile fraction in effect before the session is restored
+	if got := runtime.SetMutexProfileFraction(-1); got != 1 {
+		t.Errorf("mutex profile fraction = %d after the session, want 1", got)
+	}
+}
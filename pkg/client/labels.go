@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Do runs f with the labels attached to the calling goroutine, as
+// pprof.Do does. CPU, goroutine, block and mutex samples taken while f runs,
+// including in goroutines it starts, carry the labels and can be broken down
+// by them on the server, e.g. by endpoint or tenant. Labels already set on
+// ctx are kept unless overridden.
+func Do(ctx context.Context, labels types.Labels, f func(context.Context)) {
+	pprof.Do(ctx, pprofLabels(labels), f)
+}
+
+// LabelHandler wraps an HTTP handler so the work of every request is tagged
+// with the labels, such as {"endpoint": "/checkout"}
+func LabelHandler(labels types.Labels, next http.Handler) http.Handler {
+	set := pprofLabels(labels)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pprof.Do(r.Context(), set, func(ctx context.Context) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
+
+// pprofLabels converts labels to a pprof label set with sorted keys
+func pprofLabels(labels types.Labels) pprof.LabelSet {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key, labels[key])
+	}
+	return pprof.Labels(pairs...)
+}
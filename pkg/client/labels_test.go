@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+func TestDo(t *testing.T) {
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("tenant", "a", "region", "eu"))
+
+	Do(ctx, types.Labels{"endpoint": "/checkout", "region": "us"}, func(ctx context.Context) {
+		want := map[string]string{"endpoint": "/checkout", "region": "us", "tenant": "a"}
+		for key, value := range want {
+			if got, _ := pprof.Label(ctx, key); got != value {
+				t.Errorf("label %s = %q, want %q", key, got, value)
+			}
+		}
+
+		// Goroutines started by f are profiled with its labels
+		release := make(chan struct{})
+		started := make(chan struct{})
+		go func() {
+			close(started)
+			<-release
+		}()
+		<-started
+		defer close(release)
+
+		var buf bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		p, err := profile.ParseData(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		labelled := false
+		for _, sample := range p.Sample {
+			labelled = labelled || (len(sample.Label["endpoint"]) == 1 && sample.Label["endpoint"][0] == "/checkout")
+		}
+		if !labelled {
+			t.Error("no goroutine profile sample carries endpoint=/checkout")
+		}
+	})
+
+	if _, ok := pprof.Label(ctx, "endpoint"); ok {
+		t.Error("Do modified the caller's context")
+	}
+}
+
+func TestLabelHandler(t *testing.T) {
+	var endpoint string
+	handler := LabelHandler(types.Labels{"endpoint": "/checkout"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, _ = pprof.Label(r.Context(), "endpoint")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/checkout", nil))
+	if rec.Code != http.StatusAccepted || endpoint != "/checkout" {
+		t.Errorf("status %d, endpoint label %q; want %d, /checkout", rec.Code, endpoint, http.StatusAccepted)
+	}
+}
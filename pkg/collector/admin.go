@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"net/http"
+
+	"github.com/King-kin5/analysis/pkg/retention"
+	"go.uber.org/zap"
+)
+
+// SetJanitor enables the retention admin endpoints for the janitor
+func (c *Collector) SetJanitor(j *retention.Janitor) {
+	c.janitor = j
+}
+
+// retentionStatus is the configuration and last run of the janitor
+type retentionStatus struct {
+	Config  retention.Config  `json:"config"`
+	LastRun *retention.Report `json:"last_run"`
+}
+
+func (c *Collector) handleRetentionStatus(w http.ResponseWriter, r *http.Request) {
+	if c.janitor == nil {
+		c.respondError(w, http.StatusNotFound, "Retention is not configured")
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, retentionStatus{
+		Config:  c.janitor.Config(),
+		LastRun: c.janitor.LastRun(),
+	})
+}
+
+// handleRetentionDryRun reports what a janitor run would delete and compact
+// without changing anything
+func (c *Collector) handleRetentionDryRun(w http.ResponseWriter, r *http.Request) {
+	c.runRetention(w, r, true)
+}
+
+// handleRetentionRun runs the janitor now and reports what was reclaimed
+func (c *Collector) handleRetentionRun(w http.ResponseWriter, r *http.Request) {
+	c.runRetention(w, r, false)
+}
+
+func (c *Collector) runRetention(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	if c.janitor == nil {
+		c.respondError(w, http.StatusNotFound, "Retention is not configured")
+		return
+	}
+
+	report, err := c.janitor.Run(r.Context(), dryRun)
+	if err != nil {
+		c.logger.Error("Retention run failed", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Retention run failed")
+		return
+	}
+
+	if !dryRun {
+		c.mu.Lock()
+		for _, id := range report.Sessions {
+			delete(c.sessions, id)
+		}
+		c.mu.Unlock()
+	}
+
+	c.respondJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,395 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/library"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// loadSessionProfile decodes the profile selected by the request's {id} route
+// variable and "type", "from" and "to" query parameters, writing an error
+// response on failure
+func (c *Collector) loadSessionProfile(w http.ResponseWriter, r *http.Request) (*collection.Profile, bool) {
+	sessionID := mux.Vars(r)["id"]
+
+	profileType := types.ProfileType(r.URL.Query().Get("type"))
+	if profileType == "" {
+		profileType = types.ProfileTypeCPU
+	}
+
+	from, to, err := timeRange(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	p, err := c.analyzer.SessionProfile(sessionID, profileType, from, to)
+	if err != nil {
+		switch {
+		case errors.Is(err, collection.ErrNoProfiles):
+			c.respondError(w, http.StatusNotFound, "No profiles found")
+		case errors.Is(err, collection.ErrIncompatibleProfiles):
+			c.respondError(w, http.StatusBadRequest, err.Error())
+		default:
+			c.logger.Error("Failed to load profile", zap.Error(err))
+			c.respondError(w, http.StatusInternalServerError, "Failed to load profile")
+		}
+		return nil, false
+	}
+
+	return p, true
+}
+
+// sampleIndex resolves the request's "sample_index" query parameter against a profile
+func (c *Collector) sampleIndex(w http.ResponseWriter, r *http.Request, p *collection.Profile) (int, bool) {
+	index, err := p.SampleIndex(r.URL.Query().Get("sample_index"))
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return 0, false
+	}
+	return index, true
+}
+
+func (c *Collector) handleCallGraph(w http.ResponseWriter, r *http.Request) {
+	p, ok := c.loadSessionProfile(w, r)
+	if !ok {
+		return
+	}
+
+	index, ok := c.sampleIndex(w, r, p)
+	if !ok {
+		return
+	}
+
+	graph, err := collection.BuildCallGraph(p, index)
+	if err != nil {
+		c.logger.Error("Failed to build call graph", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to build call graph")
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, graph)
+}
+
+// flameGraphOptions reads flame graph options from the request's query string
+func flameGraphOptions(r *http.Request, sampleIndex int) (library.FlameGraphOptions, error) {
+	query := r.URL.Query()
+	opts := library.FlameGraphOptions{SampleIndex: sampleIndex}
+
+	if v := query.Get("min_width"); v != "" {
+		minWidth, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid min_width: %s", v)
+		}
+		opts.MinWidth = minWidth
+	}
+
+	if v := query.Get("focus"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid focus expression: %w", err)
+		}
+		opts.Focus = re
+	}
+
+	if v := query.Get("ignore"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid ignore expression: %w", err)
+		}
+		opts.Ignore = re
+	}
+
+	if v := query.Get("collapse_runtime"); v != "" {
+		collapse, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid collapse_runtime: %s", v)
+		}
+		opts.CollapseRuntime = collapse
+	}
+
+	if v := query.Get("label_key"); v != "" {
+		opts.LabelKey = v
+		opts.LabelValue = query.Get("label_value")
+	}
+
+	return opts, nil
+}
+
+func (c *Collector) handleFlameGraph(w http.ResponseWriter, r *http.Request) {
+	p, ok := c.loadSessionProfile(w, r)
+	if !ok {
+		return
+	}
+
+	index, ok := c.sampleIndex(w, r, p)
+	if !ok {
+		return
+	}
+
+	opts, err := flameGraphOptions(r, index)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	root, err := library.BuildFlameGraph(p, opts)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, root)
+}
+
+// timeRange reads the optional RFC 3339 "from" and "to" query parameters
+func timeRange(r *http.Request) (from, to time.Time, err error) {
+	query := r.URL.Query()
+
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid from: %s", v)
+		}
+	}
+
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid to: %s", v)
+		}
+	}
+
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return from, to, fmt.Errorf("to is before from")
+	}
+
+	return from, to, nil
+}
+
+// labelSelector reads a label selector such as "version=1.4.2,region=eu"
+// from the named query parameter
+func labelSelector(r *http.Request, name string) (types.Labels, error) {
+	labels, err := types.ParseLabels(r.URL.Query().Get(name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return labels, nil
+}
+
+// handleDownloadProfile serves a session's profile as a pprof file. Query
+// parameters: type, merge (merge every matching profile instead of returning
+// the latest one, keeping the latest snapshot of each session as the
+// analysis endpoints do), from/to and scope=application, which selects profiles
+// from every session of the session's application instead, optionally
+// filtered by labels.
+func (c *Collector) handleDownloadProfile(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	profileType := types.ProfileType(query.Get("type"))
+	if profileType == "" {
+		profileType = types.ProfileTypeCPU
+	}
+
+	merge := false
+	if v := query.Get("merge"); v != "" {
+		var err error
+		if merge, err = strconv.ParseBool(v); err != nil {
+			c.respondError(w, http.StatusBadRequest, "Invalid merge")
+			return
+		}
+	}
+
+	from, to, err := timeRange(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var profiles []*collection.Profile
+	switch query.Get("scope") {
+	case "", "session":
+		profiles, err = c.analyzer.SessionProfiles(sessionID, profileType, from, to)
+	case "application":
+		session, serr := c.storage.GetSession(sessionID)
+		if serr != nil {
+			c.respondError(w, http.StatusNotFound, "Session not found")
+			return
+		}
+		labels, lerr := labelSelector(r, "labels")
+		if lerr != nil {
+			c.respondError(w, http.StatusBadRequest, lerr.Error())
+			return
+		}
+		profiles, err = c.analyzer.ApplicationProfiles(storage.ProfileQuery{
+			ApplicationID: session.ApplicationID,
+			Type:          profileType,
+			From:          from,
+			To:            to,
+			Labels:        labels,
+		})
+	default:
+		c.respondError(w, http.StatusBadRequest, "Invalid scope")
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to load profiles", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to load profiles")
+		return
+	}
+
+	if len(profiles) == 0 {
+		c.respondError(w, http.StatusNotFound, "No profiles found")
+		return
+	}
+
+	p := profiles[len(profiles)-1]
+	if merge {
+		if p, err = collection.Combine(profiles); err != nil {
+			c.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	c.respondProfile(w, p, fmt.Sprintf("%s_%s.pb.gz", sessionID, profileType))
+}
+
+// respondProfile writes a profile as a gzipped pprof attachment
+func (c *Collector) respondProfile(w http.ResponseWriter, p *collection.Profile, filename string) {
+	data, err := collection.Encode(p.Profile)
+	if err != nil {
+		c.logger.Error("Failed to encode profile", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to encode profile")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// handleTop serves the flat/cum table of a session's profile. Query
+// parameters: type, sample_index, n, by (flat or cum), granularity
+// (function, file, line or address) and filter (a regular expression
+// entries must match, e.g. a package path).
+func (c *Collector) handleTop(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	granularity, err := collection.ParseGranularity(query.Get("granularity"))
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	opts := collection.TopOptions{Granularity: granularity}
+
+	switch query.Get("by") {
+	case "", "flat":
+	case "cum":
+		opts.SortByCum = true
+	default:
+		c.respondError(w, http.StatusBadRequest, "by must be flat or cum")
+		return
+	}
+
+	if v := query.Get("n"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.respondError(w, http.StatusBadRequest, "Invalid n")
+			return
+		}
+		opts.N = n
+	}
+
+	if v := query.Get("filter"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			c.respondError(w, http.StatusBadRequest, "Invalid filter expression")
+			return
+		}
+		opts.Filter = re
+	}
+
+	p, ok := c.loadSessionProfile(w, r)
+	if !ok {
+		return
+	}
+
+	if opts.SampleIndex, ok = c.sampleIndex(w, r, p); !ok {
+		return
+	}
+
+	report, err := collection.Top(p, opts)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, report)
+}
+
+func (c *Collector) handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	report, err := c.analyzer.GoroutineReport(mux.Vars(r)["id"])
+	if err != nil {
+		if errors.Is(err, collection.ErrNoProfiles) {
+			c.respondError(w, http.StatusNotFound, "No goroutine profiles found")
+			return
+		}
+		c.logger.Error("Failed to build goroutine report", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to build goroutine report")
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, report)
+}
+
+// handleDownloadTrace returns the session's latest execution trace as
+// stored, for use with go tool trace
+func (c *Collector) handleDownloadTrace(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	record, err := c.analyzer.LatestTrace(sessionID)
+	if err != nil {
+		if errors.Is(err, collection.ErrNoProfiles) {
+			c.respondError(w, http.StatusNotFound, "No traces found")
+			return
+		}
+		c.logger.Error("Failed to load trace", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to load trace")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sessionID+".trace"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(record.Data)))
+	w.Write(record.Data)
+}
+
+func (c *Collector) handleTraceSummary(w http.ResponseWriter, r *http.Request) {
+	summary, err := c.analyzer.TraceSummary(mux.Vars(r)["id"])
+	if err != nil {
+		if errors.Is(err, collection.ErrNoProfiles) {
+			c.respondError(w, http.StatusNotFound, "No traces found")
+			return
+		}
+		if errors.Is(err, collection.ErrInvalidTrace) {
+			c.respondError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		c.logger.Error("Failed to summarize trace", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to summarize trace")
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// encodePprof returns a profile with one sample of value for sampleType
+func encodePprof(t *testing.T, sampleType string, value int64) []byte {
+	t.Helper()
+
+	fn := &profile.Function{ID: 1, Name: "main.work", Filename: "/app/work.go"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 42}}}
+	data, err := collection.Encode(&profile.Profile{
+		SampleType: []*profile.ValueType{{Type: sampleType, Unit: "count"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// savePprof stores a profile with one sample of value for sampleType
+func savePprof(t *testing.T, store storage.Storage, sessionID string, profileType types.ProfileType, sampleType string, value int64, at time.Time) {
+	t.Helper()
+
+	data := encodePprof(t, sampleType, value)
+	if err := store.SaveProfileData(&types.ProfileData{SessionID: sessionID, Type: profileType, Timestamp: at, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncompatibleProfiles(t *testing.T) {
+	c, store := newTestCollector(t)
+	for _, id := range []string{"mixed", "ok"} {
+		if err := store.SaveSession(&types.ProfileSession{ID: id, ApplicationID: "app"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	savePprof(t, store, "mixed", types.ProfileTypeCPU, "cpu", 1, now)
+	savePprof(t, store, "mixed", types.ProfileTypeCPU, "samples", 1, now.Add(time.Second))
+	savePprof(t, store, "ok", types.ProfileTypeCPU, "cpu", 1, now)
+
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/ok/top", "", ""), http.StatusOK, "compatible profiles")
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/mixed/top", "", ""), http.StatusBadRequest, "top of incompatible profiles")
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/mixed/callgraph", "", ""), http.StatusBadRequest, "call graph of incompatible profiles")
+	expectStatus(t, serve(c, "GET", "/api/v1/compare?base=ok&target=mixed", "", ""), http.StatusBadRequest, "compare with incompatible profiles")
+}
+
+func TestDownloadMergedSnapshots(t *testing.T) {
+	c, store := newTestCollector(t)
+	for _, id := range []string{"s1", "s2"} {
+		if err := store.SaveSession(&types.ProfileSession{ID: id, ApplicationID: "app"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	savePprof(t, store, "s1", types.ProfileTypeHeap, "inuse_space", 10, now)
+	savePprof(t, store, "s1", types.ProfileTypeHeap, "inuse_space", 30, now.Add(time.Second))
+	savePprof(t, store, "s2", types.ProfileTypeHeap, "inuse_space", 5, now)
+	savePprof(t, store, "s1", types.ProfileTypeCPU, "cpu", 1, now)
+	savePprof(t, store, "s1", types.ProfileTypeCPU, "cpu", 2, now.Add(time.Second))
+
+	tests := []struct {
+		query string
+		want  int64
+	}{
+		{"type=heap&merge=true", 30},
+		{"type=heap&merge=true&scope=application", 35},
+		{"type=cpu&merge=true", 3},
+	}
+	for _, tt := range tests {
+		rec := serve(c, "GET", "/api/v1/sessions/s1/profile?"+tt.query, "", "")
+		expectStatus(t, rec, http.StatusOK, tt.query)
+
+		p, err := collection.Parse(rec.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var total int64
+		for _, s := range p.Sample {
+			total += s.Value[0]
+		}
+		if total != tt.want {
+			t.Errorf("%s: total %d, want %d", tt.query, total, tt.want)
+		}
+	}
+}
+
+func TestTraceSummaryOfInvalidTrace(t *testing.T) {
+	c, store := newTestCollector(t)
+	if err := store.SaveSession(&types.ProfileSession{ID: "s", ApplicationID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/s/trace/summary", "", ""), http.StatusNotFound, "no trace")
+
+	err := store.SaveProfileData(&types.ProfileData{SessionID: "s", Type: types.ProfileTypeTrace, Timestamp: time.Now(), Data: []byte("go 1.23 trace\x00\x00garbage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/s/trace/summary", "", ""), http.StatusUnprocessableEntity, "unparsable trace")
+}
@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// handleApplicationProfiles lists the profiles recorded by every session of an
+// application in the from/to range, optionally filtered by type and labels.
+// The list takes the paging and field parameters of handleGetProfiles. With
+// merge=true the matching profiles of the requested type are merged
+// server-side and returned as a single pprof file.
+func (c *Collector) handleApplicationProfiles(w http.ResponseWriter, r *http.Request) {
+	applicationID := mux.Vars(r)["application_id"]
+	query := r.URL.Query()
+	profileType := types.ProfileType(query.Get("type"))
+
+	from, to, err := timeRange(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	labels, err := labelSelector(r, "labels")
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	profileQuery := storage.ProfileQuery{
+		ApplicationID: applicationID,
+		Type:          profileType,
+		From:          from,
+		To:            to,
+		Labels:        labels,
+	}
+
+	merge := false
+	if v := query.Get("merge"); v != "" {
+		if merge, err = strconv.ParseBool(v); err != nil {
+			c.respondError(w, http.StatusBadRequest, "Invalid merge")
+			return
+		}
+	}
+
+	if !merge {
+		params, includeData, err := parseProfileListParams(r)
+		if err != nil {
+			c.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		profileQuery.MetadataOnly = true
+
+		profiles, err := c.storage.QueryProfileData(profileQuery)
+		if err != nil {
+			c.logger.Error("Failed to query profile data", zap.Error(err))
+			c.respondError(w, http.StatusInternalServerError, "Failed to query profile data")
+			return
+		}
+
+		if profiles == nil {
+			profiles = []*types.ProfileData{}
+		}
+		page, next := paginateProfiles(profiles, params)
+		if includeData {
+			if page, err = c.loadPayloads(page); err != nil {
+				c.logger.Error("Failed to query profile data", zap.Error(err))
+				c.respondError(w, http.StatusInternalServerError, "Failed to query profile data")
+				return
+			}
+		}
+		c.respondList(w, params, page, next)
+		return
+	}
+
+	if profileType == "" {
+		c.respondError(w, http.StatusBadRequest, "type is required to merge")
+		return
+	}
+
+	p, err := c.analyzer.ApplicationProfile(profileQuery)
+	if err != nil {
+		switch {
+		case errors.Is(err, collection.ErrNoProfiles):
+			c.respondError(w, http.StatusNotFound, "No profiles found")
+		case errors.Is(err, collection.ErrIncompatibleProfiles):
+			c.respondError(w, http.StatusBadRequest, err.Error())
+		default:
+			c.logger.Error("Failed to merge profiles", zap.Error(err))
+			c.respondError(w, http.StatusInternalServerError, "Failed to merge profiles")
+		}
+		return
+	}
+
+	c.respondProfile(w, p, fmt.Sprintf("%s_%s.pb.gz", applicationID, profileType))
+}
@@ -0,0 +1,231 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/King-kin5/analysis/pkg/auth"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// SetKeyStore requires an API key on every /api/v1 route and enables the key
+// management endpoints
+func (c *Collector) SetKeyStore(keys *auth.KeyStore) {
+	c.keys = keys
+}
+
+type apiKeyContext struct{}
+
+// requestKey returns the API key a request was authenticated with, nil when
+// authentication is disabled
+func requestKey(r *http.Request) *auth.Key {
+	key, _ := r.Context().Value(apiKeyContext{}).(*auth.Key)
+	return key
+}
+
+// authorizedFor reports whether the request may access an application's data
+func authorizedFor(r *http.Request, applicationID string) bool {
+	key := requestKey(r)
+	return key == nil || key.CoversApplication(applicationID)
+}
+
+// requiredScope returns the scope a request needs: admin for the admin
+// routes and deletions, read for other GETs and ingest for writes
+func requiredScope(r *http.Request) auth.Scope {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/v1/admin/"), r.Method == http.MethodDelete:
+		return auth.ScopeAdmin
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		return auth.ScopeRead
+	}
+	return auth.ScopeIngest
+}
+
+// authenticate checks the API key of a request, sent as a bearer token or
+// in the X-API-Key header, and the scope the route needs
+func (c *Collector) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.keys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get("X-API-Key")
+		if v := r.Header.Get("Authorization"); v != "" {
+			scheme, credentials, _ := strings.Cut(v, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(credentials)
+			}
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="profiler"`)
+			c.respondError(w, http.StatusUnauthorized, "API key required")
+			return
+		}
+
+		key, err := c.keys.Authenticate(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="profiler", error="invalid_token"`)
+			c.respondError(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+
+		if scope := requiredScope(r); !key.HasScope(scope) {
+			c.respondError(w, http.StatusForbidden, fmt.Sprintf("API key lacks the %s scope", scope))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	})
+}
+
+// authorizeVars restricts the sessions and applications named by the route
+// to those of the request's API key. Sessions of other applications are
+// reported as not found so that their IDs are not disclosed.
+func (c *Collector) authorizeVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		if key == nil || key.AllApplications() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if applicationID, ok := vars["application_id"]; ok && !key.CoversApplication(applicationID) {
+			c.respondError(w, http.StatusForbidden, "API key is not valid for application "+applicationID)
+			return
+		}
+		for _, name := range []string{"id", "session_id"} {
+			if sessionID, ok := vars[name]; ok && !c.authorizedSession(r, sessionID) {
+				c.respondError(w, http.StatusNotFound, "Session not found")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeWrite checks that the request may write to a session. An existing
+// session must belong to one of the key's applications, as must
+// applicationID, the application a new or updated session is recorded for.
+// Keys restricted to some applications cannot write to a session that does
+// not exist without naming its application, since nothing would tie the
+// data to one of theirs.
+func (c *Collector) authorizeWrite(w http.ResponseWriter, r *http.Request, sessionID, applicationID string) bool {
+	key := requestKey(r)
+	if key == nil || key.AllApplications() {
+		return true
+	}
+
+	existing, found := c.sessionApplication(sessionID)
+	switch {
+	case found && !key.CoversApplication(existing):
+		c.respondError(w, http.StatusForbidden, "API key is not valid for application "+existing)
+		return false
+	case applicationID != "" && !key.CoversApplication(applicationID):
+		c.respondError(w, http.StatusForbidden, "API key is not valid for application "+applicationID)
+		return false
+	case !found && applicationID == "":
+		c.respondError(w, http.StatusNotFound, "Session not found")
+		return false
+	}
+	return true
+}
+
+// authorizedSession reports whether the request may access a session. Keys
+// restricted to some applications only access stored sessions of those.
+func (c *Collector) authorizedSession(r *http.Request, sessionID string) bool {
+	key := requestKey(r)
+	if key == nil || key.AllApplications() {
+		return true
+	}
+	applicationID, found := c.sessionApplication(sessionID)
+	return found && key.CoversApplication(applicationID)
+}
+
+// sessionApplication returns the application of a stored session
+func (c *Collector) sessionApplication(sessionID string) (string, bool) {
+	session, err := c.storage.GetSession(sessionID)
+	if err != nil {
+		return "", false
+	}
+	return session.ApplicationID, true
+}
+
+// createdKey is the response to a key creation, the only one carrying the
+// API key itself
+type createdKey struct {
+	*auth.Key
+	APIKey string `json:"api_key"`
+}
+
+func (c *Collector) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	if c.keys == nil {
+		c.respondError(w, http.StatusNotFound, "Authentication is not configured")
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, c.keys.List())
+}
+
+// handleCreateKey creates an API key from a name, scopes and applications
+func (c *Collector) handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	if c.keys == nil {
+		c.respondError(w, http.StatusNotFound, "Authentication is not configured")
+		return
+	}
+
+	var spec auth.KeySpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		c.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key, apiKey, err := c.keys.Create(spec)
+	if err != nil {
+		c.logger.Error("Failed to create API key", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	c.logger.Info("API key created",
+		zap.String("key_id", key.ID),
+		zap.String("name", key.Name),
+		zap.String("created_by", requestKey(r).ID))
+
+	c.respondJSON(w, http.StatusCreated, createdKey{Key: key, APIKey: apiKey})
+}
+
+func (c *Collector) handleDeleteKey(w http.ResponseWriter, r *http.Request) {
+	if c.keys == nil {
+		c.respondError(w, http.StatusNotFound, "Authentication is not configured")
+		return
+	}
+
+	keyID := mux.Vars(r)["key_id"]
+	if err := c.keys.Delete(keyID); err != nil {
+		if errors.Is(err, auth.ErrKeyNotFound) {
+			c.respondError(w, http.StatusNotFound, "API key not found")
+			return
+		}
+		c.logger.Error("Failed to delete API key", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to delete API key")
+		return
+	}
+
+	c.logger.Info("API key deleted",
+		zap.String("key_id", keyID),
+		zap.String("deleted_by", requestKey(r).ID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
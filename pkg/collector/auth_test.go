@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/auth"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+const testAdminKey = "test-admin-key-0123456789"
+
+// newAuthCollector returns a collector requiring API keys, with sessions
+// "own" of application "a" and "other" of application "b", and keys for
+// application "a"
+func newAuthCollector(t *testing.T) (c *Collector, store storage.Storage, ingest, read string) {
+	t.Helper()
+
+	c, store = newTestCollector(t)
+	keys, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "api_keys.json"), testAdminKey)
+	if err != nil {
+		t.Fatalf("NewKeyStore: %v", err)
+	}
+	c.SetKeyStore(keys)
+
+	for id, app := range map[string]string{"own": "a", "other": "b"} {
+		if err := store.SaveSession(&types.ProfileSession{ID: id, ApplicationID: app}); err != nil {
+			t.Fatalf("SaveSession: %v", err)
+		}
+	}
+
+	create := func(scope auth.Scope) string {
+		_, key, err := keys.Create(auth.KeySpec{Scopes: []auth.Scope{scope}, Applications: []string{"a"}})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		return key
+	}
+	return c, store, create(auth.ScopeIngest), create(auth.ScopeRead)
+}
+
+func TestAuthenticate(t *testing.T) {
+	c, _, ingest, read := newAuthCollector(t)
+
+	rec := serve(c, "GET", "/api/v1/sessions", "", "")
+	expectStatus(t, rec, http.StatusUnauthorized, "no key")
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("no key: missing WWW-Authenticate header")
+	}
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions", "pk_unknown", ""), http.StatusUnauthorized, "unknown key")
+
+	req := newRequest("GET", "/api/v1/sessions/own")
+	req.Header.Set("X-API-Key", read)
+	expectStatus(t, serveRequest(c, req), http.StatusOK, "X-API-Key header")
+
+	expectStatus(t, serve(c, "GET", "/health", "", ""), http.StatusOK, "health without key")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		key    string
+		want   int
+	}{
+		{"read key reads", "GET", "/api/v1/sessions/own", read, http.StatusOK},
+		{"read key cannot write", "POST", "/api/v1/metrics", read, http.StatusForbidden},
+		{"ingest key cannot read", "GET", "/api/v1/sessions/own", ingest, http.StatusForbidden},
+		{"read key cannot delete", "DELETE", "/api/v1/sessions/own", read, http.StatusForbidden},
+		{"ingest key cannot delete", "DELETE", "/api/v1/sessions/own", ingest, http.StatusForbidden},
+		{"read key cannot list keys", "GET", "/api/v1/admin/keys", read, http.StatusForbidden},
+		{"read key cannot run retention", "POST", "/api/v1/admin/retention/run", read, http.StatusForbidden},
+		{"admin key lists keys", "GET", "/api/v1/admin/keys", testAdminKey, http.StatusOK},
+		{"admin key deletes", "DELETE", "/api/v1/sessions/other", testAdminKey, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		expectStatus(t, serve(c, tt.method, tt.target, tt.key, `{"session_id":"own"}`), tt.want, tt.name)
+	}
+}
+
+func TestAuthorizeReads(t *testing.T) {
+	c, _, _, read := newAuthCollector(t)
+
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/other", read, ""), http.StatusNotFound, "other application's session")
+	expectStatus(t, serve(c, "GET", "/api/v1/profiles/other", read, ""), http.StatusNotFound, "other application's profiles")
+	expectStatus(t, serve(c, "GET", "/api/v1/metrics/other", read, ""), http.StatusNotFound, "other application's metrics")
+	expectStatus(t, serve(c, "GET", "/api/v1/apps/b/profiles", read, ""), http.StatusForbidden, "other application")
+	expectStatus(t, serve(c, "GET", "/api/v1/compare?base=own&target=other", read, ""), http.StatusNotFound, "compare with other session")
+	expectStatus(t, serve(c, "GET", "/api/v1/compare?app=b&base_labels=v=1&target_labels=v=2", read, ""), http.StatusForbidden, "compare other application")
+
+	rec := serve(c, "GET", "/api/v1/sessions", read, "")
+	expectStatus(t, rec, http.StatusOK, "list sessions")
+	var sessions []types.ProfileSession
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("decode sessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "own" {
+		t.Errorf("list sessions = %+v, want only own", sessions)
+	}
+}
+
+func TestAuthorizeWrites(t *testing.T) {
+	c, store, ingest, _ := newAuthCollector(t)
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		want   int
+	}{
+		{"create own session", "/api/v1/sessions", `{"id":"new","application_id":"a"}`, http.StatusCreated},
+		{"create other application's session", "/api/v1/sessions", `{"id":"new2","application_id":"b"}`, http.StatusForbidden},
+		{"take over other session", "/api/v1/sessions", `{"id":"other","application_id":"a"}`, http.StatusForbidden},
+		{"move own session", "/api/v1/sessions", `{"id":"own","application_id":"b"}`, http.StatusForbidden},
+		{"profile for own session", "/api/v1/profiles", `{"session_id":"own","type":"cpu","data":"YQ=="}`, http.StatusCreated},
+		{"profile for other session", "/api/v1/profiles", `{"session_id":"other","type":"cpu","data":"YQ=="}`, http.StatusForbidden},
+		{"profile for missing session", "/api/v1/profiles", `{"session_id":"orphan","type":"cpu","data":"YQ=="}`, http.StatusNotFound},
+		{"metrics for own session", "/api/v1/metrics", `{"session_id":"own"}`, http.StatusCreated},
+		{"metrics for other session", "/api/v1/metrics", `{"session_id":"other"}`, http.StatusForbidden},
+		{"metrics for missing session", "/api/v1/metrics", `{"session_id":"orphan"}`, http.StatusNotFound},
+		{"folded for other session", "/api/v1/profiles/folded?session_id=other", "main;work 1\n", http.StatusForbidden},
+		{"folded for missing session", "/api/v1/profiles/folded?session_id=orphan", "main;work 1\n", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		expectStatus(t, serve(c, "POST", tt.target, ingest, tt.body), tt.want, tt.name)
+	}
+
+	// Rejected writes leave nothing behind for another application to claim
+	if profiles, _ := store.ListProfiles("orphan"); len(profiles) != 0 {
+		t.Errorf("orphan session has %d profiles", len(profiles))
+	}
+	if metrics, _ := store.GetMetrics("orphan"); len(metrics) != 0 {
+		t.Errorf("orphan session has %d metrics snapshots", len(metrics))
+	}
+	if profiles, _ := store.ListProfiles("other"); len(profiles) != 0 {
+		t.Errorf("other session has %d profiles", len(profiles))
+	}
+	if session, err := store.GetSession("other"); err != nil || session.ApplicationID != "b" {
+		t.Errorf("other session = %+v, %v", session, err)
+	}
+}
+
+func TestKeyManagement(t *testing.T) {
+	c, _, _, _ := newAuthCollector(t)
+
+	expectStatus(t, serve(c, "POST", "/api/v1/admin/keys", testAdminKey, `{"scopes":["admin"],"applications":["a"]}`),
+		http.StatusBadRequest, "admin key for one application")
+	expectStatus(t, serve(c, "POST", "/api/v1/admin/keys", testAdminKey, `{"scopes":["write"],"applications":["a"]}`),
+		http.StatusBadRequest, "unknown scope")
+
+	rec := serve(c, "POST", "/api/v1/admin/keys", testAdminKey, `{"name":"b reader","scopes":["read"],"applications":["b"]}`)
+	expectStatus(t, rec, http.StatusCreated, "create key")
+	var created createdKey
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode key: %v", err)
+	}
+
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/other", created.APIKey, ""), http.StatusOK, "new key")
+	expectStatus(t, serve(c, "DELETE", "/api/v1/admin/keys/"+created.ID, testAdminKey, ""), http.StatusNoContent, "delete key")
+	expectStatus(t, serve(c, "DELETE", "/api/v1/admin/keys/"+created.ID, testAdminKey, ""), http.StatusNotFound, "delete key twice")
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/other", created.APIKey, ""), http.StatusUnauthorized, "deleted key")
+}
+
+func TestAuthDisabled(t *testing.T) {
+	c, _ := newTestCollector(t)
+
+	expectStatus(t, serve(c, "POST", "/api/v1/sessions", "", `{"id":"s","application_id":"a"}`), http.StatusCreated, "create session")
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/s", "", ""), http.StatusOK, "get session")
+	expectStatus(t, serve(c, "GET", "/api/v1/admin/keys", "", ""), http.StatusNotFound, "key management")
+}
@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/library"
+	"github.com/gorilla/mux"
+)
+
+// handleSampleLabels lists the sample label keys, such as those set with
+// pprof.Do, found in a session's profile
+func (c *Collector) handleSampleLabels(w http.ResponseWriter, r *http.Request) {
+	p, ok := c.loadSessionProfile(w, r)
+	if !ok {
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, collection.SampleLabelKeys(p))
+}
+
+// handleLabelBreakdown aggregates a session's profile by the values of the
+// {key} sample label and attaches a flame graph to each value. Query
+// parameters: type, sample_index, from/to, n (maximum number of values),
+// flamegraph (false to leave the flame graphs out) and the flame graph
+// options.
+func (c *Collector) handleLabelBreakdown(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := mux.Vars(r)["key"]
+
+	limit := 0
+	if v := query.Get("n"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			c.respondError(w, http.StatusBadRequest, "Invalid n")
+			return
+		}
+	}
+
+	withFlameGraphs := true
+	if v := query.Get("flamegraph"); v != "" {
+		var err error
+		if withFlameGraphs, err = strconv.ParseBool(v); err != nil {
+			c.respondError(w, http.StatusBadRequest, "Invalid flamegraph")
+			return
+		}
+	}
+
+	p, ok := c.loadSessionProfile(w, r)
+	if !ok {
+		return
+	}
+
+	index, ok := c.sampleIndex(w, r, p)
+	if !ok {
+		return
+	}
+
+	breakdown, err := collection.BreakdownByLabel(p, key, index)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if limit > 0 && len(breakdown.Values) > limit {
+		breakdown.Values = breakdown.Values[:limit]
+	}
+
+	if withFlameGraphs {
+		opts, err := flameGraphOptions(r, index)
+		if err != nil {
+			c.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts.LabelKey = key
+
+		for _, v := range breakdown.Values {
+			opts.LabelValue = v.Value
+			if v.FlameGraph, err = library.BuildFlameGraph(p, opts); err != nil {
+				c.respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+	}
+
+	c.respondJSON(w, http.StatusOK, breakdown)
+}
@@ -2,21 +2,30 @@ package collector
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/auth"
+	"github.com/King-kin5/analysis/pkg/retention"
 	"github.com/King-kin5/analysis/pkg/storage"
 	"github.com/King-kin5/analysis/pkg/types"
 	"go.uber.org/zap"
 )
 // Collector receives and processes profiling data
 type Collector struct {
-	storage storage.Storage
-	logger  *zap.Logger
-	server  *http.Server
-	router  *mux.Router
+	storage  storage.Storage
+	analyzer *collection.Analyzer
+	logger   *zap.Logger
+	server   *http.Server
+	router   *mux.Router
+	janitor  *retention.Janitor
+	keys     *auth.KeyStore
 	
 	sessions map[string]*types.ProfileSession
 	mu       sync.RWMutex
@@ -29,6 +38,7 @@ func NewCollector(store storage.Storage, logger *zap.Logger) *Collector {
 
 	c := &Collector{
 		storage:  store,
+		analyzer: collection.NewAnalyzer(store),
 		logger:   logger,
 		sessions: make(map[string]*types.ProfileSession),
 	}
@@ -37,21 +47,45 @@ func NewCollector(store storage.Storage, logger *zap.Logger) *Collector {
 	return c
 }
 func (c *Collector) setupRouter() {
-	c.router = mux.NewRouter()
+	c.router = mux.NewRouter().UseEncodedPath()
 
 	// API routes
 	api := c.router.PathPrefix("/api/v1").Subrouter()
+	api.Use(c.authenticate, c.validateIDVars, c.authorizeVars)
 	api.HandleFunc("/sessions", c.handleCreateSession).Methods("POST")
 	api.HandleFunc("/sessions", c.handleListSessions).Methods("GET")
 	api.HandleFunc("/sessions/{id}", c.handleGetSession).Methods("GET")
 	api.HandleFunc("/sessions/{id}", c.handleDeleteSession).Methods("DELETE")
+	api.HandleFunc("/sessions/{id}/callgraph", c.handleCallGraph).Methods("GET")
+	api.HandleFunc("/sessions/{id}/flamegraph", c.handleFlameGraph).Methods("GET")
+	api.HandleFunc("/sessions/{id}/folded", c.handleExportFolded).Methods("GET")
+	api.HandleFunc("/sessions/{id}/goroutines", c.handleGoroutines).Methods("GET")
+	api.HandleFunc("/sessions/{id}/labels", c.handleSampleLabels).Methods("GET")
+	api.HandleFunc("/sessions/{id}/labels/{key}", c.handleLabelBreakdown).Methods("GET")
+	api.HandleFunc("/sessions/{id}/profile", c.handleDownloadProfile).Methods("GET")
+	api.HandleFunc("/sessions/{id}/top", c.handleTop).Methods("GET")
+	api.HandleFunc("/sessions/{id}/trace", c.handleDownloadTrace).Methods("GET")
+	api.HandleFunc("/sessions/{id}/trace/summary", c.handleTraceSummary).Methods("GET")
 	
 	api.HandleFunc("/profiles", c.handleProfileData).Methods("POST")
+	api.HandleFunc("/profiles/folded", c.handleImportFolded).Methods("POST")
 	api.HandleFunc("/profiles/{session_id}", c.handleGetProfiles).Methods("GET")
+	api.HandleFunc("/profiles/{session_id}/{profile_id}", c.handleGetProfile).Methods("GET")
 	
+	api.HandleFunc("/apps/{application_id}/profiles", c.handleApplicationProfiles).Methods("GET")
+
+	api.HandleFunc("/compare", c.handleCompare).Methods("GET")
+
 	api.HandleFunc("/metrics", c.handleMetrics).Methods("POST")
 	api.HandleFunc("/metrics/{session_id}", c.handleGetMetrics).Methods("GET")
 
+	api.HandleFunc("/admin/retention", c.handleRetentionStatus).Methods("GET")
+	api.HandleFunc("/admin/retention/dry-run", c.handleRetentionDryRun).Methods("GET")
+	api.HandleFunc("/admin/retention/run", c.handleRetentionRun).Methods("POST")
+	api.HandleFunc("/admin/keys", c.handleListKeys).Methods("GET")
+	api.HandleFunc("/admin/keys", c.handleCreateKey).Methods("POST")
+	api.HandleFunc("/admin/keys/{key_id}", c.handleDeleteKey).Methods("DELETE")
+
 	// Health check
 	c.router.HandleFunc("/health", c.handleHealth).Methods("GET")
 }
@@ -73,7 +107,9 @@ func (c *Collector) Start(ctx context.Context, addr string) error {
 
 	c.logger.Info("Starting collector server", zap.String("addr", addr))
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
@@ -84,6 +120,8 @@ func (c *Collector) Start(ctx context.Context, addr string) error {
 		return err
 	}
 
+	// Wait for in-flight requests to drain before returning
+	<-shutdownDone
 	return nil
 }
 func (c *Collector) handleCreateSession(w http.ResponseWriter, r *http.Request) {
@@ -93,6 +131,27 @@ func (c *Collector) handleCreateSession(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if err := session.Labels.Validate(); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if session.ApplicationID == "" {
+		c.respondError(w, http.StatusBadRequest, "application_id is required")
+		return
+	}
+
+	if session.ID == "" {
+		session.ID = types.NewSessionID(session.ApplicationID)
+	} else if err := validateID("id", session.ID); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !c.authorizeWrite(w, r, session.ID, session.ApplicationID) {
+		return
+	}
+
 	c.mu.Lock()
 	c.sessions[session.ID] = &session
 	c.mu.Unlock()
@@ -109,9 +168,32 @@ func (c *Collector) handleCreateSession(w http.ResponseWriter, r *http.Request)
 
 	c.respondJSON(w, http.StatusCreated, session)
 }
+// handleListSessions lists sessions. Query parameters: application_id,
+// labels, from/to (RFC 3339 bounds on the start time), mode, language,
+// profile_type, sort (start_time or duration, newest first by default),
+// order, limit, cursor and fields.
 func (c *Collector) handleListSessions(w http.ResponseWriter, r *http.Request) {
-	appID := r.URL.Query().Get("application_id")
+	query := r.URL.Query()
+	appID := query.Get("application_id")
 	
+	labels, err := labelSelector(r, "labels")
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, to, err := timeRange(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params, err := parseListParams(r, []string{"start_time", "duration"}, true)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	sessions, err := c.storage.ListSessions(appID)
 	if err != nil {
 		c.logger.Error("Failed to list sessions", zap.Error(err))
@@ -119,7 +201,38 @@ func (c *Collector) handleListSessions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c.respondJSON(w, http.StatusOK, sessions)
+	mode := types.ProfileMode(query.Get("mode"))
+	language := query.Get("language")
+	profileType := types.ProfileType(query.Get("profile_type"))
+
+	matching := make([]*types.ProfileSession, 0, len(sessions))
+	for _, session := range sessions {
+		if !authorizedFor(r, session.ApplicationID) {
+			continue
+		}
+		if len(labels) > 0 && !session.Labels.Matches(labels) {
+			continue
+		}
+		if !from.IsZero() && session.StartTime.Before(from) {
+			continue
+		}
+		if !to.IsZero() && session.StartTime.After(to) {
+			continue
+		}
+		if (mode != "" && session.Mode != mode) || (language != "" && session.Language != language) ||
+			(profileType != "" && session.ProfileType != profileType) {
+			continue
+		}
+		matching = append(matching, session)
+	}
+
+	key := func(s *types.ProfileSession) int64 { return s.StartTime.UnixNano() }
+	if params.sort == "duration" {
+		key = func(s *types.ProfileSession) int64 { return int64(s.Duration) }
+	}
+	page, next := paginate(matching, params, key, func(s *types.ProfileSession) string { return s.ID })
+
+	c.respondList(w, params, page, next)
 }
 func (c *Collector) handleGetSession(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -150,12 +263,32 @@ func (c *Collector) handleDeleteSession(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 func (c *Collector) handleProfileData(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data", "application/octet-stream":
+		c.handleProfileUpload(w, r, mediaType)
+		return
+	}
+
 	var profileData types.ProfileData
 	if err := json.NewDecoder(r.Body).Decode(&profileData); err != nil {
 		c.respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
+	if err := profileData.Labels.Validate(); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := validateID("session_id", profileData.SessionID); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !c.authorizeWrite(w, r, profileData.SessionID, "") {
+		return
+	}
+
 	if err := c.storage.SaveProfileData(&profileData); err != nil {
 		c.logger.Error("Failed to save profile data", zap.Error(err))
 		c.respondError(w, http.StatusInternalServerError, "Failed to save profile data")
@@ -167,20 +300,125 @@ func (c *Collector) handleProfileData(w http.ResponseWriter, r *http.Request) {
 		zap.String("type", string(profileData.Type)),
 		zap.Int("size", len(profileData.Data)))
 
-	c.respondJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
+	c.respondJSON(w, http.StatusCreated, map[string]string{"status": "ok", "id": profileData.ID})
 }
+// handleGetProfiles lists a session's profiles. Query parameters: type,
+// from/to, include_data (false leaves out the payloads), sort (timestamp or
+// size, oldest first by default), order, limit (100 by default), cursor and
+// fields. The listing is paged on metadata and only the payloads of the
+// returned page are read.
 func (c *Collector) handleGetProfiles(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["session_id"]
+	query := r.URL.Query()
+
+	from, to, err := timeRange(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params, includeData, err := parseProfileListParams(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	profiles, err := c.storage.GetProfileData(sessionID)
+	profiles, err := c.storage.ListProfiles(sessionID)
 	if err != nil {
 		c.logger.Error("Failed to get profile data", zap.Error(err))
 		c.respondError(w, http.StatusInternalServerError, "Failed to get profile data")
 		return
 	}
 
-	c.respondJSON(w, http.StatusOK, profiles)
+	profileType := types.ProfileType(query.Get("type"))
+	matching := make([]*types.ProfileData, 0, len(profiles))
+	for _, p := range profiles {
+		if profileType != "" && p.Type != profileType {
+			continue
+		}
+		if (!from.IsZero() && p.Timestamp.Before(from)) || (!to.IsZero() && p.Timestamp.After(to)) {
+			continue
+		}
+		matching = append(matching, p)
+	}
+
+	page, next := paginateProfiles(matching, params)
+	if includeData {
+		if page, err = c.loadPayloads(page); err != nil {
+			c.logger.Error("Failed to get profile data", zap.Error(err))
+			c.respondError(w, http.StatusInternalServerError, "Failed to get profile data")
+			return
+		}
+	}
+	c.respondList(w, params, page, next)
+}
+
+// parseProfileListParams reads the list parameters of a profile listing and
+// whether its payloads are returned. Payloads can be large, so profile
+// listings are paged even without a limit.
+func parseProfileListParams(r *http.Request) (listParams, bool, error) {
+	params, err := parseListParams(r, []string{"timestamp", "size"}, false)
+	if err != nil {
+		return params, false, err
+	}
+	if params.limit == 0 {
+		params.limit = defaultProfilePageSize
+	}
+
+	includeData := params.hasField("data")
+	if v := r.URL.Query().Get("include_data"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return params, false, errors.New("Invalid include_data")
+		}
+		includeData = includeData && include
+	}
+	return params, includeData, nil
+}
+
+// paginateProfiles returns a page of profiles sorted by timestamp or size.
+// Ties are broken by session and profile ID, since profiles of different
+// sessions may share an ID.
+func paginateProfiles(profiles []*types.ProfileData, params listParams) ([]*types.ProfileData, string) {
+	key := func(p *types.ProfileData) int64 { return p.Timestamp.UnixNano() }
+	if params.sort == "size" {
+		key = func(p *types.ProfileData) int64 { return int64(p.Size) }
+	}
+	return paginate(profiles, params, key, func(p *types.ProfileData) string { return p.SessionID + "/" + p.ID })
+}
+
+// loadPayloads reads the full records, payloads included, of a page of listed
+// profiles. Profiles deleted since they were listed are left out.
+func (c *Collector) loadPayloads(page []*types.ProfileData) ([]*types.ProfileData, error) {
+	loaded := make([]*types.ProfileData, 0, len(page))
+	for _, p := range page {
+		full, err := c.storage.GetProfile(p.SessionID, p.ID)
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, full)
+	}
+	return loaded, nil
+}
+func (c *Collector) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	profile, err := c.storage.GetProfile(vars["session_id"], vars["profile_id"])
+	if err != nil {
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			c.respondError(w, http.StatusNotFound, "Profile not found")
+			return
+		}
+		c.logger.Error("Failed to get profile data", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to get profile data")
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, profile)
 }
 func (c *Collector) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
@@ -193,6 +431,14 @@ func (c *Collector) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateID("session_id", payload.SessionID); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !c.authorizeWrite(w, r, payload.SessionID, "") {
+		return
+	}
+
 	if err := c.storage.SaveMetrics(payload.SessionID, &payload.Metrics); err != nil {
 		c.logger.Error("Failed to save metrics", zap.Error(err))
 		c.respondError(w, http.StatusInternalServerError, "Failed to save metrics")
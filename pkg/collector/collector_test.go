@@ -0,0 +1,59 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// newTestCollector returns a collector over a file storage in a temporary
+// directory
+func newTestCollector(t *testing.T) (*Collector, storage.Storage) {
+	t.Helper()
+
+	store, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	return NewCollector(store, zap.NewNop()), store
+}
+
+// newRequest returns a request with a JSON body
+func newRequest(method, target string) *http.Request {
+	return newRequestBody(method, target, "")
+}
+
+func newRequestBody(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// serveRequest sends a request through the collector's router
+func serveRequest(c *Collector, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c.GetRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+// serve sends a request with a JSON body through the collector's router,
+// authenticated with key when it is not empty
+func serve(c *Collector, method, target, key, body string) *httptest.ResponseRecorder {
+	req := newRequestBody(method, target, body)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return serveRequest(c, req)
+}
+
+// expectStatus fails the test when a response has an unexpected status
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int, what string) {
+	t.Helper()
+	if rec.Code != want {
+		t.Errorf("%s: status %d, want %d (%s)", what, rec.Code, want, strings.TrimSpace(rec.Body.String()))
+	}
+}
@@ -0,0 +1,206 @@
+package collector
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/library"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+	"go.uber.org/zap"
+)
+
+// comparisonResponse is a session comparison with its differential flame graph
+type comparisonResponse struct {
+	*collection.Comparison
+	FlameGraph *types.FlameGraphFrame `json:"flame_graph"`
+}
+
+// handleCompare compares two merged profiles, selected either by the base
+// and target session IDs or, with app set, by the base_labels and
+// target_labels selectors (e.g. version=1.4.2 and version=1.4.3) over the
+// application's profiles in the optional from/to range. Other query
+// parameters: type, sample_index, normalize (total, duration or none), n
+// (maximum number of functions) and the flame graph options.
+func (c *Collector) handleCompare(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	appID := query.Get("app")
+	baseID, targetID := query.Get("base"), query.Get("target")
+	if appID == "" && (baseID == "" || targetID == "") {
+		c.respondError(w, http.StatusBadRequest, "base and target, or app with base_labels and target_labels, are required")
+		return
+	}
+	for name, id := range map[string]string{"base": baseID, "target": targetID} {
+		if id == "" {
+			continue
+		}
+		if err := validateID(name, id); err != nil {
+			c.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !c.authorizedSession(r, id) {
+			c.respondError(w, http.StatusNotFound, "Session not found")
+			return
+		}
+	}
+	if appID != "" && !authorizedFor(r, appID) {
+		c.respondError(w, http.StatusForbidden, "API key is not valid for application "+appID)
+		return
+	}
+
+	profileType := types.ProfileType(query.Get("type"))
+	if profileType == "" {
+		profileType = types.ProfileTypeCPU
+	}
+
+	mode, err := collection.ParseNormalization(query.Get("normalize"))
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := 0
+	if v := query.Get("n"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			c.respondError(w, http.StatusBadRequest, "Invalid n")
+			return
+		}
+	}
+
+	var (
+		base, target *collection.Profile
+		ok           bool
+	)
+	if appID != "" {
+		base, target, ok = c.loadComparedLabels(w, r, appID, profileType)
+	} else {
+		base, ok = c.loadComparedProfile(w, baseID, profileType)
+		if ok {
+			target, ok = c.loadComparedProfile(w, targetID, profileType)
+		}
+	}
+	if !ok {
+		return
+	}
+
+	baseIndex, ok := c.sampleIndex(w, r, base)
+	if !ok {
+		return
+	}
+	targetIndex, err := target.SampleIndex(base.SampleType[baseIndex].Type)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, "Target profile has no "+base.SampleType[baseIndex].Type+" samples")
+		return
+	}
+
+	scale, err := collection.TargetScale(base, target, baseIndex, targetIndex, mode)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	comparison, err := collection.Compare(base, target, baseIndex, targetIndex, scale)
+	if err != nil {
+		c.logger.Error("Failed to compare profiles", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to compare profiles")
+		return
+	}
+	comparison.Normalization = mode
+	if limit > 0 && len(comparison.Functions) > limit {
+		comparison.Functions = comparison.Functions[:limit]
+	}
+
+	opts, err := flameGraphOptions(r, baseIndex)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	flameGraph, err := library.BuildDiffFlameGraph(base, target, opts, targetIndex, scale)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.respondJSON(w, http.StatusOK, comparisonResponse{
+		Comparison: comparison,
+		FlameGraph: flameGraph,
+	})
+}
+
+func (c *Collector) loadComparedProfile(w http.ResponseWriter, sessionID string, profileType types.ProfileType) (*collection.Profile, bool) {
+	p, err := c.analyzer.SessionProfile(sessionID, profileType, time.Time{}, time.Time{})
+	if err != nil {
+		switch {
+		case errors.Is(err, collection.ErrNoProfiles):
+			c.respondError(w, http.StatusNotFound, "No profiles found for session "+sessionID)
+		case errors.Is(err, collection.ErrIncompatibleProfiles):
+			c.respondError(w, http.StatusBadRequest, err.Error())
+		default:
+			c.logger.Error("Failed to load profile", zap.Error(err))
+			c.respondError(w, http.StatusInternalServerError, "Failed to load profile")
+		}
+		return nil, false
+	}
+
+	// Fall back to the session's duration for profiles that carry none, such
+	// as imported folded stacks
+	if p.DurationNanos == 0 {
+		if session, err := c.storage.GetSession(sessionID); err == nil && session.Duration > 0 {
+			p.DurationNanos = session.Duration.Nanoseconds()
+		}
+	}
+
+	return p, true
+}
+
+// loadComparedLabels merges the application's profiles matching the
+// base_labels and target_labels selectors
+func (c *Collector) loadComparedLabels(w http.ResponseWriter, r *http.Request, appID string, profileType types.ProfileType) (base, target *collection.Profile, ok bool) {
+	from, to, err := timeRange(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+
+	profiles := make([]*collection.Profile, 2)
+	for i, name := range []string{"base_labels", "target_labels"} {
+		labels, err := labelSelector(r, name)
+		if err != nil {
+			c.respondError(w, http.StatusBadRequest, err.Error())
+			return nil, nil, false
+		}
+		if len(labels) == 0 {
+			c.respondError(w, http.StatusBadRequest, name+" is required")
+			return nil, nil, false
+		}
+
+		p, err := c.analyzer.ApplicationProfile(storage.ProfileQuery{
+			ApplicationID: appID,
+			Type:          profileType,
+			From:          from,
+			To:            to,
+			Labels:        labels,
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, collection.ErrNoProfiles):
+				c.respondError(w, http.StatusNotFound, "No profiles found for "+labels.String())
+			case errors.Is(err, collection.ErrIncompatibleProfiles):
+				c.respondError(w, http.StatusBadRequest, err.Error())
+			default:
+				c.logger.Error("Failed to load profile", zap.Error(err))
+				c.respondError(w, http.StatusInternalServerError, "Failed to load profile")
+			}
+			return nil, nil, false
+		}
+		profiles[i] = p
+	}
+
+	return profiles[0], profiles[1], true
+}
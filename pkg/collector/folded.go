@@ -0,0 +1,163 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/library"
+	"github.com/King-kin5/analysis/pkg/types"
+	"go.uber.org/zap"
+)
+
+// handleImportFolded stores a folded stacks text body as an ordinary pprof
+// profile record. Query parameters: session_id (required), application_id
+// (required when the session does not exist yet), type, timestamp (RFC 3339),
+// period (sampling interval, e.g. "10ms"), sample_type, unit and labels.
+// The body is limited to maxUploadSize like other uploads.
+func (c *Collector) handleImportFolded(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	query := r.URL.Query()
+
+	sessionID := query.Get("session_id")
+	if sessionID == "" {
+		c.respondError(w, http.StatusBadRequest, "session_id is required")
+		return
+	}
+	if err := validateID("session_id", sessionID); err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	applicationID := query.Get("application_id")
+	if !c.authorizeWrite(w, r, sessionID, applicationID) {
+		return
+	}
+
+	profileType := types.ProfileType(query.Get("type"))
+	if profileType == "" {
+		profileType = types.ProfileTypeCPU
+	}
+	if !profileType.Valid() {
+		c.respondError(w, http.StatusBadRequest, "unknown type: "+string(profileType))
+		return
+	}
+
+	timestamp := time.Now()
+	if v := query.Get("timestamp"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.respondError(w, http.StatusBadRequest, "Invalid timestamp")
+			return
+		}
+		timestamp = t
+	}
+
+	labels, err := labelSelector(r, "labels")
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	opts := library.FoldedOptions{
+		SampleType: query.Get("sample_type"),
+		Unit:       query.Get("unit"),
+	}
+	if v := query.Get("period"); v != "" {
+		period, err := time.ParseDuration(v)
+		if err != nil || period < 0 {
+			c.respondError(w, http.StatusBadRequest, "Invalid period")
+			return
+		}
+		opts.Period = period
+	}
+
+	p, err := library.ParseFolded(r.Body, opts)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Body exceeds %d bytes", maxUploadSize))
+			return
+		}
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.TimeNanos = timestamp.UnixNano()
+
+	data, err := collection.Encode(p)
+	if err != nil {
+		c.logger.Error("Failed to encode folded profile", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to encode profile")
+		return
+	}
+
+	params := uploadParams{
+		SessionID:     sessionID,
+		ApplicationID: applicationID,
+		Type:          profileType,
+		Timestamp:     timestamp,
+		Labels:        labels,
+	}
+	if !c.ensureSession(w, params) {
+		return
+	}
+
+	var sampleCount int64
+	for _, s := range p.Sample {
+		sampleCount += s.Value[0]
+	}
+
+	profileData := types.ProfileData{
+		SessionID:   sessionID,
+		Type:        profileType,
+		Timestamp:   timestamp,
+		Data:        data,
+		SampleRate:  sampleRate(opts.Period),
+		SampleCount: sampleCount,
+		Labels:      labels,
+		Metadata: map[string]interface{}{
+			"source_format": "folded",
+		},
+	}
+
+	if err := c.storage.SaveProfileData(&profileData); err != nil {
+		c.logger.Error("Failed to save profile data", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to save profile data")
+		return
+	}
+
+	c.logger.Debug("Folded profile imported",
+		zap.String("session_id", sessionID),
+		zap.String("type", string(profileType)),
+		zap.Int("stacks", len(p.Sample)))
+
+	c.respondJSON(w, http.StatusCreated, map[string]string{"status": "ok", "id": profileData.ID})
+}
+
+// handleExportFolded writes a session's profile in the folded stacks format
+func (c *Collector) handleExportFolded(w http.ResponseWriter, r *http.Request) {
+	p, ok := c.loadSessionProfile(w, r)
+	if !ok {
+		return
+	}
+
+	index, ok := c.sampleIndex(w, r, p)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := library.WriteFolded(w, p, index); err != nil {
+		c.logger.Error("Failed to write folded stacks", zap.Error(err))
+	}
+}
+
+// sampleRate converts a sampling interval to a rate in Hz
+func sampleRate(period time.Duration) int {
+	if period <= 0 {
+		return 0
+	}
+	return int(time.Second / period)
+}
@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+func TestImportFoldedCreatesSession(t *testing.T) {
+	c, store := newTestCollector(t)
+	const stacks = "main;work 3\nmain;idle 1\n"
+
+	expectStatus(t, serve(c, "POST", "/api/v1/profiles/folded?session_id=imported", "", stacks),
+		http.StatusBadRequest, "new session without application_id")
+	expectStatus(t, serve(c, "POST", "/api/v1/profiles/folded?session_id=imported&application_id=app&type=bogus", "", stacks),
+		http.StatusBadRequest, "unknown type")
+	if profiles, _ := store.ListProfiles("imported"); len(profiles) != 0 {
+		t.Fatalf("rejected imports stored %d profiles", len(profiles))
+	}
+
+	expectStatus(t, serve(c, "POST", "/api/v1/profiles/folded?session_id=imported&application_id=app", "", stacks),
+		http.StatusCreated, "new session")
+	expectStatus(t, serve(c, "POST", "/api/v1/profiles/folded?session_id=imported", "", stacks),
+		http.StatusCreated, "existing session")
+
+	// The imported session is listed like any other
+	rec := serve(c, "GET", "/api/v1/sessions?application_id=app", "", "")
+	expectStatus(t, rec, http.StatusOK, "list sessions")
+	var sessions []types.ProfileSession
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("decode sessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "imported" {
+		t.Errorf("sessions = %+v, want the imported one", sessions)
+	}
+	if profiles, _ := store.ListProfiles("imported"); len(profiles) != 2 {
+		t.Errorf("session has %d profiles, want 2", len(profiles))
+	}
+}
+
+// commentReader returns a body of folded stack comment lines, which
+// the parser skips without keeping anything
+type commentReader struct{}
+
+func (commentReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '#'
+		if i%1024 == 1023 {
+			p[i] = '\n'
+		}
+	}
+	return len(p), nil
+}
+
+func TestImportFoldedBodyLimit(t *testing.T) {
+	c, _ := newTestCollector(t)
+
+	body := io.LimitReader(commentReader{}, maxUploadSize+1<<20)
+	req := httptest.NewRequest("POST", "/api/v1/profiles/folded?session_id=s&application_id=app", body)
+	expectStatus(t, serveRequest(c, req), http.StatusRequestEntityTooLarge, "oversized body")
+}
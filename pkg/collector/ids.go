@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/King-kin5/analysis/pkg/types"
+	"github.com/gorilla/mux"
+)
+
+// idVars are the route variables holding session and profile IDs
+var idVars = []string{"id", "session_id", "profile_id"}
+
+// validateIDVars rejects requests whose route names an invalid session or
+// profile ID before any handler sees it. The router matches escaped paths so
+// that an ID such as "..%2Fx" reaches this check as it was sent rather than
+// being decoded into extra path segments; the other route variables are
+// unescaped here.
+func (c *Collector) validateIDVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for name, value := range vars {
+			if !isIDVar(name) {
+				unescaped, err := url.PathUnescape(value)
+				if err != nil {
+					c.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", name, value))
+					return
+				}
+				vars[name] = unescaped
+				continue
+			}
+			if err := validateID(name, value); err != nil {
+				c.respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isIDVar(name string) bool {
+	for _, idVar := range idVars {
+		if name == idVar {
+			return true
+		}
+	}
+	return false
+}
+
+// validateID checks an ID read from the named request field
+func validateID(name, id string) error {
+	if err := types.ValidateID(id); err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
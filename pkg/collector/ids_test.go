@@ -0,0 +1,147 @@
+package collector
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/types"
+	"github.com/gorilla/mux"
+)
+
+// invalidPathIDs are IDs that must be rejected with 400 wherever a route
+// takes a session or profile ID
+var invalidPathIDs = []string{
+	"..%2Fx",
+	"..%2F..%2Fetc%2Fpasswd",
+	"%2e%2e",
+	"a%2Fb",
+	"a%5Cb",
+	".hidden",
+	"a%20b",
+	"a%00b",
+	strings.Repeat("a", types.MaxIDLength+1),
+}
+
+// idRoutes returns the method and path template of every route taking a
+// session or profile ID
+func idRoutes(t *testing.T, c *Collector) [][2]string {
+	t.Helper()
+
+	var routes [][2]string
+	err := c.GetRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, name := range idVars {
+			if strings.Contains(tpl, "{"+name+"}") {
+				for _, method := range methods {
+					routes = append(routes, [2]string{method, tpl})
+				}
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if len(routes) < 15 {
+		t.Fatalf("found %d routes taking IDs, want at least 15", len(routes))
+	}
+	return routes
+}
+
+// fillRoute substitutes value for the ID variables of a path template and
+// "k" for the others
+func fillRoute(tpl, value string) string {
+	path := tpl
+	for _, name := range idVars {
+		path = strings.ReplaceAll(path, "{"+name+"}", value)
+	}
+	for strings.Contains(path, "{") {
+		start := strings.Index(path, "{")
+		end := strings.Index(path[start:], "}")
+		path = path[:start] + "k" + path[start+end+1:]
+	}
+	return path
+}
+
+func TestInvalidPathIDs(t *testing.T) {
+	c, store := newTestCollector(t)
+	if err := store.SaveSession(&types.ProfileSession{ID: "s", ApplicationID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range idRoutes(t, c) {
+		method, tpl := route[0], route[1]
+		for _, id := range invalidPathIDs {
+			target := fillRoute(tpl, id)
+			expectStatus(t, serve(c, method, target, "", "{}"), http.StatusBadRequest, method+" "+target)
+		}
+
+		// Unescaped traversal never reaches a handler: the router redirects
+		// to the cleaned path, which names no session
+		target := fillRoute(tpl, "../x")
+		if rec := serve(c, method, target, "", "{}"); rec.Code < 300 || rec.Code == http.StatusInternalServerError {
+			t.Errorf("%s %s: status %d, want a redirect or client error", method, target, rec.Code)
+		}
+	}
+
+	if sessions, err := store.ListSessions(""); err != nil || len(sessions) != 1 {
+		t.Errorf("ListSessions = %d sessions, %v; want the original one", len(sessions), err)
+	}
+}
+
+func TestInvalidBodyIDs(t *testing.T) {
+	c, _ := newTestCollector(t)
+
+	long := strings.Repeat("a", types.MaxIDLength+1)
+	for _, id := range []string{"../x", "..\\x", "/tmp/x", "a/b", ".", "..", long} {
+		quoted := strings.ReplaceAll(id, "\\", "\\\\")
+		expectStatus(t, serve(c, "POST", "/api/v1/sessions", "", `{"id":"`+quoted+`","application_id":"app"}`),
+			http.StatusBadRequest, "create session "+id)
+		expectStatus(t, serve(c, "POST", "/api/v1/profiles", "", `{"session_id":"`+quoted+`","type":"cpu","data":"YQ=="}`),
+			http.StatusBadRequest, "profile "+id)
+		expectStatus(t, serve(c, "POST", "/api/v1/metrics", "", `{"session_id":"`+quoted+`"}`),
+			http.StatusBadRequest, "metrics "+id)
+
+		query := url.Values{"session_id": {id}, "application_id": {"app"}}.Encode()
+		expectStatus(t, serve(c, "POST", "/api/v1/profiles/folded?"+query, "", "main 1\n"),
+			http.StatusBadRequest, "folded "+id)
+
+		req := newRequestBody("POST", "/api/v1/profiles?"+query, "data")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		expectStatus(t, serveRequest(c, req), http.StatusBadRequest, "upload "+id)
+
+		compare := url.Values{"base": {id}, "target": {"s"}}.Encode()
+		expectStatus(t, serve(c, "GET", "/api/v1/compare?"+compare, "", ""), http.StatusBadRequest, "compare "+id)
+	}
+}
+
+func TestGeneratedSessionID(t *testing.T) {
+	c, store := newTestCollector(t)
+
+	rec := serve(c, "POST", "/api/v1/sessions", "", `{"application_id":"team/checkout v2"}`)
+	expectStatus(t, rec, http.StatusCreated, "create session without ID")
+
+	sessions, err := store.ListSessions("team/checkout v2")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("ListSessions = %d sessions, %v", len(sessions), err)
+	}
+	id := sessions[0].ID
+	if err := types.ValidateID(id); err != nil || !strings.HasPrefix(id, "team_checkout_v2_") {
+		t.Errorf("generated ID %q: %v", id, err)
+	}
+
+	// Application IDs are not session IDs and may be escaped in paths
+	expectStatus(t, serve(c, "GET", "/api/v1/apps/"+url.PathEscape("team/checkout v2")+"/profiles", "", ""),
+		http.StatusOK, "escaped application ID")
+	expectStatus(t, serve(c, "GET", "/api/v1/sessions/"+id, "", ""), http.StatusOK, "generated session")
+}
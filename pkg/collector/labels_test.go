@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+func TestLabelFilters(t *testing.T) {
+	c, _ := newTestCollector(t)
+
+	expectStatus(t, serve(c, "POST", "/api/v1/sessions", "", `{"id":"v1","application_id":"app","labels":{"version":"1.4.2","region":"eu"}}`), http.StatusCreated, "create v1")
+	expectStatus(t, serve(c, "POST", "/api/v1/sessions", "", `{"id":"v2","application_id":"app","labels":{"version":"1.4.3","region":"eu"}}`), http.StatusCreated, "create v2")
+	expectStatus(t, serve(c, "POST", "/api/v1/sessions", "", `{"id":"v3","application_id":"app","labels":{"bad key":"x"}}`), http.StatusBadRequest, "invalid session labels")
+
+	start := time.Now().UTC().Truncate(time.Second)
+	data := encodePprof(t, "cpu", 1)
+	uploads := []struct {
+		session string
+		labels  string
+		status  int
+	}{
+		{"v1", "", http.StatusCreated},
+		{"v2", "", http.StatusCreated},
+		// A profile's own labels override its session's
+		{"v2", "region=us,pod=p1", http.StatusCreated},
+		{"v2", "pod", http.StatusBadRequest},
+	}
+	for i, u := range uploads {
+		query := url.Values{"session_id": {u.session}, "timestamp": {start.Add(time.Duration(i) * time.Second).Format(time.RFC3339)}}
+		if u.labels != "" {
+			query.Set("labels", u.labels)
+		}
+		expectStatus(t, upload(c, "", query, data), u.status, "upload with labels "+u.labels)
+	}
+
+	profiles := []struct {
+		selector string
+		want     []string
+	}{
+		{"", []string{"v1", "v2", "v2 pod=p1,region=us"}},
+		{"region=eu", []string{"v1", "v2"}},
+		{"version=1.4.3", []string{"v2", "v2 pod=p1,region=us"}},
+		{"version=1.4.3,region=us", []string{"v2 pod=p1,region=us"}},
+		{"version=2.0.0", nil},
+	}
+	for _, tt := range profiles {
+		rec := serve(c, "GET", "/api/v1/apps/app/profiles?labels="+url.QueryEscape(tt.selector), "", "")
+		expectStatus(t, rec, http.StatusOK, "profiles matching "+tt.selector)
+
+		var page []types.ProfileData
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("profiles matching %s: %v", tt.selector, err)
+		}
+		var got []string
+		for _, p := range page {
+			if len(p.Labels) > 0 {
+				got = append(got, p.SessionID+" "+p.Labels.String())
+			} else {
+				got = append(got, p.SessionID)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profiles matching %q = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+
+	sessions := []struct {
+		selector string
+		want     []string
+	}{
+		{"region=eu", []string{"v1", "v2"}},
+		{"version=1.4.2", []string{"v1"}},
+		{"region=us", nil},
+	}
+	for _, tt := range sessions {
+		rec := serve(c, "GET", "/api/v1/sessions?application_id=app&labels="+url.QueryEscape(tt.selector), "", "")
+		expectStatus(t, rec, http.StatusOK, "sessions matching "+tt.selector)
+
+		var list []types.ProfileSession
+		if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+			t.Fatalf("sessions matching %s: %v", tt.selector, err)
+		}
+		var got []string
+		for _, s := range list {
+			got = append(got, s.ID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sessions matching %q = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+
+	for _, target := range []string{"/api/v1/sessions?labels=region", "/api/v1/apps/app/profiles?labels=1x=y"} {
+		expectStatus(t, serve(c, "GET", target, "", ""), http.StatusBadRequest, "invalid selector "+target)
+	}
+}
@@ -0,0 +1,198 @@
+package collector
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxPageSize bounds the limit parameter of list endpoints
+const maxPageSize = 1000
+
+// defaultProfilePageSize is the limit of profile listings without one
+const defaultProfilePageSize = 100
+
+// listParams are the sorting, pagination and field selection parameters
+// shared by list endpoints: sort, order (asc or desc), limit, cursor and
+// fields (a comma separated list of the JSON fields to return)
+type listParams struct {
+	sort   string
+	desc   bool
+	limit  int
+	after  *pageCursor
+	fields []string
+}
+
+// pageCursor marks the last item of a page: its sort key and ID, which
+// breaks ties between equal keys. It is only valid for the sort and order it
+// was issued for.
+type pageCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	Key  int64  `json:"k"`
+	ID   string `json:"id"`
+}
+
+func (pc pageCursor) encode() string {
+	data, _ := json.Marshal(pc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseListParams reads the list parameters of a request. sorts lists the
+// accepted sort keys, the first being the default.
+func parseListParams(r *http.Request, sorts []string, defaultDesc bool) (listParams, error) {
+	query := r.URL.Query()
+	params := listParams{sort: sorts[0], desc: defaultDesc}
+
+	if v := query.Get("sort"); v != "" {
+		valid := false
+		for _, s := range sorts {
+			valid = valid || s == v
+		}
+		if !valid {
+			return params, fmt.Errorf("invalid sort: %s (expected one of %s)", v, strings.Join(sorts, ", "))
+		}
+		params.sort = v
+	}
+
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		params.desc = false
+	case "desc":
+		params.desc = true
+	default:
+		return params, fmt.Errorf("invalid order: %s", query.Get("order"))
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return params, fmt.Errorf("invalid limit: %s (expected 1 to %d)", v, maxPageSize)
+		}
+		params.limit = limit
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		var pc pageCursor
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || json.Unmarshal(data, &pc) != nil {
+			return params, fmt.Errorf("invalid cursor")
+		}
+		if pc.Sort != params.sort {
+			return params, fmt.Errorf("cursor was issued for sort=%s", pc.Sort)
+		}
+		if pc.Desc != params.desc {
+			return params, fmt.Errorf("cursor was issued for order=%s", order(pc.Desc))
+		}
+		params.after = &pc
+	}
+
+	if v := query.Get("fields"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				params.fields = append(params.fields, field)
+			}
+		}
+	}
+
+	return params, nil
+}
+
+func order(desc bool) string {
+	if desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// hasField reports whether the response includes a field
+func (p listParams) hasField(name string) bool {
+	if len(p.fields) == 0 {
+		return true
+	}
+	for _, field := range p.fields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// paginate sorts items by key, then ID, and returns the page following the
+// cursor with the cursor of the next page, empty on the last page
+func paginate[T any](items []T, params listParams, key func(T) int64, id func(T) string) ([]T, string) {
+	less := func(a, b T) bool {
+		ka, kb := key(a), key(b)
+		if ka != kb {
+			return (ka < kb) != params.desc
+		}
+		ia, ib := id(a), id(b)
+		return ia != ib && (ia < ib) != params.desc
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	start := 0
+	if params.after != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			k, itemID := key(items[i]), id(items[i])
+			if k != params.after.Key {
+				return (k > params.after.Key) != params.desc
+			}
+			return itemID != params.after.ID && (itemID > params.after.ID) != params.desc
+		})
+	}
+	items = items[start:]
+
+	if params.limit == 0 || len(items) <= params.limit {
+		return items, ""
+	}
+
+	last := items[params.limit-1]
+	next := pageCursor{Sort: params.sort, Desc: params.desc, Key: key(last), ID: id(last)}
+	return items[:params.limit], next.encode()
+}
+
+// respondList writes a page of a list endpoint. The cursor of the next page,
+// if any, is returned in the X-Next-Cursor header so that the body stays a
+// plain array. With the fields parameter only the named fields of each item
+// are written.
+func (c *Collector) respondList(w http.ResponseWriter, params listParams, items interface{}, next string) {
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
+	if len(params.fields) == 0 {
+		c.respondJSON(w, http.StatusOK, items)
+		return
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		c.respondError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+
+	var full []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &full); err != nil {
+		c.respondError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+
+	selected := make([]map[string]json.RawMessage, len(full))
+	for i, item := range full {
+		selected[i] = make(map[string]json.RawMessage, len(params.fields))
+		for _, field := range params.fields {
+			if value, ok := item[field]; ok {
+				selected[i][field] = value
+			}
+		}
+	}
+	c.respondJSON(w, http.StatusOK, selected)
+}
@@ -0,0 +1,214 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// saveTiedProfiles stores in each session the same n profiles, all with the
+// same timestamp and size, so that every sort key ties and profiles of
+// different sessions share IDs
+func saveTiedProfiles(t *testing.T, store storage.Storage, sessions []string, n int) {
+	t.Helper()
+
+	at := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	for _, sessionID := range sessions {
+		if err := store.SaveSession(&types.ProfileSession{ID: sessionID, ApplicationID: "app"}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			err := store.SaveProfileData(&types.ProfileData{
+				SessionID: sessionID,
+				Type:      types.ProfileTypeCPU,
+				Timestamp: at,
+				Data:      []byte(fmt.Sprintf("p%d", i)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// walkPages follows the cursors of a profile listing and returns the
+// session and profile ID of every item in order
+func walkPages(t *testing.T, c *Collector, target string, limit int) []string {
+	t.Helper()
+
+	var items []string
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatalf("%s: cursors do not end", target)
+		}
+		query := url.Values{"limit": {fmt.Sprint(limit)}, "include_data": {"false"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		rec := serve(c, "GET", target+"&"+query.Encode(), "", "")
+		expectStatus(t, rec, http.StatusOK, target)
+
+		var profiles []types.ProfileData
+		if err := json.Unmarshal(rec.Body.Bytes(), &profiles); err != nil {
+			t.Fatalf("%s: decode page: %v", target, err)
+		}
+		cursor = rec.Header().Get("X-Next-Cursor")
+		if len(profiles) > limit || (cursor != "" && len(profiles) != limit) {
+			t.Fatalf("%s: page of %d profiles with limit %d", target, len(profiles), limit)
+		}
+		for _, p := range profiles {
+			items = append(items, p.SessionID+"/"+p.ID)
+		}
+		if cursor == "" {
+			return items
+		}
+	}
+}
+
+func TestCursorStabilityUnderTies(t *testing.T) {
+	c, store := newTestCollector(t)
+	saveTiedProfiles(t, store, []string{"s1", "s2"}, 5)
+
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/api/v1/apps/app/profiles?type=cpu", 10},
+		{"/api/v1/profiles/s1?type=cpu", 5},
+	} {
+		for _, order := range []string{"sort=timestamp&order=asc", "sort=timestamp&order=desc", "sort=size&order=asc", "sort=size&order=desc"} {
+			target := tt.target + "&" + order
+			all := walkPages(t, c, target, maxPageSize)
+			if len(all) != tt.want {
+				t.Fatalf("%s: %d profiles, want %d", target, len(all), tt.want)
+			}
+
+			seen := make(map[string]bool)
+			for _, item := range all {
+				if seen[item] {
+					t.Errorf("%s: %s listed twice", target, item)
+				}
+				seen[item] = true
+			}
+
+			for _, limit := range []int{1, 3, 4} {
+				if paged := walkPages(t, c, target, limit); !reflect.DeepEqual(paged, all) {
+					t.Errorf("%s limit %d:\n got %v\nwant %v", target, limit, paged, all)
+				}
+			}
+		}
+	}
+}
+
+func TestApplicationProfilesFields(t *testing.T) {
+	c, store := newTestCollector(t)
+	saveTiedProfiles(t, store, []string{"s1"}, 2)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"data", "id", "session_id", "size", "timestamp", "type"}},
+		{"include_data=false", []string{"id", "session_id", "size", "timestamp", "type"}},
+		{"fields=id,session_id", []string{"id", "session_id"}},
+		{"fields=id,data&include_data=false", []string{"id"}},
+	}
+	for _, tt := range tests {
+		rec := serve(c, "GET", "/api/v1/apps/app/profiles?"+tt.query, "", "")
+		expectStatus(t, rec, http.StatusOK, tt.query)
+
+		var profiles []map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &profiles); err != nil || len(profiles) != 2 {
+			t.Fatalf("%s: %d profiles, %v", tt.query, len(profiles), err)
+		}
+		for _, field := range []string{"data", "id", "session_id", "size", "timestamp", "type"} {
+			_, ok := profiles[0][field]
+			if want := slices.Contains(tt.want, field); ok != want {
+				t.Errorf("%s: field %s present %v, want %v", tt.query, field, ok, want)
+			}
+		}
+	}
+
+	for _, query := range []string{"limit=0", "cursor=bogus", "include_data=maybe", "sort=name"} {
+		expectStatus(t, serve(c, "GET", "/api/v1/apps/app/profiles?"+query, "", ""), http.StatusBadRequest, query)
+	}
+}
+
+// payloadCounter counts the profiles whose payloads are read
+type payloadCounter struct {
+	storage.Storage
+	payloads int
+}
+
+func (s *payloadCounter) GetProfileData(sessionID string) ([]*types.ProfileData, error) {
+	profiles, err := s.Storage.GetProfileData(sessionID)
+	s.payloads += len(profiles)
+	return profiles, err
+}
+
+func (s *payloadCounter) GetProfile(sessionID, profileID string) (*types.ProfileData, error) {
+	s.payloads++
+	return s.Storage.GetProfile(sessionID, profileID)
+}
+
+func (s *payloadCounter) QueryProfileData(query storage.ProfileQuery) ([]*types.ProfileData, error) {
+	profiles, err := s.Storage.QueryProfileData(query)
+	if !query.MetadataOnly {
+		s.payloads += len(profiles)
+	}
+	return profiles, err
+}
+
+func TestProfileListingsReadOnlyPagePayloads(t *testing.T) {
+	_, fs := newTestCollector(t)
+	store := &payloadCounter{Storage: fs}
+	c := NewCollector(store, zap.NewNop())
+	saveTiedProfiles(t, store, []string{"s1"}, defaultProfilePageSize+20)
+
+	for _, target := range []string{"/api/v1/profiles/s1", "/api/v1/apps/app/profiles"} {
+		store.payloads = 0
+		rec := serve(c, "GET", target, "", "")
+		expectStatus(t, rec, http.StatusOK, target)
+
+		var profiles []types.ProfileData
+		if err := json.Unmarshal(rec.Body.Bytes(), &profiles); err != nil {
+			t.Fatalf("%s: decode: %v", target, err)
+		}
+		if len(profiles) != defaultProfilePageSize || rec.Header().Get("X-Next-Cursor") == "" {
+			t.Errorf("%s: %d profiles without a limit, want a page of %d", target, len(profiles), defaultProfilePageSize)
+		}
+		for _, p := range profiles {
+			if len(p.Data) == 0 {
+				t.Errorf("%s: profile %s listed without its payload", target, p.ID)
+				break
+			}
+		}
+		if store.payloads != defaultProfilePageSize {
+			t.Errorf("%s: read %d payloads, want %d", target, store.payloads, defaultProfilePageSize)
+		}
+	}
+}
+
+func TestCursorOrderMismatch(t *testing.T) {
+	c, store := newTestCollector(t)
+	saveTiedProfiles(t, store, []string{"s1"}, 3)
+
+	rec := serve(c, "GET", "/api/v1/profiles/s1?order=desc&limit=1", "", "")
+	expectStatus(t, rec, http.StatusOK, "first page")
+	cursor := url.QueryEscape(rec.Header().Get("X-Next-Cursor"))
+
+	expectStatus(t, serve(c, "GET", "/api/v1/profiles/s1?order=desc&limit=1&cursor="+cursor, "", ""), http.StatusOK, "same order")
+	expectStatus(t, serve(c, "GET", "/api/v1/profiles/s1?order=asc&limit=1&cursor="+cursor, "", ""), http.StatusBadRequest, "other order")
+	expectStatus(t, serve(c, "GET", "/api/v1/profiles/s1?limit=1&cursor="+cursor, "", ""), http.StatusBadRequest, "default order")
+}
@@ -0,0 +1,248 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxUploadSize bounds the body of a raw or multipart profile upload
+	maxUploadSize = 256 << 20
+	// maxUploadMemory is the part of a multipart upload kept in memory
+	maxUploadMemory = 32 << 20
+)
+
+// uploadParams are the fields accompanying an uploaded pprof file or trace
+type uploadParams struct {
+	SessionID     string
+	ApplicationID string
+	Type          types.ProfileType
+	Timestamp     time.Time
+	SampleRate    int
+	Labels        types.Labels
+}
+
+// handleProfileUpload stores a pprof file or runtime execution trace sent
+// either as the "file" part of a multipart form or as a raw
+// application/octet-stream body. Fields are read
+// from form values or, for raw bodies, from the query string. The session is
+// created when it does not exist yet, which requires application_id.
+func (c *Collector) handleProfileUpload(w http.ResponseWriter, r *http.Request, mediaType string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+			c.respondError(w, http.StatusBadRequest, "Invalid multipart form")
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			c.respondError(w, http.StatusBadRequest, "file is required")
+			return
+		}
+		data, err = io.ReadAll(file)
+		file.Close()
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, "Failed to read profile data")
+		return
+	}
+
+	params, err := parseUploadParams(r)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !c.authorizeWrite(w, r, params.SessionID, params.ApplicationID) {
+		return
+	}
+
+	if params.Type == types.ProfileTypeTrace || params.Type == "" && collection.IsTrace(data) {
+		c.saveTraceUpload(w, params, data)
+		return
+	}
+
+	p, err := collection.Parse(data)
+	if err != nil {
+		c.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if params.Type == "" {
+		params.Type = collection.DetectProfileType(p)
+	}
+	if params.Type == "" {
+		params.Type = types.ProfileTypeCPU
+	}
+	if params.Timestamp.IsZero() {
+		params.Timestamp = time.Now()
+		if p.TimeNanos > 0 {
+			params.Timestamp = time.Unix(0, p.TimeNanos)
+		}
+	}
+
+	if !c.ensureSession(w, params) {
+		return
+	}
+
+	c.saveUpload(w, &types.ProfileData{
+		SessionID:   params.SessionID,
+		Type:        params.Type,
+		Timestamp:   params.Timestamp,
+		Data:        data,
+		SampleRate:  params.SampleRate,
+		SampleCount: int64(len(p.Sample)),
+		Labels:      params.Labels,
+	})
+}
+
+// saveTraceUpload stores an uploaded runtime execution trace. Traces are not
+// parsed on upload since they can be tens of MB; summaries are computed on
+// request.
+func (c *Collector) saveTraceUpload(w http.ResponseWriter, params uploadParams, data []byte) {
+	if !collection.IsTrace(data) {
+		c.respondError(w, http.StatusBadRequest, "Not a runtime execution trace")
+		return
+	}
+
+	params.Type = types.ProfileTypeTrace
+	if params.Timestamp.IsZero() {
+		params.Timestamp = time.Now()
+	}
+
+	if !c.ensureSession(w, params) {
+		return
+	}
+
+	c.saveUpload(w, &types.ProfileData{
+		SessionID:   params.SessionID,
+		Type:        params.Type,
+		Timestamp:   params.Timestamp,
+		Data:        data,
+		SampleCount: int64(len(data)),
+		Labels:      params.Labels,
+	})
+}
+
+func (c *Collector) saveUpload(w http.ResponseWriter, profileData *types.ProfileData) {
+	if err := c.storage.SaveProfileData(profileData); err != nil {
+		c.logger.Error("Failed to save profile data", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to save profile data")
+		return
+	}
+
+	c.logger.Debug("Profile uploaded",
+		zap.String("session_id", profileData.SessionID),
+		zap.String("type", string(profileData.Type)),
+		zap.Int("size", len(profileData.Data)))
+
+	c.respondJSON(w, http.StatusCreated, map[string]string{
+		"status":     "ok",
+		"id":         profileData.ID,
+		"session_id": profileData.SessionID,
+		"type":       string(profileData.Type),
+	})
+}
+
+func parseUploadParams(r *http.Request) (uploadParams, error) {
+	var params uploadParams
+
+	params.SessionID = r.FormValue("session_id")
+	if params.SessionID == "" {
+		return params, fmt.Errorf("session_id is required")
+	}
+	if err := validateID("session_id", params.SessionID); err != nil {
+		return params, err
+	}
+
+	params.ApplicationID = r.FormValue("application_id")
+
+	params.Type = types.ProfileType(r.FormValue("type"))
+	if params.Type != "" && !params.Type.Valid() {
+		return params, fmt.Errorf("unknown type: %s", params.Type)
+	}
+
+	if v := r.FormValue("timestamp"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return params, fmt.Errorf("invalid timestamp: %s", v)
+		}
+		params.Timestamp = t
+	}
+
+	if v := r.FormValue("sample_rate"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid sample_rate: %s", v)
+		}
+		params.SampleRate = rate
+	}
+
+	labels, err := types.ParseLabels(r.FormValue("labels"))
+	if err != nil {
+		return params, fmt.Errorf("invalid labels: %w", err)
+	}
+	params.Labels = labels
+
+	return params, nil
+}
+
+// ensureSession creates the upload's session when it is not stored yet. A
+// new session needs the application it belongs to; the error response is
+// written when it returns false.
+func (c *Collector) ensureSession(w http.ResponseWriter, params uploadParams) bool {
+	if _, err := c.storage.GetSession(params.SessionID); err == nil {
+		return true
+	}
+
+	if params.ApplicationID == "" {
+		c.respondError(w, http.StatusBadRequest, "application_id is required to create session "+params.SessionID)
+		return false
+	}
+
+	session := &types.ProfileSession{
+		ID:            params.SessionID,
+		ApplicationID: params.ApplicationID,
+		Name:          params.SessionID,
+		StartTime:     params.Timestamp,
+		EndTime:       params.Timestamp,
+		ProfileType:   params.Type,
+		Labels:        params.Labels,
+		Metadata: map[string]interface{}{
+			"source": "upload",
+		},
+	}
+
+	if err := c.storage.SaveSession(session); err != nil {
+		c.logger.Error("Failed to create session", zap.Error(err))
+		c.respondError(w, http.StatusInternalServerError, "Failed to create session")
+		return false
+	}
+
+	c.mu.Lock()
+	c.sessions[session.ID] = session
+	c.mu.Unlock()
+
+	c.logger.Info("Session created from upload",
+		zap.String("session_id", session.ID),
+		zap.String("app_id", session.ApplicationID))
+
+	return true
+}
@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/auth"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// upload sends data as a raw profile upload with the given query parameters
+func upload(c *Collector, key string, query url.Values, data []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/v1/profiles?"+query.Encode(), bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return serveRequest(c, req)
+}
+
+func TestUploadCreatesSession(t *testing.T) {
+	c, store := newTestCollector(t)
+	data := encodePprof(t, "cpu", 1)
+
+	expectStatus(t, upload(c, "", url.Values{"session_id": {"new"}}, data), http.StatusBadRequest, "new session without application_id")
+	if _, err := store.GetSession("new"); err == nil {
+		t.Error("session created without application_id")
+	}
+
+	expectStatus(t, upload(c, "", url.Values{"session_id": {"new"}, "application_id": {"app"}}, data), http.StatusCreated, "new session")
+	session, err := store.GetSession("new")
+	if err != nil || session.ApplicationID != "app" {
+		t.Fatalf("session = %+v, %v; want application app", session, err)
+	}
+
+	expectStatus(t, upload(c, "", url.Values{"session_id": {"new"}}, data), http.StatusCreated, "existing session without application_id")
+	if profiles, _ := store.ListProfiles("new"); len(profiles) != 2 {
+		t.Errorf("session has %d profiles, want 2", len(profiles))
+	}
+}
+
+func TestUploadType(t *testing.T) {
+	c, store := newTestCollector(t)
+	data := encodePprof(t, "cpu", 1)
+
+	for _, profileType := range []string{"bogus", "CPU", "../cpu"} {
+		query := url.Values{"session_id": {"s"}, "application_id": {"app"}, "type": {profileType}}
+		expectStatus(t, upload(c, "", query, data), http.StatusBadRequest, "type "+profileType)
+	}
+
+	query := url.Values{"session_id": {"s"}, "application_id": {"app"}, "type": {"heap"}}
+	expectStatus(t, upload(c, "", query, data), http.StatusCreated, "known type")
+	profiles, err := store.ListProfiles("s")
+	if err != nil || len(profiles) != 1 || profiles[0].Type != types.ProfileTypeHeap {
+		t.Errorf("profiles = %+v, %v; want one heap profile", profiles, err)
+	}
+}
+
+func TestUploadRestrictedKey(t *testing.T) {
+	c, store, ingest, _ := newAuthCollector(t)
+	data := encodePprof(t, "cpu", 1)
+
+	expectStatus(t, upload(c, ingest, url.Values{"session_id": {"new"}, "application_id": {"a"}}, data),
+		http.StatusCreated, "new session of own application")
+	if session, err := store.GetSession("new"); err != nil || session.ApplicationID != "a" {
+		t.Errorf("session = %+v, %v; want application a", session, err)
+	}
+
+	expectStatus(t, upload(c, ingest, url.Values{"session_id": {"new2"}, "application_id": {"b"}}, data),
+		http.StatusForbidden, "new session of other application")
+	expectStatus(t, upload(c, ingest, url.Values{"session_id": {"new3"}}, data),
+		http.StatusNotFound, "new session without application_id")
+
+	// The key also creates sessions when it may write to every application
+	_, all, err := c.keys.Create(auth.KeySpec{Scopes: []auth.Scope{auth.ScopeIngest}, Applications: []string{"*"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	expectStatus(t, upload(c, all, url.Values{"session_id": {"new4"}, "application_id": {"c"}}, data),
+		http.StatusCreated, "new session with unrestricted key")
+}
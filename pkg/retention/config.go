@@ -0,0 +1,147 @@
+// Package retention deletes and compacts stored profiling data according to
+// per application and per profile type policies.
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Duration is a time.Duration that reads from JSON as a Go duration string
+// such as "36h", a number of days such as "7d", or a number of nanoseconds
+type Duration time.Duration
+
+// ParseDuration parses a Go duration string or a whole number of days ("7d")
+func ParseDuration(s string) (Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return Duration(time.Duration(n) * 24 * time.Hour), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return Duration(d), nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid duration: %s", data)
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Policy says how long the profiles it applies to are kept. A policy applies
+// to the profiles of ApplicationID and ProfileType; an empty field matches
+// any. When several policies apply, the one naming both wins over the one
+// naming the application, which wins over the one naming the type.
+type Policy struct {
+	ApplicationID string            `json:"application_id,omitempty"`
+	ProfileType   types.ProfileType `json:"profile_type,omitempty"`
+
+	// MaxAge deletes raw profiles older than this; zero keeps them
+	MaxAge Duration `json:"max_age,omitempty"`
+	// CompactAfter merges raw pprof profiles older than this into one
+	// profile per session, type and CompactWindow; zero disables compaction
+	CompactAfter Duration `json:"compact_after,omitempty"`
+	// CompactWindow is the span merged into one profile, an hour by default
+	CompactWindow Duration `json:"compact_window,omitempty"`
+	// CompactedMaxAge deletes compacted profiles older than this; zero keeps
+	// them
+	CompactedMaxAge Duration `json:"compacted_max_age,omitempty"`
+}
+
+// Config is the retention configuration of a server
+type Config struct {
+	Policies []Policy `json:"policies,omitempty"`
+	// MetricsMaxAge deletes metrics snapshots older than this; zero keeps them
+	MetricsMaxAge Duration `json:"metrics_max_age,omitempty"`
+	// Interval is the time between janitor runs, an hour by default
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// Enabled reports whether the configuration removes anything
+func (c Config) Enabled() bool {
+	return len(c.Policies) > 0 || c.MetricsMaxAge > 0
+}
+
+// Validate checks the configuration for policies that cannot be applied
+func (c Config) Validate() error {
+	seen := make(map[[2]string]bool)
+	for _, p := range c.Policies {
+		key := [2]string{p.ApplicationID, string(p.ProfileType)}
+		if seen[key] {
+			return fmt.Errorf("duplicate retention policy for application %q and type %q", p.ApplicationID, p.ProfileType)
+		}
+		seen[key] = true
+
+		if p.CompactAfter > 0 && p.MaxAge > 0 && p.MaxAge <= p.CompactAfter {
+			return fmt.Errorf("retention policy for application %q and type %q: max_age must exceed compact_after", p.ApplicationID, p.ProfileType)
+		}
+		if p.CompactAfter > 0 && p.CompactedMaxAge > 0 && p.CompactedMaxAge <= p.CompactAfter {
+			return fmt.Errorf("retention policy for application %q and type %q: compacted_max_age must exceed compact_after", p.ApplicationID, p.ProfileType)
+		}
+	}
+	return nil
+}
+
+// policy returns the most specific policy for a profile, or nil
+func (c Config) policy(applicationID string, profileType types.ProfileType) *Policy {
+	var (
+		best      *Policy
+		bestScore = -1
+	)
+	for i := range c.Policies {
+		p := &c.Policies[i]
+		if p.ApplicationID != "" && p.ApplicationID != applicationID {
+			continue
+		}
+		if p.ProfileType != "" && p.ProfileType != profileType {
+			continue
+		}
+
+		score := 0
+		if p.ApplicationID != "" {
+			score += 2
+		}
+		if p.ProfileType != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
+
+func (p *Policy) compactWindow() time.Duration {
+	if p.CompactWindow > 0 {
+		return time.Duration(p.CompactWindow)
+	}
+	return time.Hour
+}
@@ -0,0 +1,518 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Reasons a profile is removed
+const (
+	ReasonExpired   = "expired"
+	ReasonCompacted = "compacted"
+)
+
+// ProfileRef describes a profile removed by a run
+type ProfileRef struct {
+	SessionID     string            `json:"session_id"`
+	ApplicationID string            `json:"application_id"`
+	Type          types.ProfileType `json:"type"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Size          int64             `json:"size"`
+	Reason        string            `json:"reason"`
+}
+
+// Compaction describes the profiles of one session, type and window merged
+// into a single profile
+type Compaction struct {
+	SessionID     string            `json:"session_id"`
+	ApplicationID string            `json:"application_id"`
+	Type          types.ProfileType `json:"type"`
+	WindowStart   time.Time         `json:"window_start"`
+	Window        time.Duration     `json:"window"`
+	Profiles      int               `json:"profiles"`
+	Size          int64             `json:"size"`
+}
+
+// Report is the outcome of a janitor run. In a dry run it lists what a real
+// run would remove without changing anything. A dry run reads no payloads and
+// does not merge profiles, so compactions contribute nothing to
+// BytesReclaimed and report a zero Size.
+type Report struct {
+	DryRun          bool          `json:"dry_run"`
+	StartedAt       time.Time     `json:"started_at"`
+	Duration        time.Duration `json:"duration"`
+	ProfilesDeleted int           `json:"profiles_deleted"`
+	MetricsDeleted  int           `json:"metrics_deleted"`
+	BytesReclaimed  int64         `json:"bytes_reclaimed"`
+	Profiles        []*ProfileRef `json:"profiles"`
+	Compactions     []*Compaction `json:"compactions"`
+	Sessions        []string      `json:"sessions_deleted"`
+	Errors          []string      `json:"errors,omitempty"`
+}
+
+func (r *Report) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Janitor applies a retention configuration to a storage
+type Janitor struct {
+	store  storage.Storage
+	config Config
+	logger *zap.Logger
+	now    func() time.Time
+
+	// runMu serializes runs so that a dry run never sees a half applied one
+	runMu sync.Mutex
+
+	mu   sync.RWMutex
+	last *Report
+}
+
+// NewJanitor creates a janitor for the given storage and configuration
+func NewJanitor(store storage.Storage, config Config, logger *zap.Logger) *Janitor {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Janitor{
+		store:  store,
+		config: config,
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// Config returns the janitor's configuration
+func (j *Janitor) Config() Config {
+	return j.config
+}
+
+// LastRun returns the report of the last run that was not a dry run, or nil
+func (j *Janitor) LastRun() *Report {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.last
+}
+
+// Start runs the janitor immediately and then at the configured interval
+// until ctx is cancelled
+func (j *Janitor) Start(ctx context.Context) {
+	interval := time.Duration(j.config.Interval)
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.Run(ctx, false); err != nil && ctx.Err() == nil {
+			j.logger.Error("Retention run failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run applies the retention policies once. Failures affecting a single
+// session or profile are collected in the report rather than stopping the
+// run.
+func (j *Janitor) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+
+	report := &Report{
+		DryRun:      dryRun,
+		StartedAt:   j.now(),
+		Profiles:    []*ProfileRef{},
+		Compactions: []*Compaction{},
+		Sessions:    []string{},
+	}
+
+	sessions, err := j.store.ListSessions("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	for _, session := range sessions {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		j.cleanSession(session, report.StartedAt, dryRun, report)
+	}
+
+	report.Duration = j.now().Sub(report.StartedAt)
+
+	if !dryRun {
+		j.mu.Lock()
+		j.last = report
+		j.mu.Unlock()
+
+		j.logger.Info("Retention run completed",
+			zap.Int("profiles_deleted", report.ProfilesDeleted),
+			zap.Int("compactions", len(report.Compactions)),
+			zap.Int("sessions_deleted", len(report.Sessions)),
+			zap.Int("metrics_deleted", report.MetricsDeleted),
+			zap.Int64("bytes_reclaimed", report.BytesReclaimed),
+			zap.Int("errors", len(report.Errors)))
+	}
+
+	return report, nil
+}
+
+// compactionGroup gathers the profiles of one session merged into a window
+type compactionGroup struct {
+	policy   *Policy
+	start    time.Time
+	raw      []*types.ProfileData
+	existing *types.ProfileData
+}
+
+type groupKey struct {
+	profileType types.ProfileType
+	start       time.Time
+}
+
+// cleanSession applies the policies to one session's profiles and metrics.
+// Decisions are made on metadata alone; payloads are read only for the
+// windows being compacted. A session whose profiles have all been removed is
+// deleted, as is an empty session older than the max age of its policy.
+func (j *Janitor) cleanSession(session *types.ProfileSession, now time.Time, dryRun bool, report *Report) {
+	profiles, err := j.store.ListProfiles(session.ID)
+	if err != nil {
+		report.errorf("session %s: %v", session.ID, err)
+		return
+	}
+
+	var expired []*types.ProfileData
+	groups := make(map[groupKey]*compactionGroup)
+	group := func(policy *Policy, profileType types.ProfileType, start time.Time) *compactionGroup {
+		key := groupKey{profileType, start}
+		g, ok := groups[key]
+		if !ok {
+			g = &compactionGroup{policy: policy, start: start}
+			groups[key] = g
+		}
+		return g
+	}
+
+	for _, p := range profiles {
+		policy := j.config.policy(session.ApplicationID, p.Type)
+		if policy == nil {
+			continue
+		}
+		age := now.Sub(p.Timestamp)
+
+		if isCompacted(p) {
+			if policy.CompactedMaxAge > 0 && age > time.Duration(policy.CompactedMaxAge) {
+				expired = append(expired, p)
+			} else if policy.CompactAfter > 0 {
+				// Late profiles of the same window are merged into it
+				group(policy, p.Type, p.Timestamp.UTC()).existing = p
+			}
+			continue
+		}
+
+		if policy.CompactAfter > 0 && isCompactable(p) {
+			window := policy.compactWindow()
+			start := p.Timestamp.UTC().Truncate(window)
+
+			// Only windows that are entirely past compact_after are merged, so
+			// a window is compacted once
+			if now.Sub(start.Add(window)) > time.Duration(policy.CompactAfter) {
+				if policy.CompactedMaxAge > 0 && now.Sub(start) > time.Duration(policy.CompactedMaxAge) {
+					expired = append(expired, p)
+				} else {
+					g := group(policy, p.Type, start)
+					g.raw = append(g.raw, p)
+				}
+				continue
+			}
+		}
+
+		if policy.MaxAge > 0 && age > time.Duration(policy.MaxAge) {
+			expired = append(expired, p)
+		}
+	}
+
+	remaining := len(profiles)
+
+	for _, p := range expired {
+		if !dryRun {
+			if err := j.store.DeleteProfileData(p.SessionID, p.ID); err != nil {
+				report.errorf("session %s: failed to delete %s profile at %s: %v", session.ID, p.Type, p.Timestamp, err)
+				continue
+			}
+		}
+		report.addProfile(session, p, ReasonExpired)
+		report.BytesReclaimed += int64(p.Size)
+		remaining--
+	}
+
+	keys := make([]groupKey, 0, len(groups))
+	for key, g := range groups {
+		if len(g.raw) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].profileType != keys[b].profileType {
+			return keys[a].profileType < keys[b].profileType
+		}
+		return keys[a].start.Before(keys[b].start)
+	})
+
+	for _, key := range keys {
+		g := groups[key]
+		removed, ok := j.compact(session, key.profileType, g, dryRun, report)
+		if ok {
+			remaining -= removed
+		}
+	}
+
+	j.cleanMetrics(session, now, dryRun, report)
+
+	empty := remaining == 0 && len(profiles) > 0
+	if len(profiles) == 0 {
+		policy := j.config.policy(session.ApplicationID, session.ProfileType)
+		empty = policy != nil && policy.MaxAge > 0 && now.Sub(session.StartTime) > time.Duration(policy.MaxAge)
+	}
+	if !empty {
+		return
+	}
+
+	if !dryRun {
+		if err := j.store.DeleteSession(session.ID); err != nil {
+			report.errorf("session %s: failed to delete session: %v", session.ID, err)
+			return
+		}
+	}
+	report.Sessions = append(report.Sessions, session.ID)
+}
+
+// compact merges a window's raw profiles, and the profile an earlier run
+// compacted for the same window, into one profile and removes the raw
+// profiles. It returns the change in the session's number of profiles.
+func (j *Janitor) compact(session *types.ProfileSession, profileType types.ProfileType, g *compactionGroup, dryRun bool, report *Report) (int, bool) {
+	inputs := g.raw
+	if g.existing != nil {
+		inputs = append(inputs, g.existing)
+	}
+
+	// A dry run does not read payloads and takes every input to merge
+	merged := inputs
+	var compacted *types.ProfileData
+	if !dryRun {
+		compacted, merged = j.merge(session, profileType, g, inputs, report)
+		if compacted == nil {
+			return 0, false
+		}
+		if err := j.store.SaveProfileData(compacted); err != nil {
+			report.errorf("session %s: failed to save compacted %s profile of %s: %v", session.ID, profileType, g.start, err)
+			return 0, false
+		}
+	}
+
+	var consumed int64
+	removed := 0
+	for _, raw := range merged {
+		if raw == g.existing {
+			// Replaced by the new compacted profile without being reported
+			if !dryRun && raw.ID != compacted.ID {
+				if err := j.store.DeleteProfileData(raw.SessionID, raw.ID); err != nil {
+					report.errorf("session %s: failed to delete replaced compacted %s profile of %s: %v", session.ID, raw.Type, raw.Timestamp, err)
+				}
+			}
+			consumed += int64(raw.Size)
+			continue
+		}
+		if !dryRun {
+			if err := j.store.DeleteProfileData(raw.SessionID, raw.ID); err != nil {
+				report.errorf("session %s: failed to delete compacted %s profile at %s: %v", session.ID, raw.Type, raw.Timestamp, err)
+				continue
+			}
+		}
+		report.addProfile(session, raw, ReasonCompacted)
+		consumed += int64(raw.Size)
+		removed++
+	}
+
+	compaction := &Compaction{
+		SessionID:     session.ID,
+		ApplicationID: session.ApplicationID,
+		Type:          profileType,
+		WindowStart:   g.start,
+		Window:        g.policy.compactWindow(),
+		Profiles:      len(merged),
+	}
+	if compacted != nil {
+		compaction.Size = int64(len(compacted.Data))
+		// The inputs, including a replaced compacted profile, give way to
+		// the merged one
+		report.BytesReclaimed += consumed - compaction.Size
+	}
+	report.Compactions = append(report.Compactions, compaction)
+
+	if g.existing == nil {
+		return removed - 1, true
+	}
+	return removed, true
+}
+
+// merge loads and combines the payloads of a window's profiles. Window
+// profiles such as CPU profiles are summed, while of snapshots such as heap
+// profiles only the latest is kept. It returns the compacted profile and the
+// inputs it replaces, or nil when there is nothing to merge. Inputs that
+// cannot be read or decoded are left alone to expire under max_age.
+func (j *Janitor) merge(session *types.ProfileSession, profileType types.ProfileType, g *compactionGroup, inputs []*types.ProfileData, report *Report) (*types.ProfileData, []*types.ProfileData) {
+	// Combine takes the profiles oldest first. An earlier compacted profile
+	// carries the window start, so a late snapshot replaces it.
+	inputs = slices.Clone(inputs)
+	sort.SliceStable(inputs, func(a, b int) bool {
+		return inputs[a].Timestamp.Before(inputs[b].Timestamp)
+	})
+
+	var (
+		decoded []*collection.Profile
+		merged  []*types.ProfileData
+	)
+	for _, p := range inputs {
+		full, err := j.store.GetProfile(p.SessionID, p.ID)
+		if err != nil {
+			report.errorf("session %s: cannot load %s profile at %s: %v", session.ID, p.Type, p.Timestamp, err)
+			continue
+		}
+		d, err := collection.Decode(full)
+		if err != nil {
+			report.errorf("session %s: cannot compact %s profile at %s: %v", session.ID, p.Type, p.Timestamp, err)
+			continue
+		}
+		decoded = append(decoded, d)
+		merged = append(merged, p)
+	}
+	if len(decoded) == 0 || (len(decoded) == 1 && g.existing != nil && merged[0] == g.existing) {
+		return nil, nil
+	}
+
+	p, err := collection.Combine(decoded)
+	if err != nil {
+		report.errorf("session %s: cannot compact %s profiles of %s: %v", session.ID, profileType, g.start, err)
+		return nil, nil
+	}
+
+	data, err := collection.Encode(p.Profile)
+	if err != nil {
+		report.errorf("session %s: cannot encode compacted %s profile of %s: %v", session.ID, profileType, g.start, err)
+		return nil, nil
+	}
+
+	return &types.ProfileData{
+		SessionID:   session.ID,
+		Type:        profileType,
+		Timestamp:   g.start,
+		Data:        data,
+		Labels:      commonLabels(merged),
+		SampleRate:  merged[0].SampleRate,
+		SampleCount: int64(len(p.Sample)),
+		Metadata: map[string]interface{}{
+			types.MetadataCompacted: true,
+			"compacted_from":        len(merged),
+			"window":                g.policy.compactWindow().String(),
+		},
+	}, merged
+}
+
+// cleanMetrics removes the session's metrics older than MetricsMaxAge. Those
+// of a deleted session go with it.
+func (j *Janitor) cleanMetrics(session *types.ProfileSession, now time.Time, dryRun bool, report *Report) {
+	if j.config.MetricsMaxAge <= 0 {
+		return
+	}
+
+	cutoff := now.Add(-time.Duration(j.config.MetricsMaxAge))
+
+	if !dryRun {
+		count, err := j.store.DeleteMetrics(session.ID, cutoff)
+		if err != nil {
+			report.errorf("session %s: failed to delete metrics: %v", session.ID, err)
+			return
+		}
+		report.MetricsDeleted += count
+		return
+	}
+
+	metrics, err := j.store.GetMetrics(session.ID)
+	if err != nil {
+		report.errorf("session %s: %v", session.ID, err)
+		return
+	}
+	for _, m := range metrics {
+		if m.Timestamp.Before(cutoff) {
+			report.MetricsDeleted++
+		}
+	}
+}
+
+func (r *Report) addProfile(session *types.ProfileSession, p *types.ProfileData, reason string) {
+	r.Profiles = append(r.Profiles, &ProfileRef{
+		SessionID:     session.ID,
+		ApplicationID: session.ApplicationID,
+		Type:          p.Type,
+		Timestamp:     p.Timestamp,
+		Size:          int64(p.Size),
+		Reason:        reason,
+	})
+	r.ProfilesDeleted++
+}
+
+func isCompacted(p *types.ProfileData) bool {
+	compacted, _ := p.Metadata[types.MetadataCompacted].(bool)
+	return compacted
+}
+
+// isCompactable reports whether a profile holds pprof data that can be merged.
+// Traces, I/O statistics, memory statistics and text dumps are not pprof.
+func isCompactable(p *types.ProfileData) bool {
+	switch p.Type {
+	case types.ProfileTypeCPU, types.ProfileTypeHeap, types.ProfileTypeBlock, types.ProfileTypeMutex,
+		types.ProfileTypeGoroutine, types.ProfileTypeThreadCreate, types.ProfileTypeAllocs:
+	default:
+		return false
+	}
+	format, _ := p.Metadata["format"].(string)
+	return format != types.ProfileFormatText
+}
+
+// commonLabels returns the labels shared with the same value by every profile
+func commonLabels(profiles []*types.ProfileData) types.Labels {
+	var common types.Labels
+	for i, p := range profiles {
+		if i == 0 {
+			common = types.MergeLabels(p.Labels)
+			continue
+		}
+		for key, value := range common {
+			if p.Labels[key] != value {
+				delete(common, key)
+			}
+		}
+	}
+	if len(common) == 0 {
+		return nil
+	}
+	return common
+}
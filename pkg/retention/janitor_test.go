@@ -0,0 +1,261 @@
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/King-kin5/analysis/collection"
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// countingStorage counts the calls that read profile payloads
+type countingStorage struct {
+	storage.Storage
+	payloadReads int
+}
+
+func (s *countingStorage) GetProfileData(sessionID string) ([]*types.ProfileData, error) {
+	s.payloadReads++
+	return s.Storage.GetProfileData(sessionID)
+}
+
+func (s *countingStorage) GetProfile(sessionID, profileID string) (*types.ProfileData, error) {
+	s.payloadReads++
+	return s.Storage.GetProfile(sessionID, profileID)
+}
+
+// cpuProfile returns an encoded CPU profile with one sample of n samples
+func cpuProfile(t *testing.T, n int64) []byte {
+	t.Helper()
+
+	fn := &profile.Function{ID: 1, Name: "main.work", Filename: "/app/work.go"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 42}}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{n, n * 10000000}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	}
+	data, err := collection.Encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestJanitorRun(t *testing.T) {
+	fs, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	store := &countingStorage{Storage: fs}
+
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	config := Config{
+		Policies: []Policy{
+			{ProfileType: types.ProfileTypeCPU, MaxAge: Duration(48 * time.Hour), CompactAfter: Duration(time.Hour)},
+			{ProfileType: types.ProfileTypeHeap, MaxAge: Duration(24 * time.Hour)},
+		},
+		MetricsMaxAge: Duration(24 * time.Hour),
+	}
+	janitor := NewJanitor(store, config, nil)
+	janitor.now = func() time.Time { return now }
+
+	for _, id := range []string{"s", "old"} {
+		if err := fs.SaveSession(&types.ProfileSession{ID: id, ApplicationID: "app", StartTime: now.Add(-40 * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save := func(sessionID string, profileType types.ProfileType, age time.Duration, data []byte) {
+		t.Helper()
+		if err := fs.SaveProfileData(&types.ProfileData{SessionID: sessionID, Type: profileType, Timestamp: now.Add(-age), Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("s", types.ProfileTypeCPU, 5*time.Hour-10*time.Minute, cpuProfile(t, 2))
+	save("s", types.ProfileTypeCPU, 5*time.Hour-20*time.Minute, cpuProfile(t, 3))
+	save("s", types.ProfileTypeCPU, 10*time.Minute, cpuProfile(t, 1))
+	save("s", types.ProfileTypeHeap, 30*time.Hour, []byte("expired heap"))
+	save("s", types.ProfileTypeHeap, time.Hour, []byte("recent heap"))
+	save("old", types.ProfileTypeHeap, 30*time.Hour, []byte("old heap"))
+
+	for _, age := range []time.Duration{30 * time.Hour, time.Hour} {
+		if err := fs.SaveMetrics("s", &types.MetricsSnapshot{Timestamp: now.Add(-age)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dry, err := janitor.Run(context.Background(), true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if store.payloadReads != 0 {
+		t.Errorf("dry run read %d payloads", store.payloadReads)
+	}
+
+	run, err := janitor.Run(context.Background(), false)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(run.Errors) != 0 {
+		t.Fatalf("run errors: %v", run.Errors)
+	}
+	// Only the two profiles of the compacted window are loaded
+	if store.payloadReads != 2 {
+		t.Errorf("run read %d payloads, want 2", store.payloadReads)
+	}
+
+	for _, report := range []*Report{dry, run} {
+		if !report.StartedAt.Equal(now) {
+			t.Errorf("dry run %v: started at %v, want %v", report.DryRun, report.StartedAt, now)
+		}
+		if report.ProfilesDeleted != 4 || report.MetricsDeleted != 1 || len(report.Compactions) != 1 {
+			t.Errorf("dry run %v: %d profiles, %d metrics, %d compactions deleted, want 4, 1, 1",
+				report.DryRun, report.ProfilesDeleted, report.MetricsDeleted, len(report.Compactions))
+		}
+		if len(report.Sessions) != 1 || report.Sessions[0] != "old" {
+			t.Errorf("dry run %v: sessions deleted %v, want [old]", report.DryRun, report.Sessions)
+		}
+		if c := report.Compactions[0]; c.Profiles != 2 || !c.WindowStart.Equal(now.Add(-5*time.Hour)) {
+			t.Errorf("dry run %v: compaction = %+v", report.DryRun, c)
+		}
+	}
+	if want := int64(len("expired heap") + len("old heap")); dry.BytesReclaimed != want {
+		t.Errorf("dry run reclaimed %d bytes, want %d", dry.BytesReclaimed, want)
+	}
+
+	if _, err := fs.GetSession("old"); err == nil {
+		t.Error("old session was not deleted")
+	}
+	profiles, err := fs.GetProfileData("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 3 {
+		t.Fatalf("session has %d profiles after the run, want 3", len(profiles))
+	}
+	var compacted *types.ProfileData
+	for _, p := range profiles {
+		if isCompacted(p) {
+			compacted = p
+		}
+	}
+	if compacted == nil || !compacted.Timestamp.Equal(now.Add(-5*time.Hour)) {
+		t.Fatalf("compacted profile = %+v", compacted)
+	}
+	merged, err := collection.Decode(compacted)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if total := merged.Total(0); total != 5 {
+		t.Errorf("compacted profile has %d samples, want 5", total)
+	}
+	if metrics, _ := fs.GetMetrics("s"); len(metrics) != 1 {
+		t.Errorf("session has %d metrics snapshots, want 1", len(metrics))
+	}
+
+	// Nothing is left to do until the clock moves on
+	again, err := janitor.Run(context.Background(), false)
+	if err != nil || again.ProfilesDeleted != 0 || len(again.Compactions) != 0 {
+		t.Errorf("second run = %+v, %v; want nothing removed", again, err)
+	}
+
+	now = now.Add(3 * time.Hour)
+	later, err := janitor.Run(context.Background(), false)
+	if err != nil || len(later.Compactions) != 1 || later.Compactions[0].Profiles != 1 {
+		t.Errorf("run after 3h = %+v, %v; want the recent cpu profile compacted", later, err)
+	}
+}
+
+// heapProfile returns an encoded heap profile with n bytes in use
+func heapProfile(t *testing.T, n int64) []byte {
+	t.Helper()
+
+	fn := &profile.Function{ID: 1, Name: "main.alloc", Filename: "/app/alloc.go"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 7}}}
+	data, err := collection.Encode(&profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "inuse_space", Unit: "bytes"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{n}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestJanitorCompactsSnapshots(t *testing.T) {
+	fs, err := storage.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	config := Config{
+		Policies: []Policy{
+			{ProfileType: types.ProfileTypeHeap, CompactAfter: Duration(time.Hour)},
+			{ProfileType: types.ProfileTypeIO, CompactAfter: Duration(time.Hour)},
+		},
+	}
+	janitor := NewJanitor(fs, config, nil)
+	janitor.now = func() time.Time { return now }
+
+	if err := fs.SaveSession(&types.ProfileSession{ID: "s", ApplicationID: "app", StartTime: now.Add(-10 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	save := func(profileType types.ProfileType, age time.Duration, data []byte) {
+		t.Helper()
+		if err := fs.SaveProfileData(&types.ProfileData{SessionID: "s", Type: profileType, Timestamp: now.Add(-age), Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save(types.ProfileTypeHeap, 5*time.Hour-40*time.Minute, heapProfile(t, 300))
+	save(types.ProfileTypeHeap, 5*time.Hour-10*time.Minute, heapProfile(t, 100))
+	save(types.ProfileTypeHeap, 5*time.Hour-20*time.Minute, heapProfile(t, 200))
+	save(types.ProfileTypeIO, 5*time.Hour-10*time.Minute, []byte(`{"read_bytes":1}`))
+	save(types.ProfileTypeIO, 5*time.Hour-20*time.Minute, []byte(`{"read_bytes":2}`))
+
+	report, err := janitor.Run(context.Background(), false)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("run errors: %v", report.Errors)
+	}
+	if len(report.Compactions) != 1 || report.Compactions[0].Type != types.ProfileTypeHeap || report.Compactions[0].Profiles != 3 {
+		t.Fatalf("compactions = %+v, want the three heap snapshots", report.Compactions)
+	}
+
+	profiles, err := fs.GetProfileData("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var io int
+	for _, p := range profiles {
+		switch {
+		case p.Type == types.ProfileTypeIO:
+			io++
+		case isCompacted(p):
+			merged, err := collection.Decode(p)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			// The latest snapshot of the window, not the sum of all three
+			if total := merged.Total(0); total != 300 {
+				t.Errorf("compacted heap profile has %d bytes in use, want 300", total)
+			}
+		default:
+			t.Errorf("%s profile at %s was not compacted", p.Type, p.Timestamp)
+		}
+	}
+	if io != 2 {
+		t.Errorf("%d io profiles left, want 2", io)
+	}
+}
@@ -0,0 +1,19 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/storage/storagetest"
+)
+
+func TestFileStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		dir := t.TempDir()
+		store, err := storage.NewFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storagetest.Backend{Storage: store, Corrupt: storagetest.CorruptFileProfiles(dir), Dir: dir}
+	})
+}
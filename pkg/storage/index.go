@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// indexEntry locates one stored profile
+type indexEntry struct {
+	sessionID   string
+	profileType types.ProfileType
+	timestamp   time.Time
+	labels      types.Labels
+	id          string
+}
+
+// profileIndex orders the profiles of every application by timestamp so that
+// time-range queries do not scan every session directory. Profiles can arrive
+// before their session does; they are kept per session and join their
+// application's index once the session is saved.
+type profileIndex struct {
+	sessionApps   map[string]string
+	sessionLabels map[string]types.Labels
+	sessions      map[string][]indexEntry
+	// ids holds the profile IDs of each session in sessions
+	ids  map[string]map[string]bool
+	apps map[string][]indexEntry
+}
+
+func newProfileIndex() *profileIndex {
+	return &profileIndex{
+		sessionApps:   make(map[string]string),
+		sessionLabels: make(map[string]types.Labels),
+		sessions:      make(map[string][]indexEntry),
+		ids:           make(map[string]map[string]bool),
+		apps:          make(map[string][]indexEntry),
+	}
+}
+
+// setSession records the application and labels of a session
+func (idx *profileIndex) setSession(sessionID, applicationID string, labels types.Labels) {
+	if len(labels) > 0 {
+		idx.sessionLabels[sessionID] = labels
+	} else {
+		delete(idx.sessionLabels, sessionID)
+	}
+
+	previous, known := idx.sessionApps[sessionID]
+	if known && previous == applicationID {
+		return
+	}
+
+	if known {
+		idx.removeFromApp(previous, sessionID, "")
+	}
+	idx.sessionApps[sessionID] = applicationID
+
+	for _, entry := range idx.sessions[sessionID] {
+		idx.insertIntoApp(applicationID, entry)
+	}
+}
+
+// has reports whether a session holds a profile
+func (idx *profileIndex) has(sessionID, id string) bool {
+	return idx.ids[sessionID][id]
+}
+
+// add indexes a profile, replacing an earlier entry with the same ID
+func (idx *profileIndex) add(entry indexEntry) {
+	if idx.has(entry.sessionID, entry.id) {
+		idx.remove(entry.sessionID, entry.id)
+	}
+	idx.addToSession(entry)
+
+	if applicationID, known := idx.sessionApps[entry.sessionID]; known {
+		idx.insertIntoApp(applicationID, entry)
+	}
+}
+
+// load indexes the profiles of a session read from its manifest. A later
+// entry with the same ID replaces an earlier one. The application's entries
+// are appended unordered, so sortApps must be called once every session is
+// loaded.
+func (idx *profileIndex) load(sessionID string, entries []indexEntry) {
+	for _, entry := range entries {
+		if idx.has(sessionID, entry.id) {
+			idx.removeFromSession(sessionID, entry.id)
+		}
+		idx.addToSession(entry)
+	}
+
+	if applicationID, known := idx.sessionApps[sessionID]; known {
+		idx.apps[applicationID] = append(idx.apps[applicationID], idx.sessions[sessionID]...)
+	}
+}
+
+// sortApps orders the entries of every application by timestamp
+func (idx *profileIndex) sortApps() {
+	for _, entries := range idx.apps {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].timestamp.Before(entries[j].timestamp)
+		})
+	}
+}
+
+// remove drops the entry of one profile
+func (idx *profileIndex) remove(sessionID, id string) {
+	if !idx.has(sessionID, id) {
+		return
+	}
+	idx.removeFromSession(sessionID, id)
+
+	if applicationID, known := idx.sessionApps[sessionID]; known {
+		idx.removeFromApp(applicationID, sessionID, id)
+	}
+}
+
+func (idx *profileIndex) addToSession(entry indexEntry) {
+	ids := idx.ids[entry.sessionID]
+	if ids == nil {
+		ids = make(map[string]bool)
+		idx.ids[entry.sessionID] = ids
+	}
+	ids[entry.id] = true
+	idx.sessions[entry.sessionID] = append(idx.sessions[entry.sessionID], entry)
+}
+
+func (idx *profileIndex) removeFromSession(sessionID, id string) {
+	entries := idx.sessions[sessionID]
+	for i, existing := range entries {
+		if existing.id == id {
+			idx.sessions[sessionID] = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	delete(idx.ids[sessionID], id)
+
+	if len(idx.sessions[sessionID]) == 0 {
+		delete(idx.sessions, sessionID)
+		delete(idx.ids, sessionID)
+	}
+}
+
+// removeSession drops a session and all of its profiles
+func (idx *profileIndex) removeSession(sessionID string) {
+	if applicationID, known := idx.sessionApps[sessionID]; known {
+		idx.removeFromApp(applicationID, sessionID, "")
+	}
+	delete(idx.sessionApps, sessionID)
+	delete(idx.sessionLabels, sessionID)
+	delete(idx.sessions, sessionID)
+	delete(idx.ids, sessionID)
+}
+
+// query returns the entries of an application matching the query, oldest first
+func (idx *profileIndex) query(q ProfileQuery) []indexEntry {
+	entries := idx.apps[q.ApplicationID]
+
+	start := 0
+	if !q.From.IsZero() {
+		start = sort.Search(len(entries), func(i int) bool {
+			return !entries[i].timestamp.Before(q.From)
+		})
+	}
+
+	var matches []indexEntry
+	for _, entry := range entries[start:] {
+		if !q.To.IsZero() && entry.timestamp.After(q.To) {
+			break
+		}
+		if q.Type != "" && entry.profileType != q.Type {
+			continue
+		}
+		if len(q.Labels) > 0 && !idx.labels(entry).Matches(q.Labels) {
+			continue
+		}
+		matches = append(matches, entry)
+	}
+	return matches
+}
+
+// labels returns the effective labels of a profile: its session's labels
+// overridden by its own
+func (idx *profileIndex) labels(entry indexEntry) types.Labels {
+	sessionLabels := idx.sessionLabels[entry.sessionID]
+	if len(entry.labels) == 0 {
+		return sessionLabels
+	}
+	return types.MergeLabels(sessionLabels, entry.labels)
+}
+
+func (idx *profileIndex) insertIntoApp(applicationID string, entry indexEntry) {
+	entries := idx.apps[applicationID]
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].timestamp.After(entry.timestamp)
+	})
+	entries = append(entries, indexEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	idx.apps[applicationID] = entries
+}
+
+// removeFromApp drops a session's entries from an application, or only the
+// entry with the given ID when it is set
+func (idx *profileIndex) removeFromApp(applicationID, sessionID, id string) {
+	entries := idx.apps[applicationID]
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.sessionID == sessionID && (id == "" || entry.id == id) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	if len(kept) == 0 {
+		delete(idx.apps, applicationID)
+		return
+	}
+	idx.apps[applicationID] = kept
+}
+
+// buildIndex indexes every session and profile already on disk, migrating
+// profiles stored in the earlier one file per profile layout
+func (fs *FileStorage) buildIndex() error {
+	sessions, err := fs.ListSessions("")
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		fs.index.setSession(session.ID, session.ApplicationID, session.Labels)
+	}
+
+	profilesDir := filepath.Join(fs.basePath, "profiles")
+	sessionDirs, err := os.ReadDir(profilesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read profiles directory: %w", err)
+	}
+
+	for _, sessionDir := range sessionDirs {
+		if !sessionDir.IsDir() {
+			continue
+		}
+
+		sessionID := sessionDir.Name()
+		profileDir := filepath.Join(profilesDir, sessionID)
+		if err := migrateLegacyProfiles(profileDir, sessionID); err != nil {
+			return fmt.Errorf("failed to migrate profiles of session %s: %w", sessionID, err)
+		}
+
+		records, err := readManifest(profileDir)
+		if err != nil {
+			continue
+		}
+
+		entries := make([]indexEntry, len(records))
+		for i, record := range records {
+			entries[i] = indexEntry{
+				sessionID:   sessionID,
+				profileType: record.Type,
+				timestamp:   record.Timestamp,
+				labels:      record.Labels,
+				id:          record.ID,
+			}
+		}
+		fs.index.load(sessionID, entries)
+	}
+
+	fs.index.sortApps()
+	return nil
+}
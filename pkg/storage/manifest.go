@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// A session's profiles are stored as
+//
+//	profiles/<session_id>/manifest.jsonl   one profileRecord per line
+//	profiles/<session_id>/blobs/<sha256>   payloads, named by content hash
+//
+// Identical payloads within a session share a blob. The manifest is only
+// appended to, except when profiles are deleted.
+const (
+	manifestName = "manifest.jsonl"
+	blobsDir     = "blobs"
+)
+
+// profileRecord is the manifest entry of one profile
+type profileRecord struct {
+	ID          string                 `json:"id"`
+	Type        types.ProfileType      `json:"type"`
+	Timestamp   time.Time              `json:"timestamp"`
+	SampleRate  int                    `json:"sample_rate"`
+	SampleCount int64                  `json:"sample_count"`
+	Labels      types.Labels           `json:"labels,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Digest      string                 `json:"digest"`
+	Size        int                    `json:"size"`
+}
+
+// digest returns the hex SHA-256 of a payload
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// profileID derives a profile's ID from its type, timestamp and payload
+// digest. Profiles of the same second get distinct IDs unless they are the
+// same upload repeated, which is then stored once.
+func profileID(data *types.ProfileData, digest string) string {
+	h := sha256.New()
+	io.WriteString(h, string(data.Type))
+	io.WriteString(h, "\x00"+strconv.FormatInt(data.Timestamp.UnixNano(), 10))
+	io.WriteString(h, "\x00"+digest)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func newProfileRecord(data *types.ProfileData, digest string) *profileRecord {
+	return &profileRecord{
+		ID:          profileID(data, digest),
+		Type:        data.Type,
+		Timestamp:   data.Timestamp,
+		SampleRate:  data.SampleRate,
+		SampleCount: data.SampleCount,
+		Labels:      data.Labels,
+		Metadata:    data.Metadata,
+		Digest:      digest,
+		Size:        len(data.Data),
+	}
+}
+
+// profileData returns the profile described by a record, reading its blob
+// only when withData is set
+func (r *profileRecord) profileData(profileDir, sessionID string, withData bool) (*types.ProfileData, error) {
+	profileData := &types.ProfileData{
+		ID:          r.ID,
+		SessionID:   sessionID,
+		Type:        r.Type,
+		Timestamp:   r.Timestamp,
+		Labels:      r.Labels,
+		Metadata:    r.Metadata,
+		SampleRate:  r.SampleRate,
+		SampleCount: r.SampleCount,
+		Size:        r.Size,
+	}
+
+	if withData {
+		var err error
+		profileData.Data, err = os.ReadFile(blobPath(profileDir, r.Digest))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return profileData, nil
+}
+
+func blobPath(profileDir, digest string) string {
+	return filepath.Join(profileDir, blobsDir, digest)
+}
+
+// readManifest returns the records of a session's manifest, oldest first.
+// Lines that cannot be parsed are skipped.
+func readManifest(profileDir string) ([]*profileRecord, error) {
+	data, err := os.ReadFile(filepath.Join(profileDir, manifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var records []*profileRecord
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var record profileRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.ID == "" || record.Digest == "" {
+			continue
+		}
+		records = append(records, &record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records, nil
+}
+
+// appendManifest adds a record to a session's manifest. A line left
+// incomplete by an interrupted write is terminated first so that it does
+// not swallow the new record.
+func appendManifest(profileDir string, record *profileRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest record: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(profileDir, manifestName), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte("\n"), line...)
+		}
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// writeManifest replaces a session's manifest with the given records
+func writeManifest(profileDir string, records []*profileRecord) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal manifest record: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmpPath, err := writeTempFile(profileDir, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(profileDir, manifestName)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// migrateLegacyProfiles moves the profiles of a session stored in the
+// earlier layout, a "<type>_<time>.pprof" payload next to a ".meta.json"
+// file, into the manifest and blob store. Profiles that cannot be read are
+// left in place.
+func migrateLegacyProfiles(profileDir, sessionID string) error {
+	entries, err := os.ReadDir(profileDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta.json") {
+			continue
+		}
+
+		profileData, profileFile, err := readLegacyProfile(profileDir, sessionID, entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Join(profileDir, blobsDir), 0755); err != nil {
+			return fmt.Errorf("failed to create blob directory: %w", err)
+		}
+
+		record := newProfileRecord(profileData, digest(profileData.Data))
+		tmpPath, err := writeTempFile(filepath.Join(profileDir, blobsDir), profileData.Data)
+		if err != nil {
+			return fmt.Errorf("failed to write profile data: %w", err)
+		}
+		if err := os.Rename(tmpPath, blobPath(profileDir, record.Digest)); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to write profile data: %w", err)
+		}
+		if err := appendManifest(profileDir, record); err != nil {
+			return err
+		}
+
+		os.Remove(filepath.Join(profileDir, profileFile))
+		os.Remove(filepath.Join(profileDir, entry.Name()))
+	}
+
+	return nil
+}
+
+// readLegacyProfile loads a profile stored in the earlier layout and returns
+// it with the name of its payload file
+func readLegacyProfile(profileDir, sessionID, metaName string) (*types.ProfileData, string, error) {
+	metaBytes, err := os.ReadFile(filepath.Join(profileDir, metaName))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var meta struct {
+		Type        types.ProfileType      `json:"type"`
+		Timestamp   time.Time              `json:"timestamp"`
+		SampleRate  int                    `json:"sample_rate"`
+		SampleCount int64                  `json:"sample_count"`
+		Labels      types.Labels           `json:"labels"`
+		Metadata    map[string]interface{} `json:"metadata"`
+		File        string                 `json:"file"`
+	}
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, "", err
+	}
+	if meta.File == "" || filepath.Base(meta.File) != meta.File {
+		return nil, "", fmt.Errorf("metadata %s names no profile file", metaName)
+	}
+
+	data, err := os.ReadFile(filepath.Join(profileDir, meta.File))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &types.ProfileData{
+		SessionID:   sessionID,
+		Type:        meta.Type,
+		Timestamp:   meta.Timestamp,
+		Data:        data,
+		Labels:      meta.Labels,
+		Metadata:    meta.Metadata,
+		SampleRate:  meta.SampleRate,
+		SampleCount: meta.SampleCount,
+	}, meta.File, nil
+}
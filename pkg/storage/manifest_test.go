@@ -0,0 +1,193 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+func openFileStorage(t *testing.T, dir string) *storage.FileStorage {
+	t.Helper()
+
+	store, err := storage.NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	return store
+}
+
+// dirNames returns the sorted names of a directory's entries
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profilePayloads returns the payloads of a session's profiles, oldest first
+func profilePayloads(t *testing.T, s storage.Storage, sessionID string) []string {
+	t.Helper()
+
+	profiles, err := s.GetProfileData(sessionID)
+	if err != nil {
+		t.Fatalf("GetProfileData: %v", err)
+	}
+	var payloads []string
+	for _, p := range profiles {
+		payloads = append(payloads, string(p.Data))
+	}
+	return payloads
+}
+
+func TestManifestDeduplication(t *testing.T) {
+	dir := t.TempDir()
+	store := openFileStorage(t, dir)
+	blobs := filepath.Join(dir, "profiles", "s1", "blobs")
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	profiles := []*types.ProfileData{
+		{SessionID: "s1", Type: types.ProfileTypeHeap, Timestamp: start, Data: []byte("same")},
+		{SessionID: "s1", Type: types.ProfileTypeHeap, Timestamp: start.Add(time.Minute), Data: []byte("same")},
+		{SessionID: "s1", Type: types.ProfileTypeCPU, Timestamp: start.Add(2 * time.Minute), Data: []byte("other")},
+	}
+	for _, p := range profiles {
+		if err := store.SaveProfileData(p); err != nil {
+			t.Fatalf("SaveProfileData: %v", err)
+		}
+	}
+
+	// Identical payloads share one blob
+	if names := dirNames(t, blobs); len(names) != 2 {
+		t.Errorf("blobs = %v, want 2", names)
+	}
+
+	// The shared blob stays until its last profile is deleted
+	if err := store.DeleteProfileData("s1", profiles[0].ID); err != nil {
+		t.Fatalf("DeleteProfileData: %v", err)
+	}
+	if names := dirNames(t, blobs); len(names) != 2 {
+		t.Errorf("blobs after deleting one sharer = %v, want 2", names)
+	}
+	if got, want := profilePayloads(t, store, "s1"), []string{"same", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("payloads = %v, want %v", got, want)
+	}
+
+	if err := store.DeleteProfileData("s1", profiles[1].ID); err != nil {
+		t.Fatalf("DeleteProfileData: %v", err)
+	}
+	if names := dirNames(t, blobs); len(names) != 1 {
+		t.Errorf("blobs after deleting both sharers = %v, want 1", names)
+	}
+}
+
+func TestManifestInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	store := openFileStorage(t, dir)
+	manifest := filepath.Join(dir, "profiles", "s1", "manifest.jsonl")
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	save := func(s storage.Storage, payload string, at time.Duration) {
+		t.Helper()
+		if err := s.SaveProfileData(&types.ProfileData{SessionID: "s1", Type: types.ProfileTypeCPU, Timestamp: start.Add(at), Data: []byte(payload)}); err != nil {
+			t.Fatalf("SaveProfileData: %v", err)
+		}
+	}
+	save(store, "first", 0)
+
+	// A record cut short by a crash is skipped and does not swallow the next
+	f, err := os.OpenFile(manifest, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"torn","type":"cpu","timest`)
+	f.Close()
+
+	store = openFileStorage(t, dir)
+	save(store, "second", time.Second)
+
+	store = openFileStorage(t, dir)
+	if got, want := profilePayloads(t, store, "s1"), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("payloads = %v, want %v", got, want)
+	}
+}
+
+// writeLegacyProfile stores a profile in the one file per profile layout
+// that predates manifests
+func writeLegacyProfile(t *testing.T, profileDir, name string, meta map[string]interface{}, payload string) {
+	t.Helper()
+
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(profileDir, name+".meta.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if payload != "" {
+		if err := os.WriteFile(filepath.Join(profileDir, name+".pprof"), []byte(payload), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLegacyProfileMigration(t *testing.T) {
+	dir := t.TempDir()
+	store := openFileStorage(t, dir)
+	if err := store.SaveSession(&types.ProfileSession{ID: "s1", ApplicationID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	profileDir := filepath.Join(dir, "profiles", "s1")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeLegacyProfile(t, profileDir, "cpu_2", map[string]interface{}{
+		"type": "cpu", "timestamp": start.Add(time.Minute), "sample_rate": 100, "labels": map[string]string{"pod": "p1"}, "file": "cpu_2.pprof",
+	}, "newer")
+	writeLegacyProfile(t, profileDir, "cpu_1", map[string]interface{}{
+		"type": "cpu", "timestamp": start, "file": "cpu_1.pprof",
+	}, "older")
+	// Metadata whose payload is missing or outside the directory stays put
+	writeLegacyProfile(t, profileDir, "heap_1", map[string]interface{}{
+		"type": "heap", "timestamp": start, "file": "heap_1.pprof",
+	}, "")
+	writeLegacyProfile(t, profileDir, "heap_2", map[string]interface{}{
+		"type": "heap", "timestamp": start, "file": "../heap_2.pprof",
+	}, "")
+
+	store = openFileStorage(t, dir)
+	want := []string{"blobs", "heap_1.meta.json", "heap_2.meta.json", "manifest.jsonl"}
+	if names := dirNames(t, profileDir); !reflect.DeepEqual(names, want) {
+		t.Errorf("session directory after migration = %v, want %v", names, want)
+	}
+
+	profiles, err := store.QueryProfileData(storage.ProfileQuery{ApplicationID: "app", Labels: types.Labels{"pod": "p1"}})
+	if err != nil {
+		t.Fatalf("QueryProfileData: %v", err)
+	}
+	if len(profiles) != 1 || string(profiles[0].Data) != "newer" || profiles[0].SampleRate != 100 || profiles[0].ID == "" {
+		t.Errorf("migrated profiles matching pod=p1 = %+v, want the newer one", profiles)
+	}
+
+	// Reopening does not migrate twice
+	store = openFileStorage(t, dir)
+	if got, want := profilePayloads(t, store, "s1"), []string{"older", "newer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("payloads = %v, want %v", got, want)
+	}
+}
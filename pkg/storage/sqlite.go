@@ -0,0 +1,672 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+
+	// Pure Go SQLite driver, registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id             TEXT PRIMARY KEY,
+	application_id TEXT NOT NULL,
+	labels         TEXT,
+	data           TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_application ON sessions (application_id);
+
+CREATE TABLE IF NOT EXISTS profiles (
+	session_id   TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	type         TEXT NOT NULL,
+	timestamp    INTEGER NOT NULL,
+	sample_rate  INTEGER NOT NULL,
+	sample_count INTEGER NOT NULL,
+	labels       TEXT,
+	metadata     TEXT,
+	size         INTEGER NOT NULL,
+	digest       TEXT NOT NULL,
+	PRIMARY KEY (session_id, id)
+);
+CREATE INDEX IF NOT EXISTS profiles_timestamp ON profiles (timestamp);
+CREATE INDEX IF NOT EXISTS profiles_digest ON profiles (digest);
+
+CREATE TABLE IF NOT EXISTS blobs (
+	digest TEXT PRIMARY KEY,
+	data   BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS metrics (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL,
+	data       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_session ON metrics (session_id);
+`
+
+// SQLiteStorage implements Storage on an embedded SQLite database. Sessions,
+// profile metadata and metrics live in indexed tables, so listing sessions
+// and querying an application's profiles do not read every record; profile
+// payloads are stored once per content hash in the blobs table.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage opens, creating it if needed, the SQLite database at path
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	// WAL lets readers proceed while a profile is written; writers wait for
+	// each other instead of failing with SQLITE_BUSY
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStorage{db: db}, nil
+}
+
+// migrateSQLite creates the schema, moving profiles stored by earlier
+// versions, which kept payloads inline and named profiles by second, into
+// the blobs table
+func migrateSQLite(db *sql.DB) error {
+	var legacy int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('profiles') WHERE name = 'name'`).Scan(&legacy)
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if legacy > 0 {
+		if _, err := tx.Exec(`DROP INDEX IF EXISTS profiles_timestamp;
+			ALTER TABLE profiles RENAME TO legacy_profiles`); err != nil {
+			return fmt.Errorf("failed to migrate profiles: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(sqliteSchema); err != nil {
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	if legacy > 0 {
+		rows, err := tx.Query(`SELECT session_id, type, timestamp, sample_rate, sample_count, labels, metadata, data
+			FROM legacy_profiles`)
+		if err != nil {
+			return fmt.Errorf("failed to migrate profiles: %w", err)
+		}
+
+		var profiles []*types.ProfileData
+		for rows.Next() {
+			var (
+				p           types.ProfileData
+				profileType string
+				timestamp   int64
+				labels      sql.NullString
+				metadata    sql.NullString
+			)
+			if err := rows.Scan(&p.SessionID, &profileType, &timestamp, &p.SampleRate, &p.SampleCount, &labels, &metadata, &p.Data); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to migrate profiles: %w", err)
+			}
+			p.Type = types.ProfileType(profileType)
+			p.Timestamp = time.Unix(0, timestamp).UTC()
+			// Unreadable labels and metadata are dropped rather than the profile
+			p.Labels, _ = unmarshalLabels(labels)
+			if metadata.Valid {
+				json.Unmarshal([]byte(metadata.String), &p.Metadata)
+			}
+			profiles = append(profiles, &p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to migrate profiles: %w", err)
+		}
+
+		for _, p := range profiles {
+			if err := insertProfile(tx, p); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DROP TABLE legacy_profiles`); err != nil {
+			return fmt.Errorf("failed to migrate profiles: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStorage) SaveSession(session *types.ProfileSession) error {
+	if err := validateIDs(session.ID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	labels, err := marshalLabels(session.Labels)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO sessions (id, application_id, labels, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET application_id = excluded.application_id, labels = excluded.labels, data = excluded.data`,
+		session.ID, session.ApplicationID, labels, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetSession(sessionID string) (*types.ProfileSession, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return nil, err
+	}
+
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE id = ?`, sessionID).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("session not found: %s", sessionID)
+		}
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	var session types.ProfileSession
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+
+	return &session, nil
+}
+
+func (s *SQLiteStorage) ListSessions(applicationID string) ([]*types.ProfileSession, error) {
+	query := `SELECT data FROM sessions ORDER BY id`
+	var args []interface{}
+	if applicationID != "" {
+		query = `SELECT data FROM sessions WHERE application_id = ? ORDER BY id`
+		args = append(args, applicationID)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []*types.ProfileSession{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read session: %w", err)
+		}
+
+		var session types.ProfileSession
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			// Skip corrupt records like FileStorage does
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (s *SQLiteStorage) DeleteSession(sessionID string) error {
+	if err := validateIDs(sessionID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"sessions", "profiles", "metrics"} {
+		column := "session_id"
+		if table == "sessions" {
+			column = "id"
+		}
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+column+` = ?`, sessionID); err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE NOT EXISTS (SELECT 1 FROM profiles p WHERE p.digest = blobs.digest)`); err != nil {
+		return fmt.Errorf("failed to delete profile data: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// SaveProfileData stores the profile's payload in the blobs table, shared
+// with identical payloads, and sets data.ID. Saving a profile already stored
+// with the same type, timestamp and payload keeps the stored one.
+func (s *SQLiteStorage) SaveProfileData(data *types.ProfileData) error {
+	if err := validateIDs(data.SessionID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertProfile(tx, data); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save profile data: %w", err)
+	}
+	return nil
+}
+
+// insertProfile stores a profile and its blob within a transaction
+func insertProfile(tx *sql.Tx, data *types.ProfileData) error {
+	labels, err := marshalLabels(data.Labels)
+	if err != nil {
+		return err
+	}
+
+	var metadata interface{}
+	if data.Metadata != nil {
+		metaBytes, err := json.Marshal(data.Metadata)
+		if err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+		metadata = string(metaBytes)
+	}
+
+	payload := data.Data
+	if payload == nil {
+		payload = []byte{}
+	}
+	sum := digest(payload)
+	id := profileID(data, sum)
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO blobs (digest, data) VALUES (?, ?)`, sum, payload); err != nil {
+		return fmt.Errorf("failed to save profile data: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO profiles
+		(session_id, id, type, timestamp, sample_rate, sample_count, labels, metadata, size, digest)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		data.SessionID, id, string(data.Type), data.Timestamp.UnixNano(), data.SampleRate,
+		data.SampleCount, labels, metadata, len(payload), sum)
+	if err != nil {
+		return fmt.Errorf("failed to save profile data: %w", err)
+	}
+
+	data.ID = id
+	return nil
+}
+
+// DeleteProfileData removes a profile, and its blob once no other profile
+// shares it
+func (s *SQLiteStorage) DeleteProfileData(sessionID, profileID string) error {
+	if err := validateIDs(sessionID, profileID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var sum string
+	err = tx.QueryRow(`DELETE FROM profiles WHERE session_id = ? AND id = ? RETURNING digest`, sessionID, profileID).Scan(&sum)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete profile data: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE digest = ? AND NOT EXISTS (SELECT 1 FROM profiles WHERE digest = ?)`, sum, sum); err != nil {
+		return fmt.Errorf("failed to delete profile data: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete profile data: %w", err)
+	}
+	return nil
+}
+
+// profileColumns are the columns read by scanProfile
+const profileColumns = `p.id, p.session_id, p.type, p.timestamp, p.sample_rate, p.sample_count, p.size, p.labels, p.metadata, b.data`
+
+// profileMetadataColumns are profileColumns without the payload
+const profileMetadataColumns = `p.id, p.session_id, p.type, p.timestamp, p.sample_rate, p.sample_count, p.size, p.labels, p.metadata, NULL`
+
+func (s *SQLiteStorage) GetProfileData(sessionID string) ([]*types.ProfileData, error) {
+	return s.readProfiles(`SELECT `+profileColumns+` FROM profiles p
+		JOIN blobs b ON b.digest = p.digest
+		WHERE p.session_id = ? ORDER BY p.timestamp, p.id`, sessionID)
+}
+
+func (s *SQLiteStorage) ListProfiles(sessionID string) ([]*types.ProfileData, error) {
+	return s.readProfiles(`SELECT `+profileMetadataColumns+` FROM profiles p
+		WHERE p.session_id = ? ORDER BY p.timestamp, p.id`, sessionID)
+}
+
+func (s *SQLiteStorage) readProfiles(query, sessionID string) ([]*types.ProfileData, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(query, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile data: %w", err)
+	}
+	defer rows.Close()
+
+	profiles := []*types.ProfileData{}
+	for rows.Next() {
+		profileData, err := scanProfile(rows)
+		if err != nil {
+			// Skip unreadable records like FileStorage does
+			continue
+		}
+		profiles = append(profiles, profileData)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile data: %w", err)
+	}
+	return profiles, nil
+}
+
+// QueryProfileData selects the application's profiles through the sessions
+// and timestamp indexes. Labels are matched after the lookup since they are
+// the session's labels overridden by the profile's own.
+func (s *SQLiteStorage) QueryProfileData(query ProfileQuery) ([]*types.ProfileData, error) {
+	var sb strings.Builder
+	if query.MetadataOnly {
+		sb.WriteString(`SELECT ` + profileMetadataColumns + `, s.labels FROM profiles p`)
+	} else {
+		sb.WriteString(`SELECT ` + profileColumns + `, s.labels FROM profiles p
+		JOIN blobs b ON b.digest = p.digest`)
+	}
+	sb.WriteString(`
+		JOIN sessions s ON s.id = p.session_id
+		WHERE s.application_id = ?`)
+	args := []interface{}{query.ApplicationID}
+
+	if query.Type != "" {
+		sb.WriteString(` AND p.type = ?`)
+		args = append(args, string(query.Type))
+	}
+	if !query.From.IsZero() {
+		sb.WriteString(` AND p.timestamp >= ?`)
+		args = append(args, query.From.UnixNano())
+	}
+	if !query.To.IsZero() {
+		sb.WriteString(` AND p.timestamp <= ?`)
+		args = append(args, query.To.UnixNano())
+	}
+	sb.WriteString(` ORDER BY p.timestamp, p.session_id, p.id`)
+
+	rows, err := s.db.Query(sb.String(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile data: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []*types.ProfileData
+	for rows.Next() {
+		var sessionLabels sql.NullString
+		profileData, err := scanProfile(rows, &sessionLabels)
+		if err != nil {
+			continue
+		}
+
+		if len(query.Labels) > 0 {
+			labels, err := unmarshalLabels(sessionLabels)
+			if err != nil {
+				continue
+			}
+			if !types.MergeLabels(labels, profileData.Labels).Matches(query.Labels) {
+				continue
+			}
+		}
+		profiles = append(profiles, profileData)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query profile data: %w", err)
+	}
+	return profiles, nil
+}
+
+func (s *SQLiteStorage) GetProfile(sessionID, profileID string) (*types.ProfileData, error) {
+	if err := validateIDs(sessionID, profileID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT `+profileColumns+` FROM profiles p
+		JOIN blobs b ON b.digest = p.digest
+		WHERE p.session_id = ? AND p.id = ?`, sessionID, profileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile data: %w", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read profile data: %w", err)
+		}
+		return nil, fmt.Errorf("%w: %s/%s", ErrProfileNotFound, sessionID, profileID)
+	}
+	return scanProfile(rows)
+}
+
+// scanProfile reads a row selected with profileColumns, followed by any
+// extra destinations
+func scanProfile(rows *sql.Rows, extra ...interface{}) (*types.ProfileData, error) {
+	var (
+		profileData types.ProfileData
+		profileType string
+		timestamp   int64
+		labels      sql.NullString
+		metadata    sql.NullString
+	)
+
+	dest := []interface{}{
+		&profileData.ID, &profileData.SessionID, &profileType, &timestamp, &profileData.SampleRate,
+		&profileData.SampleCount, &profileData.Size, &labels, &metadata, &profileData.Data,
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, fmt.Errorf("failed to read profile data: %w", err)
+	}
+
+	profileData.Type = types.ProfileType(profileType)
+	profileData.Timestamp = time.Unix(0, timestamp).UTC()
+
+	var err error
+	if profileData.Labels, err = unmarshalLabels(labels); err != nil {
+		return nil, err
+	}
+
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &profileData.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+		}
+	}
+
+	return &profileData, nil
+}
+
+func (s *SQLiteStorage) SaveMetrics(sessionID string, metrics *types.MetricsSnapshot) error {
+	if err := validateIDs(sessionID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metrics: %w", err)
+	}
+
+	if _, err := s.db.Exec(`INSERT INTO metrics (session_id, data) VALUES (?, ?)`, sessionID, string(data)); err != nil {
+		return fmt.Errorf("failed to save metrics: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetMetrics(sessionID string) ([]*types.MetricsSnapshot, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT data FROM metrics WHERE session_id = ? ORDER BY id`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
+	defer rows.Close()
+
+	metrics := []*types.MetricsSnapshot{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read metrics: %w", err)
+		}
+
+		var m types.MetricsSnapshot
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			continue
+		}
+		metrics = append(metrics, &m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
+	return metrics, nil
+}
+
+// DeleteMetrics removes the snapshots taken before the given time. Snapshots
+// are stored as JSON, so their timestamps are compared after decoding. The
+// read and the deletes share one write transaction.
+func (s *SQLiteStorage) DeleteMetrics(sessionID string, before time.Time) (int, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, data FROM metrics WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read metrics: %w", err)
+	}
+
+	var expired []int64
+	for rows.Next() {
+		var (
+			id   int64
+			data string
+		)
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read metrics: %w", err)
+		}
+
+		var m types.MetricsSnapshot
+		if err := json.Unmarshal([]byte(data), &m); err != nil || m.Timestamp.Before(before) {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read metrics: %w", err)
+	}
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	removed := 0
+	for _, id := range expired {
+		result, err := tx.Exec(`DELETE FROM metrics WHERE id = ?`, id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete metrics: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete metrics: %w", err)
+		}
+		removed += int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to delete metrics: %w", err)
+	}
+	return removed, nil
+}
+
+// marshalLabels encodes labels for a labels column, NULL when empty
+func marshalLabels(labels types.Labels) (interface{}, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal labels: %w", err)
+	}
+	return string(data), nil
+}
+
+func unmarshalLabels(column sql.NullString) (types.Labels, error) {
+	if !column.Valid || column.String == "" {
+		return nil, nil
+	}
+	var labels types.Labels
+	if err := json.Unmarshal([]byte(column.String), &labels); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal labels: %w", err)
+	}
+	return labels, nil
+}
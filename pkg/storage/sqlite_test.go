@@ -0,0 +1,104 @@
+package storage_test
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/storage/storagetest"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+func openSQLite(t *testing.T, path string) *storage.SQLiteStorage {
+	t.Helper()
+
+	store, err := storage.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// corruptSQLiteProfiles replaces the metadata of a session's profiles with
+// invalid JSON through a separate connection
+func corruptSQLiteProfiles(path string) func(sessionID string) error {
+	return func(sessionID string) error {
+		db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		_, err = db.Exec(`UPDATE profiles SET metadata = '{' WHERE session_id = ?`, sessionID)
+		return err
+	}
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "profiler.db")
+		return storagetest.Backend{
+			Storage: openSQLite(t, path),
+			Corrupt: corruptSQLiteProfiles(path),
+			Dir:     dir,
+		}
+	})
+}
+
+// TestSQLiteSharedDatabase writes through two handles on the same database,
+// as a restarted server overlapping its predecessor would, so that writers
+// contend for the database lock across connection pools
+func TestSQLiteSharedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiler.db")
+	stores := []*storage.SQLiteStorage{openSQLite(t, path), openSQLite(t, path)}
+
+	const profiles = 40
+	if err := stores[0].SaveSession(&types.ProfileSession{ID: "s", ApplicationID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, profiles*2)
+	for i := 0; i < profiles; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			store := stores[i%len(stores)]
+			timestamp := time.Unix(int64(i), 0).UTC()
+			errs <- store.SaveProfileData(&types.ProfileData{
+				SessionID: "s",
+				Type:      types.ProfileTypeCPU,
+				Timestamp: timestamp,
+				Data:      bytes.Repeat([]byte(fmt.Sprint(i)), 16*1024),
+			})
+			errs <- store.SaveMetrics("s", &types.MetricsSnapshot{Timestamp: timestamp})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write: %v", err)
+		}
+	}
+
+	for i, store := range stores {
+		got, err := store.ListProfiles("s")
+		if err != nil || len(got) != profiles {
+			t.Errorf("store %d: ListProfiles got %d profiles, err %v", i, len(got), err)
+		}
+		metrics, err := store.GetMetrics("s")
+		if err != nil || len(metrics) != profiles {
+			t.Errorf("store %d: GetMetrics got %d snapshots, err %v", i, len(metrics), err)
+		}
+	}
+}
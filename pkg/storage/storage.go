@@ -3,6 +3,7 @@ package storage
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,38 +14,95 @@ import (
 	"github.com/King-kin5/analysis/pkg/types"
 )
 
-// Storage defines the interface for storing profiling data
+// Storage defines the interface for storing profiling data. Every method
+// taking a session or profile ID returns an error wrapping
+// types.ErrInvalidID when the ID does not pass types.ValidateID.
 type Storage interface {
 	SaveSession(session *types.ProfileSession) error
 	GetSession(sessionID string) (*types.ProfileSession, error)
 	ListSessions(applicationID string) ([]*types.ProfileSession, error)
 	DeleteSession(sessionID string) error
 
+	// SaveProfileData stores a profile and sets data.ID to the ID it is
+	// stored under, unique within the session
 	SaveProfileData(data *types.ProfileData) error
 	GetProfileData(sessionID string) ([]*types.ProfileData, error)
+	// ListProfiles returns a session's profiles like GetProfileData, without
+	// reading their payloads
+	ListProfiles(sessionID string) ([]*types.ProfileData, error)
+	// GetProfile returns one profile by ID, or an error wrapping
+	// ErrProfileNotFound
+	GetProfile(sessionID, profileID string) (*types.ProfileData, error)
+	QueryProfileData(query ProfileQuery) ([]*types.ProfileData, error)
+	// DeleteProfileData removes one profile by ID. Deleting a missing profile
+	// is not an error.
+	DeleteProfileData(sessionID, profileID string) error
 
 	SaveMetrics(sessionID string, metrics *types.MetricsSnapshot) error
 	GetMetrics(sessionID string) ([]*types.MetricsSnapshot, error)
+	// DeleteMetrics removes a session's snapshots taken before the given time
+	// and returns how many it removed
+	DeleteMetrics(sessionID string, before time.Time) (int, error)
+}
+
+// validateIDs checks the session and profile IDs a method is called with, so
+// that no ID can name a path outside the storage
+func validateIDs(ids ...string) error {
+	for _, id := range ids {
+		if err := types.ValidateID(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrProfileNotFound is returned when a profile ID is not stored
+var ErrProfileNotFound = errors.New("profile not found")
+
+// ProfileQuery selects the profiles of an application recorded within
+// [From, To], oldest first. An empty Type selects every type and a zero bound
+// leaves that side of the range open. Labels match against the profile's
+// labels on top of its session's.
+type ProfileQuery struct {
+	ApplicationID string
+	Type          types.ProfileType
+	From          time.Time
+	To            time.Time
+	Labels        types.Labels
+	// MetadataOnly leaves out the payloads, as ListProfiles does
+	MetadataOnly bool
 }
 
 // FileStorage implements Storage using the filesystem
 type FileStorage struct {
 	basePath string
 	mu       sync.RWMutex
+	index    *profileIndex
 }
 
-// NewFileStorage creates a new file based storage
+// NewFileStorage creates a new file based storage. The profile index is
+// rebuilt from the files on disk.
 func NewFileStorage(basePath string) (*FileStorage, error) {
 	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create base directory: %w", err)
 	}
 
-	return &FileStorage{
+	fs := &FileStorage{
 		basePath: basePath,
-	}, nil
+		index:    newProfileIndex(),
+	}
+	if err := fs.buildIndex(); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
 }
 
 func (fs *FileStorage) SaveSession(session *types.ProfileSession) error {
+	if err := validateIDs(session.ID); err != nil {
+		return err
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -63,10 +121,15 @@ func (fs *FileStorage) SaveSession(session *types.ProfileSession) error {
 		return fmt.Errorf("failed to write session file: %w", err)
 	}
 
+	fs.index.setSession(session.ID, session.ApplicationID, session.Labels)
 	return nil
 }
 
 func (fs *FileStorage) GetSession(sessionID string) (*types.ProfileSession, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return nil, err
+	}
+
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
@@ -127,6 +190,10 @@ func (fs *FileStorage) ListSessions(applicationID string) ([]*types.ProfileSessi
 }
 
 func (fs *FileStorage) DeleteSession(sessionID string) error {
+	if err := validateIDs(sessionID); err != nil {
+		return err
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -148,113 +215,241 @@ func (fs *FileStorage) DeleteSession(sessionID string) error {
 		return fmt.Errorf("failed to delete metrics directory: %w", err)
 	}
 
+	fs.index.removeSession(sessionID)
 	return nil
 }
 
+// SaveProfileData stores a profile's payload under its content hash and
+// records it in the session's manifest, setting data.ID. Saving a profile
+// already stored with the same type, timestamp and payload keeps the stored
+// one.
 func (fs *FileStorage) SaveProfileData(data *types.ProfileData) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	if err := validateIDs(data.SessionID); err != nil {
+		return err
+	}
 
 	profileDir := filepath.Join(fs.basePath, "profiles", data.SessionID)
-	if err := os.MkdirAll(profileDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(profileDir, blobsDir), 0755); err != nil {
 		return fmt.Errorf("failed to create profile directory: %w", err)
 	}
 
-	// Save the profile data
-	timestamp := data.Timestamp.Format("20060102_150405")
-	filename := fmt.Sprintf("%s_%s.pprof", data.Type, timestamp)
-	profilePath := filepath.Join(profileDir, filename)
+	record := newProfileRecord(data, digest(data.Data))
 
-	if err := os.WriteFile(profilePath, data.Data, 0644); err != nil {
+	// Payloads such as execution traces can be tens of MB, so they are
+	// written to a temporary file without holding the lock and renamed into
+	// place once complete
+	tmpPath, err := writeTempFile(filepath.Join(profileDir, blobsDir), data.Data)
+	if err != nil {
 		return fmt.Errorf("failed to write profile data: %w", err)
 	}
+	defer os.Remove(tmpPath)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	// Save metadata
-	metaFilename := fmt.Sprintf("%s_%s.meta.json", data.Type, timestamp)
-	metaPath := filepath.Join(profileDir, metaFilename)
+	data.ID = record.ID
+	if fs.index.has(data.SessionID, record.ID) {
+		return nil
+	}
+
+	// An existing blob has the same content, so replacing it is harmless
+	if err := os.Rename(tmpPath, blobPath(profileDir, record.Digest)); err != nil {
+		return fmt.Errorf("failed to write profile data: %w", err)
+	}
 
-	metaData := map[string]interface{}{
-		"session_id":   data.SessionID,
-		"type":         data.Type,
-		"timestamp":    data.Timestamp,
-		"sample_rate":  data.SampleRate,
-		"sample_count": data.SampleCount,
-		"metadata":     data.Metadata,
-		"file":         filename,
+	if err := appendManifest(profileDir, record); err != nil {
+		return err
 	}
 
-	metaBytes, err := json.MarshalIndent(metaData, "", "  ")
+	fs.index.add(indexEntry{
+		sessionID:   data.SessionID,
+		profileType: data.Type,
+		timestamp:   data.Timestamp,
+		labels:      data.Labels,
+		id:          record.ID,
+	})
+	return nil
+}
+
+// DeleteProfileData removes a profile from its session's manifest, and its
+// blob once no other profile of the session shares it
+func (fs *FileStorage) DeleteProfileData(sessionID, profileID string) error {
+	if err := validateIDs(sessionID, profileID); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	profileDir := filepath.Join(fs.basePath, "profiles", sessionID)
+	records, err := readManifest(profileDir)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
+		return err
+	}
+
+	var (
+		kept    []*profileRecord
+		removed *profileRecord
+	)
+	for _, record := range records {
+		if record.ID == profileID {
+			removed = record
+			continue
+		}
+		kept = append(kept, record)
 	}
 
-	if err := os.WriteFile(metaPath, metaBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata: %w", err)
+	fs.index.remove(sessionID, profileID)
+	if removed == nil {
+		return nil
 	}
 
+	if len(kept) == 0 {
+		if err := os.RemoveAll(profileDir); err != nil {
+			return fmt.Errorf("failed to delete profile directory: %w", err)
+		}
+		return nil
+	}
+
+	if err := writeManifest(profileDir, kept); err != nil {
+		return err
+	}
+
+	for _, record := range kept {
+		if record.Digest == removed.Digest {
+			return nil
+		}
+	}
+	if err := os.Remove(blobPath(profileDir, removed.Digest)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete profile data: %w", err)
+	}
 	return nil
 }
 
+// writeTempFile writes data to a new temporary file in dir and returns its path
+func writeTempFile(dir string, data []byte) (string, error) {
+	f, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// GetProfileData returns the profiles listed in the session's manifest,
+// oldest first. Profiles whose blob cannot be read are skipped.
 func (fs *FileStorage) GetProfileData(sessionID string) ([]*types.ProfileData, error) {
+	return fs.readProfiles(sessionID, true)
+}
+
+// ListProfiles returns the profiles listed in the session's manifest
+// without reading their blobs
+func (fs *FileStorage) ListProfiles(sessionID string) ([]*types.ProfileData, error) {
+	return fs.readProfiles(sessionID, false)
+}
+
+func (fs *FileStorage) readProfiles(sessionID string, withData bool) ([]*types.ProfileData, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return nil, err
+	}
+
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
 	profileDir := filepath.Join(fs.basePath, "profiles", sessionID)
-	entries, err := os.ReadDir(profileDir)
+	records, err := readManifest(profileDir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []*types.ProfileData{}, nil
-		}
-		return nil, fmt.Errorf("failed to read profile directory: %w", err)
+		return nil, err
 	}
 
-	var profiles []*types.ProfileData
-	for _, entry := range entries {
-		// Only process metadata files
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta.json") {
-			continue
-		}
-
-		metaPath := filepath.Join(profileDir, entry.Name())
-		metaBytes, err := os.ReadFile(metaPath)
+	profiles := []*types.ProfileData{}
+	for _, record := range records {
+		profileData, err := record.profileData(profileDir, sessionID, withData)
 		if err != nil {
 			continue
 		}
+		profiles = append(profiles, profileData)
+	}
 
-		var meta map[string]interface{}
-		if err := json.Unmarshal(metaBytes, &meta); err != nil {
-			continue
-		}
+	return profiles, nil
+}
 
-		// Read the actual profile data
-		profileFile, ok := meta["file"].(string)
-		if !ok {
+// GetProfile returns one profile of a session by ID
+func (fs *FileStorage) GetProfile(sessionID, profileID string) (*types.ProfileData, error) {
+	if err := validateIDs(sessionID, profileID); err != nil {
+		return nil, err
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	profileDir := filepath.Join(fs.basePath, "profiles", sessionID)
+	records, err := readManifest(profileDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if record.ID != profileID {
 			continue
 		}
-
-		profilePath := filepath.Join(profileDir, profileFile)
-		profileBytes, err := os.ReadFile(profilePath)
+		profileData, err := record.profileData(profileDir, sessionID, true)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to read profile data: %w", err)
 		}
+		return profileData, nil
+	}
 
-		timestamp, _ := time.Parse(time.RFC3339, meta["timestamp"].(string))
-		profileData := &types.ProfileData{
-			SessionID:   sessionID,
-			Type:        types.ProfileType(meta["type"].(string)),
-			Timestamp:   timestamp,
-			Data:        profileBytes,
-			SampleCount: int64(meta["sample_count"].(float64)),
-		}
+	return nil, fmt.Errorf("%w: %s/%s", ErrProfileNotFound, sessionID, profileID)
+}
 
-		if sampleRate, ok := meta["sample_rate"].(float64); ok {
-			profileData.SampleRate = int(sampleRate)
-		}
+// QueryProfileData returns the profiles matching the query using the
+// in-memory index, reading only the manifests and, unless the query asks for
+// metadata only, the blobs of the matches
+func (fs *FileStorage) QueryProfileData(query ProfileQuery) ([]*types.ProfileData, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 
-		if metadata, ok := meta["metadata"].(map[string]interface{}); ok {
-			profileData.Metadata = metadata
+	manifests := make(map[string]map[string]*profileRecord)
+	var profiles []*types.ProfileData
+	for _, entry := range fs.index.query(query) {
+		profileDir := filepath.Join(fs.basePath, "profiles", entry.sessionID)
+
+		records, ok := manifests[entry.sessionID]
+		if !ok {
+			list, err := readManifest(profileDir)
+			if err != nil {
+				continue
+			}
+			records = make(map[string]*profileRecord, len(list))
+			for _, record := range list {
+				records[record.ID] = record
+			}
+			manifests[entry.sessionID] = records
 		}
 
+		record, ok := records[entry.id]
+		if !ok {
+			continue
+		}
+		profileData, err := record.profileData(profileDir, entry.sessionID, !query.MetadataOnly)
+		if err != nil {
+			continue
+		}
 		profiles = append(profiles, profileData)
 	}
 
@@ -262,6 +457,10 @@ func (fs *FileStorage) GetProfileData(sessionID string) ([]*types.ProfileData, e
 }
 
 func (fs *FileStorage) SaveMetrics(sessionID string, metrics *types.MetricsSnapshot) error {
+	if err := validateIDs(sessionID); err != nil {
+		return err
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -290,8 +489,71 @@ func (fs *FileStorage) SaveMetrics(sessionID string, metrics *types.MetricsSnaps
 	return nil
 }
 
+// DeleteMetrics rewrites a session's metrics file without the snapshots
+// taken before the given time. Lines that cannot be parsed are dropped too.
+// The lock is held from the read to the rewrite, so no snapshot appended in
+// between is lost.
+func (fs *FileStorage) DeleteMetrics(sessionID string, before time.Time) (int, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return 0, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	metricsDir := filepath.Join(fs.basePath, "metrics", sessionID)
+	metricsFile := filepath.Join(metricsDir, "metrics.jsonl")
+	data, err := os.ReadFile(metricsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read metrics file: %w", err)
+	}
+
+	var kept []byte
+	removed := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var m types.MetricsSnapshot
+		if err := json.Unmarshal([]byte(line), &m); err != nil || m.Timestamp.Before(before) {
+			removed++
+			continue
+		}
+		kept = append(kept, line+"\n"...)
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if len(kept) == 0 {
+		if err := os.RemoveAll(metricsDir); err != nil {
+			return 0, fmt.Errorf("failed to delete metrics directory: %w", err)
+		}
+		return removed, nil
+	}
+
+	tmpPath, err := writeTempFile(metricsDir, kept)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := os.Rename(tmpPath, metricsFile); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to write metrics: %w", err)
+	}
+	return removed, nil
+}
+
 // GetMetrics reads metrics from JSONL file - FIXED VERSION
 func (fs *FileStorage) GetMetrics(sessionID string) ([]*types.MetricsSnapshot, error) {
+	if err := validateIDs(sessionID); err != nil {
+		return nil, err
+	}
+
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
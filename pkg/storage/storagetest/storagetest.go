@@ -0,0 +1,1046 @@
+// Package storagetest is a conformance suite for storage.Storage
+// implementations. A backend is validated by calling Run from its own test:
+//
+//	func TestFileStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+//			dir := t.TempDir()
+//			store, err := storage.NewFileStorage(dir)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return storagetest.Backend{Storage: store, Corrupt: storagetest.CorruptFileProfiles(dir), Dir: dir}
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/storage"
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Backend is a storage under test
+type Backend struct {
+	Storage storage.Storage
+	// Corrupt, when set, damages the stored metadata of every profile of a
+	// session so that reads have to skip them. The corruption tests are
+	// skipped without it.
+	Corrupt func(sessionID string) error
+	// Dir, when set, is the directory the backend keeps its files in. The
+	// invalid ID tests then also check that no file next to it or inside it
+	// is created, changed or removed.
+	Dir string
+}
+
+// Factory returns a new, empty backend. It is called once per test and
+// should register any cleanup with t.Cleanup.
+type Factory func(t *testing.T) Backend
+
+// Run runs the conformance suite against the backends created by factory
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, b Backend)
+	}{
+		{"SessionRoundTrip", testSessionRoundTrip},
+		{"SessionUpdate", testSessionUpdate},
+		{"MissingSession", testMissingSession},
+		{"ListSessions", testListSessions},
+		{"ProfileRoundTrip", testProfileRoundTrip},
+		{"ProfileIDs", testProfileIDs},
+		{"RepeatedUpload", testRepeatedUpload},
+		{"GetProfile", testGetProfile},
+		{"ListProfiles", testListProfiles},
+		{"ProfileKinds", testProfileKinds},
+		{"QueryProfileData", testQueryProfileData},
+		{"QueryLabels", testQueryLabels},
+		{"ProfilesBeforeSession", testProfilesBeforeSession},
+		{"Metrics", testMetrics},
+		{"DeleteProfile", testDeleteProfile},
+		{"DeleteMetrics", testDeleteMetrics},
+		{"DeleteMetricsWhileSaving", testDeleteMetricsWhileSaving},
+		{"DeleteCascade", testDeleteCascade},
+		{"DeleteMissing", testDeleteMissing},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"CorruptedProfiles", testCorruptedProfiles},
+		{"InvalidIDs", testInvalidIDs},
+		{"ValidIDs", testValidIDs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory(t))
+		})
+	}
+}
+
+// CorruptFileProfiles returns a Backend.Corrupt function for a FileStorage
+// rooted at basePath. It overwrites the session's manifest with invalid
+// JSON, leaving the last line unterminated.
+func CorruptFileProfiles(basePath string) func(sessionID string) error {
+	return func(sessionID string) error {
+		manifest := filepath.Join(basePath, "profiles", sessionID, "manifest.jsonl")
+		if _, err := os.Stat(manifest); err != nil {
+			return err
+		}
+		return os.WriteFile(manifest, []byte("{\n{\"id\":"), 0644)
+	}
+}
+
+// baseTime is the timestamp profiles are recorded relative to. It is whole
+// seconds so that every backend can represent it exactly.
+var baseTime = time.Date(2025, 1, 14, 14, 0, 0, 0, time.UTC)
+
+func at(seconds int) time.Time {
+	return baseTime.Add(time.Duration(seconds) * time.Second)
+}
+
+func saveSession(t *testing.T, s storage.Storage, id, applicationID string, labels types.Labels) *types.ProfileSession {
+	t.Helper()
+
+	session := &types.ProfileSession{
+		ID:            id,
+		ApplicationID: applicationID,
+		Name:          "session " + id,
+		Language:      "go",
+		StartTime:     baseTime,
+		EndTime:       baseTime.Add(time.Minute),
+		Duration:      time.Minute,
+		ProfileType:   types.ProfileTypeCPU,
+		Mode:          types.ProfileModeEmbedded,
+		Labels:        labels,
+		Metadata:      map[string]interface{}{"host": "test"},
+	}
+	if err := s.SaveSession(session); err != nil {
+		t.Fatalf("SaveSession(%s): %v", id, err)
+	}
+	return session
+}
+
+func saveProfile(t *testing.T, s storage.Storage, sessionID string, profileType types.ProfileType, timestamp time.Time, labels types.Labels) *types.ProfileData {
+	t.Helper()
+
+	data := &types.ProfileData{
+		SessionID:   sessionID,
+		Type:        profileType,
+		Timestamp:   timestamp,
+		Data:        []byte(fmt.Sprintf("%s/%s/%d", sessionID, profileType, timestamp.Unix())),
+		Labels:      labels,
+		Metadata:    map[string]interface{}{"source": "storagetest"},
+		SampleRate:  100,
+		SampleCount: 42,
+	}
+	if err := s.SaveProfileData(data); err != nil {
+		t.Fatalf("SaveProfileData(%s, %s): %v", sessionID, profileType, err)
+	}
+	return data
+}
+
+func getProfiles(t *testing.T, s storage.Storage, sessionID string) []*types.ProfileData {
+	t.Helper()
+
+	profiles, err := s.GetProfileData(sessionID)
+	if err != nil {
+		t.Fatalf("GetProfileData(%s): %v", sessionID, err)
+	}
+	return profiles
+}
+
+func query(t *testing.T, s storage.Storage, q storage.ProfileQuery) []*types.ProfileData {
+	t.Helper()
+
+	profiles, err := s.QueryProfileData(q)
+	if err != nil {
+		t.Fatalf("QueryProfileData(%+v): %v", q, err)
+	}
+	return profiles
+}
+
+func sessionIDs(sessions []*types.ProfileSession) map[string]bool {
+	ids := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		ids[session.ID] = true
+	}
+	return ids
+}
+
+// payloads returns the payloads of profiles in order, which identify them
+func payloads(profiles []*types.ProfileData) []string {
+	names := make([]string, len(profiles))
+	for i, p := range profiles {
+		names[i] = string(p.Data)
+	}
+	return names
+}
+
+func expectPayloads(t *testing.T, what string, profiles []*types.ProfileData, want ...*types.ProfileData) {
+	t.Helper()
+
+	got := payloads(profiles)
+	expected := payloads(want)
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("%s: got %q, want %q", what, got, expected)
+	}
+}
+
+func testSessionRoundTrip(t *testing.T, b Backend) {
+	want := saveSession(t, b.Storage, "s1", "app", types.Labels{"version": "1.4.2"})
+
+	got, err := b.Storage.GetSession("s1")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+
+	if got.ID != want.ID || got.ApplicationID != want.ApplicationID || got.Name != want.Name ||
+		got.Language != want.Language || got.ProfileType != want.ProfileType || got.Mode != want.Mode {
+		t.Errorf("session fields: got %+v, want %+v", got, want)
+	}
+	if !got.StartTime.Equal(want.StartTime) || !got.EndTime.Equal(want.EndTime) || got.Duration != want.Duration {
+		t.Errorf("session times: got %v-%v (%v), want %v-%v (%v)",
+			got.StartTime, got.EndTime, got.Duration, want.StartTime, want.EndTime, want.Duration)
+	}
+	if got.Labels.String() != want.Labels.String() {
+		t.Errorf("session labels: got %v, want %v", got.Labels, want.Labels)
+	}
+	if got.Metadata["host"] != "test" {
+		t.Errorf("session metadata: got %v", got.Metadata)
+	}
+}
+
+func testSessionUpdate(t *testing.T, b Backend) {
+	session := saveSession(t, b.Storage, "s1", "app", nil)
+
+	session.Name = "renamed"
+	session.ApplicationID = "other"
+	if err := b.Storage.SaveSession(session); err != nil {
+		t.Fatalf("SaveSession: %v", err)
+	}
+
+	got, err := b.Storage.GetSession("s1")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.Name != "renamed" || got.ApplicationID != "other" {
+		t.Errorf("updated session: got %+v", got)
+	}
+
+	sessions, err := b.Storage.ListSessions("")
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("ListSessions after update: got %d sessions, want 1", len(sessions))
+	}
+	if sessions, _ := b.Storage.ListSessions("app"); len(sessions) != 0 {
+		t.Errorf("ListSessions(app) after moving the session: got %d sessions, want 0", len(sessions))
+	}
+}
+
+func testMissingSession(t *testing.T, b Backend) {
+	if _, err := b.Storage.GetSession("missing"); err == nil {
+		t.Error("GetSession of a missing session: expected an error")
+	}
+
+	if profiles := getProfiles(t, b.Storage, "missing"); len(profiles) != 0 {
+		t.Errorf("GetProfileData of a missing session: got %d profiles", len(profiles))
+	}
+
+	metrics, err := b.Storage.GetMetrics("missing")
+	if err != nil {
+		t.Fatalf("GetMetrics of a missing session: %v", err)
+	}
+	if len(metrics) != 0 {
+		t.Errorf("GetMetrics of a missing session: got %d snapshots", len(metrics))
+	}
+}
+
+func testListSessions(t *testing.T, b Backend) {
+	sessions, err := b.Storage.ListSessions("")
+	if err != nil {
+		t.Fatalf("ListSessions on an empty storage: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("ListSessions on an empty storage: got %d sessions", len(sessions))
+	}
+
+	saveSession(t, b.Storage, "a1", "app-a", nil)
+	saveSession(t, b.Storage, "a2", "app-a", nil)
+	saveSession(t, b.Storage, "b1", "app-b", nil)
+
+	for _, tt := range []struct {
+		applicationID string
+		want          []string
+	}{
+		{"", []string{"a1", "a2", "b1"}},
+		{"app-a", []string{"a1", "a2"}},
+		{"app-b", []string{"b1"}},
+		{"app-c", nil},
+	} {
+		sessions, err := b.Storage.ListSessions(tt.applicationID)
+		if err != nil {
+			t.Fatalf("ListSessions(%q): %v", tt.applicationID, err)
+		}
+
+		ids := sessionIDs(sessions)
+		if len(ids) != len(tt.want) {
+			t.Errorf("ListSessions(%q): got %d sessions, want %v", tt.applicationID, len(ids), tt.want)
+			continue
+		}
+		for _, id := range tt.want {
+			if !ids[id] {
+				t.Errorf("ListSessions(%q): missing %s", tt.applicationID, id)
+			}
+		}
+	}
+}
+
+func testProfileRoundTrip(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	want := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), types.Labels{"pod": "p1"})
+
+	profiles := getProfiles(t, b.Storage, "s1")
+	if len(profiles) != 1 {
+		t.Fatalf("GetProfileData: got %d profiles, want 1", len(profiles))
+	}
+
+	got := profiles[0]
+	if got.SessionID != want.SessionID || got.Type != want.Type {
+		t.Errorf("profile identity: got %s/%s, want %s/%s", got.SessionID, got.Type, want.SessionID, want.Type)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("profile timestamp: got %v, want %v", got.Timestamp, want.Timestamp)
+	}
+	if !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("profile data: got %q, want %q", got.Data, want.Data)
+	}
+	if got.SampleRate != want.SampleRate || got.SampleCount != want.SampleCount {
+		t.Errorf("profile samples: got rate %d count %d, want rate %d count %d",
+			got.SampleRate, got.SampleCount, want.SampleRate, want.SampleCount)
+	}
+	if got.Labels.String() != want.Labels.String() {
+		t.Errorf("profile labels: got %v, want %v", got.Labels, want.Labels)
+	}
+	if got.Metadata["source"] != "storagetest" {
+		t.Errorf("profile metadata: got %v", got.Metadata)
+	}
+}
+
+func testProfileIDs(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	first := saveProfile(t, b.Storage, "s1", types.ProfileTypeHeap, at(0), nil)
+
+	// A second profile of the same type and second is kept alongside the first
+	second := &types.ProfileData{
+		SessionID: "s1",
+		Type:      types.ProfileTypeHeap,
+		Timestamp: at(0).Add(500 * time.Millisecond),
+		Data:      []byte("second"),
+	}
+	if err := b.Storage.SaveProfileData(second); err != nil {
+		t.Fatalf("SaveProfileData: %v", err)
+	}
+
+	if first.ID == "" || second.ID == "" || first.ID == second.ID {
+		t.Fatalf("profile IDs: got %q and %q, want distinct IDs", first.ID, second.ID)
+	}
+
+	profiles := getProfiles(t, b.Storage, "s1")
+	expectPayloads(t, "GetProfileData of two profiles in one second", profiles, first, second)
+	for i, want := range []*types.ProfileData{first, second} {
+		if i < len(profiles) && profiles[i].ID != want.ID {
+			t.Errorf("GetProfileData: profile %d has ID %q, want %q", i, profiles[i].ID, want.ID)
+		}
+	}
+
+	queried := query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"})
+	expectPayloads(t, "QueryProfileData of two profiles in one second", queried, first, second)
+	for _, p := range queried {
+		if p.ID == "" {
+			t.Errorf("QueryProfileData: profile %q has no ID", p.Data)
+		}
+	}
+}
+
+func testRepeatedUpload(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	first := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+
+	// The same upload retried is stored once
+	retried := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+	if retried.ID != first.ID {
+		t.Errorf("repeated upload: got ID %q, want %q", retried.ID, first.ID)
+	}
+	expectPayloads(t, "GetProfileData after a repeated upload", getProfiles(t, b.Storage, "s1"), first)
+
+	// The same payload at another time is a distinct profile
+	later := &types.ProfileData{SessionID: "s1", Type: types.ProfileTypeCPU, Timestamp: at(10), Data: first.Data}
+	if err := b.Storage.SaveProfileData(later); err != nil {
+		t.Fatalf("SaveProfileData: %v", err)
+	}
+	if later.ID == first.ID {
+		t.Errorf("identical payload at another time: got the ID of the first profile")
+	}
+	expectPayloads(t, "GetProfileData of identical payloads", getProfiles(t, b.Storage, "s1"), first, later)
+}
+
+func testGetProfile(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+	want := saveProfile(t, b.Storage, "s1", types.ProfileTypeHeap, at(10), types.Labels{"pod": "p1"})
+
+	got, err := b.Storage.GetProfile("s1", want.ID)
+	if err != nil {
+		t.Fatalf("GetProfile: %v", err)
+	}
+	if got.ID != want.ID || got.SessionID != "s1" || got.Type != want.Type || !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("GetProfile: got %s %s/%s at %v", got.ID, got.SessionID, got.Type, got.Timestamp)
+	}
+	if !bytes.Equal(got.Data, want.Data) || got.Labels.String() != want.Labels.String() {
+		t.Errorf("GetProfile: got data %q labels %v", got.Data, got.Labels)
+	}
+
+	for _, tt := range []struct{ sessionID, profileID string }{
+		{"s1", "missing"},
+		{"missing", want.ID},
+	} {
+		if _, err := b.Storage.GetProfile(tt.sessionID, tt.profileID); !errors.Is(err, storage.ErrProfileNotFound) {
+			t.Errorf("GetProfile(%s, %s): got %v, want ErrProfileNotFound", tt.sessionID, tt.profileID, err)
+		}
+	}
+}
+
+func testListProfiles(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	first := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), types.Labels{"pod": "p1"})
+	second := saveProfile(t, b.Storage, "s1", types.ProfileTypeHeap, at(10), nil)
+
+	listed, err := b.Storage.ListProfiles("s1")
+	if err != nil {
+		t.Fatalf("ListProfiles: %v", err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("ListProfiles: got %d profiles, want 2", len(listed))
+	}
+
+	for i, want := range []*types.ProfileData{first, second} {
+		got := listed[i]
+		if got.ID != want.ID || got.Type != want.Type || !got.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("ListProfiles: profile %d is %s %s at %v, want %s %s at %v",
+				i, got.ID, got.Type, got.Timestamp, want.ID, want.Type, want.Timestamp)
+		}
+		if got.Data != nil {
+			t.Errorf("ListProfiles: profile %d has a payload", i)
+		}
+		if got.Size != len(want.Data) {
+			t.Errorf("ListProfiles: profile %d has size %d, want %d", i, got.Size, len(want.Data))
+		}
+		if got.Labels.String() != want.Labels.String() || got.Metadata["source"] != "storagetest" {
+			t.Errorf("ListProfiles: profile %d has labels %v metadata %v", i, got.Labels, got.Metadata)
+		}
+	}
+
+	if listed, err := b.Storage.ListProfiles("missing"); err != nil || len(listed) != 0 {
+		t.Errorf("ListProfiles of a missing session: got %d profiles, err %v", len(listed), err)
+	}
+}
+
+func testProfileKinds(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+
+	// A pprof goroutine profile, its text dump and a trace recorded in the
+	// same second are distinct profiles
+	pprofProfile := saveProfile(t, b.Storage, "s1", types.ProfileTypeGoroutine, at(0), nil)
+	dump := &types.ProfileData{
+		SessionID: "s1",
+		Type:      types.ProfileTypeGoroutine,
+		Timestamp: at(0),
+		Data:      []byte("goroutine 1 [running]:"),
+		Metadata:  map[string]interface{}{"format": types.ProfileFormatText},
+	}
+	if err := b.Storage.SaveProfileData(dump); err != nil {
+		t.Fatalf("SaveProfileData(dump): %v", err)
+	}
+	trace := saveProfile(t, b.Storage, "s1", types.ProfileTypeTrace, at(0), nil)
+
+	profiles := getProfiles(t, b.Storage, "s1")
+	if len(profiles) != 3 {
+		t.Fatalf("GetProfileData: got %q, want 3 profiles", payloads(profiles))
+	}
+
+	found := make(map[string]bool)
+	for _, p := range profiles {
+		found[string(p.Data)] = true
+	}
+	for _, want := range []*types.ProfileData{pprofProfile, dump, trace} {
+		if !found[string(want.Data)] {
+			t.Errorf("GetProfileData: missing %q", want.Data)
+		}
+	}
+}
+
+func testQueryProfileData(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	saveSession(t, b.Storage, "s2", "app", nil)
+	saveSession(t, b.Storage, "other", "other-app", nil)
+
+	// Saved out of order and interleaved across sessions
+	cpu3 := saveProfile(t, b.Storage, "s2", types.ProfileTypeCPU, at(30), nil)
+	cpu1 := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(10), nil)
+	heap2 := saveProfile(t, b.Storage, "s1", types.ProfileTypeHeap, at(20), nil)
+	cpu4 := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(40), nil)
+	saveProfile(t, b.Storage, "other", types.ProfileTypeCPU, at(20), nil)
+
+	for _, tt := range []struct {
+		name  string
+		query storage.ProfileQuery
+		want  []*types.ProfileData
+	}{
+		{"all", storage.ProfileQuery{ApplicationID: "app"}, []*types.ProfileData{cpu1, heap2, cpu3, cpu4}},
+		{"type", storage.ProfileQuery{ApplicationID: "app", Type: types.ProfileTypeCPU}, []*types.ProfileData{cpu1, cpu3, cpu4}},
+		{"range", storage.ProfileQuery{ApplicationID: "app", From: at(20), To: at(30)}, []*types.ProfileData{heap2, cpu3}},
+		{"from", storage.ProfileQuery{ApplicationID: "app", From: at(25)}, []*types.ProfileData{cpu3, cpu4}},
+		{"to", storage.ProfileQuery{ApplicationID: "app", To: at(15)}, []*types.ProfileData{cpu1}},
+		{"empty range", storage.ProfileQuery{ApplicationID: "app", From: at(41)}, nil},
+		{"unknown application", storage.ProfileQuery{ApplicationID: "missing"}, nil},
+	} {
+		expectPayloads(t, "QueryProfileData "+tt.name, query(t, b.Storage, tt.query), tt.want...)
+	}
+
+	// A metadata only query selects the same profiles without their payloads
+	listed := query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app", Type: types.ProfileTypeCPU, MetadataOnly: true})
+	if len(listed) != 3 {
+		t.Fatalf("QueryProfileData metadata only: got %d profiles, want 3", len(listed))
+	}
+	for i, want := range []*types.ProfileData{cpu1, cpu3, cpu4} {
+		got := listed[i]
+		if got.ID != want.ID || got.SessionID != want.SessionID || !got.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("QueryProfileData metadata only: profile %d is %s/%s at %v, want %s/%s at %v",
+				i, got.SessionID, got.ID, got.Timestamp, want.SessionID, want.ID, want.Timestamp)
+		}
+		if got.Data != nil || got.Size != len(want.Data) {
+			t.Errorf("QueryProfileData metadata only: profile %d has %d bytes of payload and size %d, want none and %d",
+				i, len(got.Data), got.Size, len(want.Data))
+		}
+	}
+}
+
+func testQueryLabels(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "v1", "app", types.Labels{"version": "1.4.2", "region": "eu"})
+	saveSession(t, b.Storage, "v2", "app", types.Labels{"version": "1.4.3", "region": "eu"})
+
+	old := saveProfile(t, b.Storage, "v1", types.ProfileTypeCPU, at(0), nil)
+	current := saveProfile(t, b.Storage, "v2", types.ProfileTypeCPU, at(10), nil)
+	// A profile's own labels override its session's
+	moved := saveProfile(t, b.Storage, "v2", types.ProfileTypeCPU, at(20), types.Labels{"region": "us", "pod": "p1"})
+
+	for _, tt := range []struct {
+		labels types.Labels
+		want   []*types.ProfileData
+	}{
+		{types.Labels{"region": "eu"}, []*types.ProfileData{old, current}},
+		{types.Labels{"version": "1.4.3"}, []*types.ProfileData{current, moved}},
+		{types.Labels{"version": "1.4.3", "region": "us"}, []*types.ProfileData{moved}},
+		{types.Labels{"pod": "p1"}, []*types.ProfileData{moved}},
+		{types.Labels{"version": "2.0.0"}, nil},
+	} {
+		got := query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app", Labels: tt.labels})
+		expectPayloads(t, "QueryProfileData labels "+tt.labels.String(), got, tt.want...)
+	}
+}
+
+func testProfilesBeforeSession(t *testing.T, b Backend) {
+	// Uploads may create profiles before their session is saved
+	early := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+
+	if got := query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"}); len(got) != 0 {
+		t.Errorf("QueryProfileData before the session exists: got %q", payloads(got))
+	}
+
+	saveSession(t, b.Storage, "s1", "app", types.Labels{"version": "1.4.2"})
+	got := query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app", Labels: types.Labels{"version": "1.4.2"}})
+	expectPayloads(t, "QueryProfileData once the session exists", got, early)
+}
+
+func testMetrics(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+
+	for i := 0; i < 3; i++ {
+		snapshot := &types.MetricsSnapshot{
+			Timestamp:      at(i),
+			CPUPercent:     float64(i),
+			MemoryUsed:     uint64(i) * 1024,
+			GoroutineCount: i + 1,
+		}
+		if err := b.Storage.SaveMetrics("s1", snapshot); err != nil {
+			t.Fatalf("SaveMetrics: %v", err)
+		}
+	}
+
+	metrics, err := b.Storage.GetMetrics("s1")
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("GetMetrics: got %d snapshots, want 3", len(metrics))
+	}
+	for i, m := range metrics {
+		if !m.Timestamp.Equal(at(i)) || m.CPUPercent != float64(i) || m.MemoryUsed != uint64(i)*1024 || m.GoroutineCount != i+1 {
+			t.Errorf("snapshot %d: got %+v", i, m)
+		}
+	}
+}
+
+func testDeleteProfile(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	first := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+	second := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(10), nil)
+	trace := saveProfile(t, b.Storage, "s1", types.ProfileTypeTrace, at(10), nil)
+
+	// Two profiles sharing a payload
+	shared := &types.ProfileData{SessionID: "s1", Type: types.ProfileTypeHeap, Timestamp: at(20), Data: []byte("shared")}
+	sharedLater := &types.ProfileData{SessionID: "s1", Type: types.ProfileTypeHeap, Timestamp: at(30), Data: []byte("shared")}
+	for _, p := range []*types.ProfileData{shared, sharedLater} {
+		if err := b.Storage.SaveProfileData(p); err != nil {
+			t.Fatalf("SaveProfileData: %v", err)
+		}
+	}
+
+	// Records read back carry the ID they are deleted by
+	for _, p := range getProfiles(t, b.Storage, "s1") {
+		if p.ID == second.ID || p.ID == shared.ID {
+			if err := b.Storage.DeleteProfileData(p.SessionID, p.ID); err != nil {
+				t.Fatalf("DeleteProfileData: %v", err)
+			}
+		}
+	}
+
+	got := getProfiles(t, b.Storage, "s1")
+	expectPayloads(t, "GetProfileData after deleting two profiles", got, first, trace, sharedLater)
+	expectPayloads(t, "QueryProfileData after delete", query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"}), first, trace, sharedLater)
+
+	if err := b.Storage.DeleteProfileData("s1", second.ID); err != nil {
+		t.Errorf("DeleteProfileData of a deleted profile: %v", err)
+	}
+	if err := b.Storage.DeleteProfileData("missing", second.ID); err != nil {
+		t.Errorf("DeleteProfileData of a missing session: %v", err)
+	}
+
+	// Deleting every profile leaves the session able to store new ones
+	for _, p := range []*types.ProfileData{first, trace, sharedLater} {
+		if err := b.Storage.DeleteProfileData("s1", p.ID); err != nil {
+			t.Fatalf("DeleteProfileData: %v", err)
+		}
+	}
+	if got := getProfiles(t, b.Storage, "s1"); len(got) != 0 {
+		t.Errorf("GetProfileData after deleting every profile: got %q", payloads(got))
+	}
+	again := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+	expectPayloads(t, "GetProfileData after saving a deleted profile again", getProfiles(t, b.Storage, "s1"), again)
+}
+
+func testDeleteMetrics(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "s1", "app", nil)
+	for i := 0; i < 4; i++ {
+		if err := b.Storage.SaveMetrics("s1", &types.MetricsSnapshot{Timestamp: at(i * 10)}); err != nil {
+			t.Fatalf("SaveMetrics: %v", err)
+		}
+	}
+
+	if removed, err := b.Storage.DeleteMetrics("s1", at(20)); err != nil || removed != 2 {
+		t.Fatalf("DeleteMetrics: removed %d, %v; want 2", removed, err)
+	}
+	if removed, err := b.Storage.DeleteMetrics("s1", at(20)); err != nil || removed != 0 {
+		t.Errorf("DeleteMetrics again: removed %d, %v; want 0", removed, err)
+	}
+
+	metrics, err := b.Storage.GetMetrics("s1")
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	if len(metrics) != 2 || !metrics[0].Timestamp.Equal(at(20)) || !metrics[1].Timestamp.Equal(at(30)) {
+		t.Errorf("GetMetrics after DeleteMetrics: got %d snapshots", len(metrics))
+	}
+
+	// Snapshots keep being appended after a deletion
+	if err := b.Storage.SaveMetrics("s1", &types.MetricsSnapshot{Timestamp: at(40)}); err != nil {
+		t.Fatalf("SaveMetrics: %v", err)
+	}
+	if removed, err := b.Storage.DeleteMetrics("s1", at(100)); err != nil || removed != 3 {
+		t.Fatalf("DeleteMetrics of every snapshot: removed %d, %v; want 3", removed, err)
+	}
+	if metrics, err := b.Storage.GetMetrics("s1"); err != nil || len(metrics) != 0 {
+		t.Errorf("GetMetrics after deleting every snapshot: got %d snapshots, err %v", len(metrics), err)
+	}
+
+	if removed, err := b.Storage.DeleteMetrics("missing", at(0)); err != nil || removed != 0 {
+		t.Errorf("DeleteMetrics of a missing session: removed %d, %v", removed, err)
+	}
+}
+
+// testDeleteMetricsWhileSaving deletes old snapshots while new and old ones
+// are appended: every old snapshot is counted once and no new one is lost
+func testDeleteMetricsWhileSaving(t *testing.T, b Backend) {
+	const writes = 50
+
+	saveSession(t, b.Storage, "s1", "app", nil)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		removed int
+	)
+	errs := make(chan error, writes*3)
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			errs <- b.Storage.SaveMetrics("s1", &types.MetricsSnapshot{Timestamp: at(0)})
+			errs <- b.Storage.SaveMetrics("s1", &types.MetricsSnapshot{Timestamp: at(20)})
+
+			n, err := b.Storage.DeleteMetrics("s1", at(10))
+			errs <- err
+			mu.Lock()
+			removed += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent metrics write: %v", err)
+		}
+	}
+
+	// Every delete ran after its own old snapshot was saved
+	if removed != writes {
+		t.Errorf("DeleteMetrics removed %d snapshots in total, want %d", removed, writes)
+	}
+	metrics, err := b.Storage.GetMetrics("s1")
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	if len(metrics) != writes {
+		t.Errorf("GetMetrics: got %d snapshots, want %d", len(metrics), writes)
+	}
+	for _, m := range metrics {
+		if !m.Timestamp.Equal(at(20)) {
+			t.Errorf("GetMetrics: snapshot at %v survived", m.Timestamp)
+		}
+	}
+}
+
+func testDeleteCascade(t *testing.T, b Backend) {
+	saveSession(t, b.Storage, "doomed", "app", nil)
+	saveSession(t, b.Storage, "kept", "app", nil)
+	saveProfile(t, b.Storage, "doomed", types.ProfileTypeCPU, at(0), nil)
+	kept := saveProfile(t, b.Storage, "kept", types.ProfileTypeCPU, at(10), nil)
+	for _, id := range []string{"doomed", "kept"} {
+		if err := b.Storage.SaveMetrics(id, &types.MetricsSnapshot{Timestamp: at(0)}); err != nil {
+			t.Fatalf("SaveMetrics(%s): %v", id, err)
+		}
+	}
+
+	if err := b.Storage.DeleteSession("doomed"); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+
+	if _, err := b.Storage.GetSession("doomed"); err == nil {
+		t.Error("GetSession after delete: expected an error")
+	}
+	if ids := sessionIDs(mustList(t, b.Storage, "")); ids["doomed"] || !ids["kept"] {
+		t.Errorf("ListSessions after delete: got %v", ids)
+	}
+	if profiles := getProfiles(t, b.Storage, "doomed"); len(profiles) != 0 {
+		t.Errorf("GetProfileData after delete: got %d profiles", len(profiles))
+	}
+	if metrics, err := b.Storage.GetMetrics("doomed"); err != nil || len(metrics) != 0 {
+		t.Errorf("GetMetrics after delete: got %d snapshots, err %v", len(metrics), err)
+	}
+	expectPayloads(t, "QueryProfileData after delete", query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"}), kept)
+
+	if metrics, err := b.Storage.GetMetrics("kept"); err != nil || len(metrics) != 1 {
+		t.Errorf("GetMetrics of the kept session: got %d snapshots, err %v", len(metrics), err)
+	}
+
+	// A session recreated with the same ID starts empty
+	saveSession(t, b.Storage, "doomed", "app", nil)
+	if profiles := getProfiles(t, b.Storage, "doomed"); len(profiles) != 0 {
+		t.Errorf("GetProfileData of a recreated session: got %d profiles", len(profiles))
+	}
+}
+
+func testDeleteMissing(t *testing.T, b Backend) {
+	if err := b.Storage.DeleteSession("missing"); err != nil {
+		t.Errorf("DeleteSession of a missing session: %v", err)
+	}
+
+	// Profiles and metrics without a session record are still removed
+	saveProfile(t, b.Storage, "orphan", types.ProfileTypeCPU, at(0), nil)
+	if err := b.Storage.SaveMetrics("orphan", &types.MetricsSnapshot{Timestamp: at(0)}); err != nil {
+		t.Fatalf("SaveMetrics: %v", err)
+	}
+	if err := b.Storage.DeleteSession("orphan"); err != nil {
+		t.Fatalf("DeleteSession of a session without a record: %v", err)
+	}
+	if profiles := getProfiles(t, b.Storage, "orphan"); len(profiles) != 0 {
+		t.Errorf("GetProfileData after deleting an orphan: got %d profiles", len(profiles))
+	}
+}
+
+func testConcurrentWriters(t *testing.T, b Backend) {
+	const (
+		sessions = 4
+		profiles = 25
+	)
+
+	for i := 0; i < sessions; i++ {
+		saveSession(t, b.Storage, fmt.Sprintf("s%d", i), "app", nil)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions*profiles*2)
+	for i := 0; i < sessions; i++ {
+		for j := 0; j < profiles; j++ {
+			wg.Add(1)
+			go func(sessionID string, j int) {
+				defer wg.Done()
+
+				errs <- b.Storage.SaveProfileData(&types.ProfileData{
+					SessionID: sessionID,
+					Type:      types.ProfileTypeCPU,
+					Timestamp: at(j),
+					Data:      bytes.Repeat([]byte{byte(j)}, 64*1024),
+				})
+				errs <- b.Storage.SaveMetrics(sessionID, &types.MetricsSnapshot{Timestamp: at(j)})
+
+				// Readers run alongside the writers
+				if _, err := b.Storage.GetProfileData(sessionID); err != nil {
+					errs <- err
+				}
+			}(fmt.Sprintf("s%d", i), j)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write: %v", err)
+		}
+	}
+
+	for i := 0; i < sessions; i++ {
+		sessionID := fmt.Sprintf("s%d", i)
+
+		got := getProfiles(t, b.Storage, sessionID)
+		if len(got) != profiles {
+			t.Errorf("GetProfileData(%s): got %d profiles, want %d", sessionID, len(got), profiles)
+		}
+		for _, p := range got {
+			if len(p.Data) != 64*1024 || p.Data[0] != byte(p.Timestamp.Sub(baseTime)/time.Second) {
+				t.Errorf("GetProfileData(%s): torn payload at %v", sessionID, p.Timestamp)
+			}
+		}
+
+		metrics, err := b.Storage.GetMetrics(sessionID)
+		if err != nil || len(metrics) != profiles {
+			t.Errorf("GetMetrics(%s): got %d snapshots, err %v", sessionID, len(metrics), err)
+		}
+	}
+
+	if got := query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"}); len(got) != sessions*profiles {
+		t.Errorf("QueryProfileData: got %d profiles, want %d", len(got), sessions*profiles)
+	}
+}
+
+func testCorruptedProfiles(t *testing.T, b Backend) {
+	if b.Corrupt == nil {
+		t.Skip("backend cannot corrupt its records")
+	}
+
+	saveSession(t, b.Storage, "broken", "app", nil)
+	saveSession(t, b.Storage, "healthy", "app", nil)
+	saveProfile(t, b.Storage, "broken", types.ProfileTypeCPU, at(0), nil)
+	saveProfile(t, b.Storage, "broken", types.ProfileTypeHeap, at(0), nil)
+	healthy := saveProfile(t, b.Storage, "healthy", types.ProfileTypeCPU, at(10), nil)
+
+	if err := b.Corrupt("broken"); err != nil {
+		t.Fatalf("Corrupt: %v", err)
+	}
+
+	// Unreadable profiles are skipped rather than failing the whole read
+	if got := getProfiles(t, b.Storage, "broken"); len(got) != 0 {
+		t.Errorf("GetProfileData of corrupted profiles: got %q", payloads(got))
+	}
+	expectPayloads(t, "QueryProfileData with corrupted profiles", query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"}), healthy)
+
+	// The session keeps working for new profiles
+	fresh := saveProfile(t, b.Storage, "broken", types.ProfileTypeCPU, at(20), nil)
+	expectPayloads(t, "GetProfileData after a new profile", getProfiles(t, b.Storage, "broken"), fresh)
+
+	if err := b.Storage.DeleteSession("broken"); err != nil {
+		t.Errorf("DeleteSession of a corrupted session: %v", err)
+	}
+}
+
+// invalidIDs are rejected by every method. Most would name a path outside
+// the storage if they were joined to it.
+var invalidIDs = []string{
+	"",
+	".",
+	"..",
+	"../victim",
+	"../../victim",
+	"../../../victim",
+	"a/../../victim",
+	"victim/..",
+	"/tmp/victim",
+	`..\victim`,
+	`a\b`,
+	".hidden",
+	"a b",
+	"a\x00b",
+	"a\nb",
+	strings.Repeat("a", types.MaxIDLength+1),
+}
+
+func testInvalidIDs(t *testing.T, b Backend) {
+	var root string
+	if b.Dir != "" {
+		// Files the invalid IDs would reach, next to and inside the storage
+		root = filepath.Dir(b.Dir)
+		for _, dir := range []string{root, b.Dir} {
+			for _, name := range []string{"victim.json", filepath.Join("victim", "manifest.jsonl"), filepath.Join("victim", "metrics.jsonl")} {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("victim"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	saveSession(t, b.Storage, "s1", "app", nil)
+	saved := saveProfile(t, b.Storage, "s1", types.ProfileTypeCPU, at(0), nil)
+	before := snapshot(t, root)
+
+	for _, id := range invalidIDs {
+		calls := []struct {
+			name string
+			call func() error
+		}{
+			{"SaveSession", func() error {
+				return b.Storage.SaveSession(&types.ProfileSession{ID: id, ApplicationID: "app", StartTime: baseTime})
+			}},
+			{"GetSession", func() error { _, err := b.Storage.GetSession(id); return err }},
+			{"DeleteSession", func() error { return b.Storage.DeleteSession(id) }},
+			{"SaveProfileData", func() error {
+				return b.Storage.SaveProfileData(&types.ProfileData{SessionID: id, Type: types.ProfileTypeCPU, Timestamp: at(0), Data: []byte("escaped")})
+			}},
+			{"GetProfileData", func() error { _, err := b.Storage.GetProfileData(id); return err }},
+			{"ListProfiles", func() error { _, err := b.Storage.ListProfiles(id); return err }},
+			{"GetProfile(session)", func() error { _, err := b.Storage.GetProfile(id, saved.ID); return err }},
+			{"GetProfile(profile)", func() error { _, err := b.Storage.GetProfile("s1", id); return err }},
+			{"DeleteProfileData(session)", func() error { return b.Storage.DeleteProfileData(id, saved.ID) }},
+			{"DeleteProfileData(profile)", func() error { return b.Storage.DeleteProfileData("s1", id) }},
+			{"SaveMetrics", func() error { return b.Storage.SaveMetrics(id, &types.MetricsSnapshot{Timestamp: at(0)}) }},
+			{"GetMetrics", func() error { _, err := b.Storage.GetMetrics(id); return err }},
+			{"DeleteMetrics", func() error { _, err := b.Storage.DeleteMetrics(id, at(100)); return err }},
+		}
+
+		for _, c := range calls {
+			if err := c.call(); !errors.Is(err, types.ErrInvalidID) {
+				t.Errorf("%s(%q): got %v, want an error wrapping types.ErrInvalidID", c.name, id, err)
+			}
+		}
+	}
+
+	if after := snapshot(t, root); !equalSnapshots(before, after) {
+		t.Errorf("calls with invalid IDs changed files:\nbefore %v\nafter  %v", before, after)
+	}
+
+	if ids := sessionIDs(mustList(t, b.Storage, "")); len(ids) != 1 || !ids["s1"] {
+		t.Errorf("ListSessions after calls with invalid IDs: got %v", ids)
+	}
+	expectPayloads(t, "QueryProfileData after calls with invalid IDs", query(t, b.Storage, storage.ProfileQuery{ApplicationID: "app"}), saved)
+}
+
+func testValidIDs(t *testing.T, b Backend) {
+	// IDs generated by the agents and the server
+	for _, id := range []string{"my-app_1736863200000000000", types.NewSessionID("team/service v2"), types.NewSessionID(""), "a", "v1.4.2", "A_b-C.d", strings.Repeat("a", types.MaxIDLength)} {
+		saveSession(t, b.Storage, id, "app", nil)
+		saved := saveProfile(t, b.Storage, id, types.ProfileTypeCPU, at(0), nil)
+		if _, err := b.Storage.GetProfile(id, saved.ID); err != nil {
+			t.Errorf("GetProfile(%q): %v", id, err)
+		}
+		if err := b.Storage.DeleteSession(id); err != nil {
+			t.Errorf("DeleteSession(%q): %v", id, err)
+		}
+	}
+}
+
+// snapshot records the files below root and their contents, or nothing when
+// root is empty
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	if root == "" {
+		return files
+	}
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			files[path] = "dir"
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[path] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("snapshot %s: %v", root, err)
+	}
+	return files
+}
+
+func equalSnapshots(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, content := range a {
+		if other, ok := b[path]; !ok || other != content {
+			return false
+		}
+	}
+	return true
+}
+
+func mustList(t *testing.T, s storage.Storage, applicationID string) []*types.ProfileSession {
+	t.Helper()
+
+	sessions, err := s.ListSessions(applicationID)
+	if err != nil {
+		t.Fatalf("ListSessions(%q): %v", applicationID, err)
+	}
+	return sessions
+}
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxIDLength is the longest accepted session or profile ID
+const MaxIDLength = 128
+
+// ErrInvalidID is wrapped by the errors of ValidateID
+var ErrInvalidID = errors.New("invalid ID")
+
+// Session and profile IDs name files and directories, so they are limited to
+// characters that cannot form a path: no separators, and no leading dot so
+// that "." and ".." are rejected too
+var idPattern = regexp.MustCompile(`^[a-zA-Z0-9_\-][a-zA-Z0-9_.\-]*$`)
+
+// ValidateID checks that id is a valid session or profile ID: 1 to
+// MaxIDLength letters, digits, '_', '-' or '.', not starting with '.'
+func ValidateID(id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidID)
+	}
+	if len(id) > MaxIDLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidID, MaxIDLength)
+	}
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%w %q: use letters, digits, '_', '-' and '.', not starting with '.'", ErrInvalidID, id)
+	}
+	return nil
+}
+
+// maxIDPrefix bounds the prefix of generated session IDs, leaving room for
+// the time and random suffix
+const maxIDPrefix = 64
+
+var idInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// NewSessionID returns a new random session ID that starts with prefix,
+// usually the application ID, and sorts by creation time after it, such as
+// "checkout_20250114-140000-3f9a1c0b7d2e". Characters of prefix that IDs do
+// not allow are replaced by '_'.
+func NewSessionID(prefix string) string {
+	var b [6]byte
+	rand.Read(b[:])
+	id := time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b[:])
+
+	prefix = strings.TrimLeft(idInvalidChars.ReplaceAllString(prefix, "_"), ".")
+	if len(prefix) > maxIDPrefix {
+		prefix = prefix[:maxIDPrefix]
+	}
+	if prefix == "" {
+		return id
+	}
+	return prefix + "_" + id
+}
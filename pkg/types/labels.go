@@ -0,0 +1,92 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Labels are string key/value pairs attached to sessions and profiles, such
+// as service, version, region, pod or git_sha. Their text form is
+// "key=value,key=value".
+type Labels map[string]string
+
+var labelKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.\-/]*$`)
+
+// ParseLabels parses the text form of a label set. An empty string yields nil.
+func ParseLabels(s string) (Labels, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	labels := make(Labels)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", pair)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	if err := labels.Validate(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// Validate checks that keys are identifiers and that no key or value holds a
+// character reserved by the text form
+func (l Labels) Validate() error {
+	for key, value := range l {
+		if !labelKey.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if strings.ContainsAny(value, ",=") {
+			return fmt.Errorf("invalid value for label %s: must not contain ',' or '='", key)
+		}
+	}
+	return nil
+}
+
+// String returns the text form of the labels with keys sorted
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + l[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Matches reports whether every label of the selector is present with the
+// same value. An empty selector matches everything.
+func (l Labels) Matches(selector Labels) bool {
+	for key, value := range selector {
+		if v, ok := l[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeLabels combines label sets, later sets overriding earlier ones. It
+// returns nil when every set is empty.
+func MergeLabels(sets ...Labels) Labels {
+	var merged Labels
+	for _, set := range sets {
+		for key, value := range set {
+			if merged == nil {
+				merged = make(Labels)
+			}
+			merged[key] = value
+		}
+	}
+	return merged
+}
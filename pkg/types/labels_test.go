@@ -0,0 +1,92 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Labels
+		valid bool
+	}{
+		{"", nil, true},
+		{"  ", nil, true},
+		{"version=1.4.2", Labels{"version": "1.4.2"}, true},
+		{" region = eu , pod=p-1 ", Labels{"region": "eu", "pod": "p-1"}, true},
+		{"k8s.io/app=api,git_sha=", Labels{"k8s.io/app": "api", "git_sha": ""}, true},
+		{"version", nil, false},
+		{"version=1=2", nil, false},
+		{"1version=1", nil, false},
+		{"=1", nil, false},
+		{"version=1,", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseLabels(tt.input)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseLabels(%q) error = %v, want valid %v", tt.input, err, tt.valid)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLabels(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestLabelsString(t *testing.T) {
+	labels := Labels{"version": "1.4.2", "region": "eu", "pod": "p1"}
+	if got, want := labels.String(), "pod=p1,region=eu,version=1.4.2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	parsed, err := ParseLabels(labels.String())
+	if err != nil || !reflect.DeepEqual(parsed, labels) {
+		t.Errorf("ParseLabels(String()) = %v, %v; want %v", parsed, err, labels)
+	}
+
+	if err := (Labels{"pod": "a,b"}).Validate(); err == nil {
+		t.Error("Validate accepted a value holding a comma")
+	}
+}
+
+func TestLabelsMatches(t *testing.T) {
+	labels := Labels{"version": "1.4.2", "region": "eu", "canary": ""}
+
+	tests := []struct {
+		selector Labels
+		want     bool
+	}{
+		{nil, true},
+		{Labels{"version": "1.4.2"}, true},
+		{Labels{"version": "1.4.2", "region": "eu"}, true},
+		{Labels{"canary": ""}, true},
+		{Labels{"version": "1.4.3"}, false},
+		{Labels{"version": "1.4.2", "region": "us"}, false},
+		{Labels{"pod": ""}, false},
+	}
+	for _, tt := range tests {
+		if got := labels.Matches(tt.selector); got != tt.want {
+			t.Errorf("Matches(%v) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+	if (Labels(nil)).Matches(Labels{"version": "1.4.2"}) {
+		t.Error("empty labels matched a selector")
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	if got := MergeLabels(nil, Labels{}); got != nil {
+		t.Errorf("MergeLabels of empty sets = %v, want nil", got)
+	}
+
+	session := Labels{"version": "1.4.2", "region": "eu"}
+	got := MergeLabels(session, Labels{"region": "us", "pod": "p1"})
+	want := Labels{"version": "1.4.2", "region": "us", "pod": "p1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeLabels = %v, want %v", got, want)
+	}
+	if session["region"] != "eu" {
+		t.Error("MergeLabels modified its input")
+	}
+}
@@ -14,14 +14,43 @@ const (
 	ProfileTypeBlock  ProfileType = "block"
 	ProfileTypeMutex  ProfileType = "mutex"
 	ProfileTypeHeap   ProfileType = "heap"
+
+	ProfileTypeGoroutine    ProfileType = "goroutine"
+	ProfileTypeThreadCreate ProfileType = "threadcreate"
+	ProfileTypeAllocs       ProfileType = "allocs"
+
+	// ProfileTypeTrace is a runtime/trace execution trace, not a pprof profile
+	ProfileTypeTrace ProfileType = "trace"
 )
 
+// Valid reports whether t is one of the known profile types
+func (t ProfileType) Valid() bool {
+	switch t {
+	case ProfileTypeCPU, ProfileTypeMemory, ProfileTypeIO, ProfileTypeBlock, ProfileTypeMutex, ProfileTypeHeap,
+		ProfileTypeGoroutine, ProfileTypeThreadCreate, ProfileTypeAllocs, ProfileTypeTrace:
+		return true
+	}
+	return false
+}
+
+// ProfileFormatText marks ProfileData whose payload is a text dump rather than
+// pprof protobuf, such as a goroutine dump taken with debug=2. It is stored
+// under the "format" metadata key.
+const ProfileFormatText = "text"
+
+// MetadataCompacted is the metadata key set to true on profiles that
+// retention compaction merged from the older profiles of a time window
+const MetadataCompacted = "compacted"
+
 // ProfileMode represents how the profiling was initiated
 type ProfileMode string
 
 const (
 	ProfileModeEmbedded ProfileMode = "embedded"
 	ProfileModeSidecar  ProfileMode = "sidecar"
+	// ProfileModeContinuous sessions are long-lived and hold back-to-back
+	// profiling windows
+	ProfileModeContinuous ProfileMode = "continuous"
 )
 
 // ProfileSession represents a profiling session
@@ -35,19 +64,23 @@ type ProfileSession struct {
 	Duration      time.Duration          `json:"duration"`
 	ProfileType   ProfileType            `json:"profile_type"`
 	Mode          ProfileMode            `json:"mode"`
+	Labels        Labels                 `json:"labels,omitempty"`
 	Metadata      map[string]interface{} `json:"metadata"`
 	DataPath      string                 `json:"data_path"`
 }
 
 // ProfileData represents collected profiling data
 type ProfileData struct {
+	ID          string                 `json:"id,omitempty"` // assigned by storage
 	SessionID   string                 `json:"session_id"`
 	Type        ProfileType            `json:"type"`
 	Timestamp   time.Time              `json:"timestamp"`
-	Data        []byte                 `json:"data"` // pprof format
+	Data        []byte                 `json:"data,omitempty"` // pprof format
+	Labels      Labels                 `json:"labels,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata"`
 	SampleRate  int                    `json:"sample_rate"`
 	SampleCount int64                  `json:"sample_count"`
+	Size        int                    `json:"size,omitempty"` // payload bytes, set by storage
 }
 
 // CallGraphNode represents a node in the call graph
@@ -63,10 +96,14 @@ type CallGraphNode struct {
 	Metadata     map[string]interface{} `json:"metadata,omitempty"`
 }
 
-// FlameGraphFrame represents a frame in the flame graph
+// FlameGraphFrame represents a frame in the flame graph. Base, Target and
+// Delta are only set on differential flame graphs, where Value is the target.
 type FlameGraphFrame struct {
 	Name     string             `json:"name"`
 	Value    float64            `json:"value"`
+	Base     float64            `json:"base,omitempty"`
+	Target   float64            `json:"target,omitempty"`
+	Delta    float64            `json:"delta,omitempty"`
 	Children []*FlameGraphFrame `json:"children,omitempty"`
 }
 
@@ -94,6 +131,14 @@ type ProfilingConfig struct {
 	SampleRate      int           `json:"sample_rate"`
 	CollectMetrics  bool          `json:"collect_metrics"`
 	MetricsInterval time.Duration `json:"metrics_interval"`
+	// GoroutineStacks also sends a full text goroutine dump (debug=2) with
+	// goroutine profiles
+	GoroutineStacks bool `json:"goroutine_stacks,omitempty"`
+	// Window switches the session to continuous mode: every profile type is
+	// recorded in back-to-back windows of this length until the session stops
+	Window time.Duration `json:"window,omitempty"`
+	// Labels are added to the agent's labels for this session only
+	Labels Labels `json:"labels,omitempty"`
 }
 
 // AgentConfig represents configuration for the profiling agent
@@ -105,4 +150,12 @@ type AgentConfig struct {
 	Mode            ProfileMode   `json:"mode"`
 	AutoProfile     bool          `json:"auto_profile"`
 	ProfileInterval time.Duration `json:"profile_interval"`
+	// Continuous makes AutoProfile record a single continuous session of
+	// WindowDuration windows instead of a new session every ProfileInterval
+	Continuous     bool          `json:"continuous,omitempty"`
+	WindowDuration time.Duration `json:"window_duration,omitempty"`
+	// Labels are attached to every session and profile of the agent
+	Labels Labels `json:"labels,omitempty"`
+	// APIKey is sent with every request when the collector requires one
+	APIKey string `json:"api_key,omitempty"`
 }
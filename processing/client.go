@@ -1 +1,116 @@
 package processing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/King-kin5/analysis/pkg/types"
+)
+
+// Client sends profiling data to a collector over its HTTP API
+type Client struct {
+	serverURL  string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewClient creates a new collector client. A nil httpClient uses a client
+// with a 30 second timeout.
+func NewClient(serverURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &Client{
+		serverURL:  strings.TrimRight(serverURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// SetAPIKey sets the API key sent with every request
+func (c *Client) SetAPIKey(key string) {
+	c.apiKey = key
+}
+
+// SendSession creates or updates a session on the collector
+func (c *Client) SendSession(ctx context.Context, session *types.ProfileSession) error {
+	return c.post(ctx, "/api/v1/sessions", session)
+}
+
+// SendProfileData uploads one profile to the collector
+func (c *Client) SendProfileData(ctx context.Context, data *types.ProfileData) error {
+	return c.post(ctx, "/api/v1/profiles", data)
+}
+
+// UploadProfile uploads one profile as a raw application/octet-stream body.
+// It suits large payloads such as execution traces, which would otherwise be
+// base64 encoded inside JSON.
+func (c *Client) UploadProfile(ctx context.Context, applicationID string, data *types.ProfileData) error {
+	query := url.Values{}
+	query.Set("session_id", data.SessionID)
+	query.Set("application_id", applicationID)
+	query.Set("type", string(data.Type))
+	query.Set("timestamp", data.Timestamp.Format(time.RFC3339))
+	if len(data.Labels) > 0 {
+		query.Set("labels", data.Labels.String())
+	}
+
+	path := "/api/v1/profiles"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serverURL+path+"?"+query.Encode(), bytes.NewReader(data.Data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	return c.do(req, path)
+}
+
+// SendMetrics uploads a metrics snapshot for a session
+func (c *Client) SendMetrics(ctx context.Context, sessionID string, metrics *types.MetricsSnapshot) error {
+	payload := map[string]interface{}{
+		"session_id": sessionID,
+		"metrics":    metrics,
+	}
+	return c.post(ctx, "/api/v1/metrics", payload)
+}
+
+func (c *Client) post(ctx context.Context, path string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serverURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, path)
+}
+
+func (c *Client) do(req *http.Request, path string) error {
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("POST %s failed: %d %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}